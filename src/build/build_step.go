@@ -4,9 +4,11 @@ package build
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
@@ -51,9 +53,11 @@ func Build(tid int, state *core.BuildState, label core.BuildLabel) {
 			log.Errorf("Failed to remove outputs for %s: %s", target.Label, err)
 		}
 		target.SetState(core.Failed)
+		state.RequeueWaitingTests()
 		return
 	}
 	metrics.Record(target, time.Since(start))
+	state.RequeueWaitingTests()
 
 	// Add any of the reverse deps that are now fully built to the queue.
 	for _, reverseDep := range state.Graph.ReverseDependencies(target) {
@@ -137,6 +141,12 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 		return buildFilegroup(tid, state, target)
 	}
 	oldOutputHash, outputHashErr := OutputHash(target)
+	// Whatever matched the output globs last time gets rediscovered by building or retrieving
+	// from the cache; anything that doesn't turn up again is removed at that point.
+	// They won't have been loaded yet if we're rebuilding because a dependency changed.
+	loadGlobOutputs(target)
+	oldGlobOutputs := target.GlobOutputs()
+	target.SetGlobOutputs(nil)
 	if err := prepareDirectories(target); err != nil {
 		return fmt.Errorf("Error preparing directories for %s: %s", target.Label, err)
 	}
@@ -147,15 +157,23 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 		goDirOnce.Do(createPlzOutGo)
 	}
 
+	cacheKey := mustShortTargetHash(state, target)
 	retrieveArtifacts := func() bool {
 		state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Checking cache...")
+		if !retrieveGlobOutputs(state, target, cacheKey) {
+			return false
+		}
 		if _, retrieved := retrieveFromCache(state, target); retrieved {
 			log.Debug("Retrieved artifacts for %s from cache", target.Label)
+			if err := removeStaleGlobOutputs(target, oldGlobOutputs); err != nil {
+				log.Warning("Failed to remove old outputs of %s: %s", target.Label, err)
+			}
 			checkLicences(state, target)
 			newOutputHash, err := calculateAndCheckRuleHash(state, target)
 			if err != nil { // Most likely hash verification failure
 				log.Warning("Error retrieving cached artifacts for %s: %s", target.Label, err)
 				RemoveOutputs(target)
+				target.SetGlobOutputs(nil)
 				return false
 			} else if outputHashErr != nil || !bytes.Equal(oldOutputHash, newOutputHash) {
 				target.SetState(core.Cached)
@@ -166,11 +184,11 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 			}
 			return true // got from cache
 		}
+		target.SetGlobOutputs(nil)
 		return false
 	}
 
-	cacheKey := mustShortTargetHash(state, target)
-	if state.Cache != nil {
+	if state.Cache != nil && !target.NoCache {
 		// Note that ordering here is quite sensitive since the post-build function can modify
 		// what we would retrieve from the cache.
 		if target.PostBuildFunction != 0 {
@@ -190,6 +208,12 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 	if err := target.CheckSecrets(); err != nil {
 		return err
 	}
+	if err := checkToolHashes(state.Graph, target); err != nil {
+		if state.VerifyHashes {
+			return err
+		}
+		log.Warning("%s", err)
+	}
 	if err := prepareSources(state.Graph, target); err != nil {
 		return fmt.Errorf("Error preparing sources for %s: %s", target.Label, err)
 	}
@@ -222,7 +246,7 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 	}
 	checkLicences(state, target)
 	state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Collecting outputs...")
-	extraOuts, outputsChanged, err := moveOutputs(state, target)
+	extraOuts, outputsChanged, err := moveOutputs(state, target, oldGlobOutputs)
 	if err != nil {
 		return fmt.Errorf("Error moving outputs for target %s: %s", target.Label, err)
 	}
@@ -234,7 +258,7 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 	} else {
 		target.SetState(core.Unchanged)
 	}
-	if state.Cache != nil {
+	if state.Cache != nil && !target.NoCache {
 		state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Storing...")
 		newCacheKey := mustShortTargetHash(state, target)
 		if target.PostBuildFunction != 0 {
@@ -268,6 +292,10 @@ func runBuildCommand(state *core.BuildState, target *core.BuildTarget, command s
 	env := core.StampedBuildEnvironment(state, target, false, inputHash)
 	log.Debug("Building target %s\nENVIRONMENT:\n%s\n%s", target.Label, strings.Join(env, "\n"), command)
 	out, combined, err := core.ExecWithTimeoutShell(target, target.TmpDir(), env, target.BuildTimeout, state.Config.Build.Timeout, state.ShowAllOutput, command, target.Sandbox)
+	if state.AuditSandbox && target.Sandbox {
+		// Do this whether it succeeded or not; a missing dependency may well be why it failed.
+		reportSandboxViolations(state, target)
+	}
 	if err != nil {
 		if state.Verbosity >= 4 {
 			return nil, fmt.Errorf("Error building target %s: %s\nENVIRONMENT:\n%s\n%s\n%s",
@@ -320,7 +348,7 @@ func prepareSources(graph *core.BuildGraph, target *core.BuildTarget) error {
 	return nil
 }
 
-func moveOutputs(state *core.BuildState, target *core.BuildTarget) ([]string, bool, error) {
+func moveOutputs(state *core.BuildState, target *core.BuildTarget, oldGlobOutputs []string) ([]string, bool, error) {
 	// Before we write any outputs, we must remove the old hash file to avoid it being
 	// left in an inconsistent state.
 	if err := os.RemoveAll(ruleHashFileName(target)); err != nil {
@@ -348,6 +376,13 @@ func moveOutputs(state *core.BuildState, target *core.BuildTarget) ([]string, bo
 		}
 		changed = changed || outputChanged
 	}
+	if len(target.OutputGlobs) > 0 {
+		globChanged, err := moveGlobOutputs(state, target, oldGlobOutputs)
+		if err != nil {
+			return nil, true, err
+		}
+		changed = changed || globChanged
+	}
 	if changed {
 		log.Debug("Outputs for %s have changed", target.Label)
 	} else {
@@ -365,9 +400,110 @@ func moveOutputs(state *core.BuildState, target *core.BuildTarget) ([]string, bo
 		}
 		extraOuts = append(extraOuts, output)
 	}
+	if len(target.OutputGlobs) > 0 {
+		warnUnmatchedFiles(state, target, extraOuts)
+		extraOuts = append(extraOuts, target.GlobOutputsFileName())
+	}
 	return extraOuts, changed, nil
 }
 
+// moveGlobOutputs finds everything in the temp directory matching the target's output globs
+// and moves it into place as outputs of the target. The set that matched is recorded so later
+// builds (and cache retrievals) know exactly which files make up the outputs.
+func moveGlobOutputs(state *core.BuildState, target *core.BuildTarget, oldGlobOutputs []string) (bool, error) {
+	tmpDir := target.TmpDir()
+	outDir := target.OutDir()
+	known := map[string]bool{}
+	for _, output := range target.Outputs() {
+		known[output] = true
+	}
+	for _, source := range tmpSources(state.Graph, target) {
+		known[source] = true
+	}
+	outputs := []string{}
+	for _, output := range core.Glob(tmpDir, target.OutputGlobs, nil, nil, true) {
+		if !known[output] && core.PathExists(path.Join(tmpDir, output)) {
+			outputs = append(outputs, output)
+		}
+	}
+	target.SetGlobOutputs(outputs)
+	changed := len(oldGlobOutputs) != len(outputs)
+	if err := removeStaleGlobOutputs(target, oldGlobOutputs); err != nil {
+		return true, err
+	}
+	for _, output := range target.GlobOutputs() {
+		log.Debug("Discovered output %s of %s", output, target.Label)
+		dereferencedPath, err := filepath.EvalSymlinks(path.Join(tmpDir, output))
+		if err != nil {
+			return true, err
+		}
+		outputChanged, err := moveOutput(target, dereferencedPath, path.Join(outDir, output), false)
+		if err != nil {
+			return true, err
+		}
+		changed = changed || outputChanged
+	}
+	return changed, storeGlobOutputs(target)
+}
+
+// removeStaleGlobOutputs removes any of the given previous glob outputs of a target that aren't
+// among its current ones, so the output directory contains exactly the set it was built with.
+func removeStaleGlobOutputs(target *core.BuildTarget, oldGlobOutputs []string) error {
+	current := map[string]bool{}
+	for _, output := range target.GlobOutputs() {
+		current[output] = true
+	}
+	for _, output := range oldGlobOutputs {
+		if !current[output] {
+			log.Debug("Removing old output %s of %s", output, target.Label)
+			if err := os.RemoveAll(path.Join(target.OutDir(), output)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// warnUnmatchedFiles warns about any files in the temp directory of a target with output globs
+// that aren't its sources or any of its outputs. These were produced by the rule but won't be
+// collected, which usually means the globs are wrong.
+func warnUnmatchedFiles(state *core.BuildState, target *core.BuildTarget, optionalOutputs []string) {
+	tmpDir := target.TmpDir()
+	known := append(tmpSources(state.Graph, target), target.Outputs()...)
+	known = append(known, optionalOutputs...)
+	unmatched := []string{}
+	filepath.Walk(tmpDir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		rel := name[len(tmpDir)+1:]
+		for _, k := range known {
+			if rel == k || strings.HasPrefix(rel, k+"/") {
+				return nil
+			}
+		}
+		unmatched = append(unmatched, rel)
+		return nil
+	})
+	if len(unmatched) > 0 {
+		log.Warning("%s produced files that don't match any of its outputs, they won't be collected: %s",
+			target.Label, strings.Join(unmatched, ", "))
+	}
+}
+
+// tmpSources returns the paths of all the sources of a target in its temp directory,
+// relative to that directory.
+func tmpSources(graph *core.BuildGraph, target *core.BuildTarget) []string {
+	tmpDir := target.TmpDir()
+	sources := []string{}
+	for source := range core.IterSources(graph, target) {
+		if strings.HasPrefix(source.Tmp, tmpDir+"/") {
+			sources = append(sources, source.Tmp[len(tmpDir)+1:])
+		}
+	}
+	return sources
+}
+
 func moveOutput(target *core.BuildTarget, tmpOutput, realOutput string, filegroup bool) (bool, error) {
 	// hash the file
 	newHash, err := pathHash(tmpOutput, false)
@@ -433,6 +569,11 @@ func RemoveOutputs(target *core.BuildTarget) error {
 			return err
 		}
 	}
+	if len(target.OutputGlobs) > 0 {
+		if err := os.RemoveAll(globOutputsFileName(target)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -513,11 +654,64 @@ func checkRuleHashes(target *core.BuildTarget, hash []byte) error {
 		target.Label, hashStr, strings.Join(target.Hashes, ", "))
 }
 
+// checkToolHashes verifies that the tools of a target match the hashes given for them in tool_hashes.
+func checkToolHashes(graph *core.BuildGraph, target *core.BuildTarget) error {
+	if len(target.ToolHashes) == 0 {
+		return nil // nothing to check
+	}
+	for _, tool := range target.AllTools() {
+		expected, present := target.ToolHashes[tool.String()]
+		if !present {
+			continue
+		}
+		paths := tool.FullPaths(graph)
+		if len(paths) != 1 {
+			return fmt.Errorf("Can't check hash of tool %s for %s; it has %d outputs, not 1", tool, target.Label, len(paths))
+		}
+		hash, err := fileSha256(paths[0])
+		if err != nil {
+			return fmt.Errorf("Failed to calculate hash of tool %s for %s: %s", tool, target.Label, err)
+		} else if hash != expected {
+			return fmt.Errorf("Bad hash for tool %s of %s: was %s but expected %s", tool, target.Label, hash, expected)
+		}
+	}
+	return nil
+}
+
+// fileSha256 returns the hex-encoded SHA256 hash of a file's contents, as sha256sum would.
+func fileSha256(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func retrieveFromCache(state *core.BuildState, target *core.BuildTarget) ([]byte, bool) {
 	hash := mustShortTargetHash(state, target)
 	return hash, state.Cache.Retrieve(target, hash)
 }
 
+// retrieveGlobOutputs retrieves the record of which outputs matched a target's output globs
+// from the cache. It has to come first since we don't know what else to retrieve until we have it.
+// Targets without output globs don't need it and always succeed.
+func retrieveGlobOutputs(state *core.BuildState, target *core.BuildTarget, key []byte) bool {
+	if len(target.OutputGlobs) == 0 {
+		return true
+	} else if !state.Cache.RetrieveExtra(target, key, target.GlobOutputsFileName()) {
+		return false
+	} else if err := loadGlobOutputs(target); err != nil {
+		log.Warning("Error reading cached outputs of %s: %s", target.Label, err)
+		return false
+	}
+	return true
+}
+
 // Runs the post-build function for a target if it's got one.
 func runPostBuildFunctionIfNeeded(tid int, state *core.BuildState, target *core.BuildTarget) (string, error) {
 	if target.PostBuildFunction != 0 {
@@ -589,10 +783,11 @@ func buildFilegroup(tid int, state *core.BuildState, target *core.BuildTarget) e
 		return err
 	} else if changed {
 		target.SetState(core.Built)
+		state.LogBuildResult(tid, target.Label, core.TargetBuilt, "Built")
 	} else {
 		target.SetState(core.Unchanged)
+		state.LogBuildResult(tid, target.Label, core.TargetBuilt, "Built (unchanged)")
 	}
-	state.LogBuildResult(tid, target.Label, core.TargetBuilt, "Built")
 	return nil
 }
 
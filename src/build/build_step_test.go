@@ -15,6 +15,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/op/go-logging.v1"
@@ -126,6 +127,17 @@ func TestCacheRetrieval(t *testing.T) {
 	assert.Equal(t, core.Cached, target.State())
 }
 
+func TestNoCacheTargetIsNotRetrieved(t *testing.T) {
+	// The mock cache would return this target, but it's opted out so we should build it.
+	state, target := newState("//package1:target8a")
+	target.AddOutput("file8a")
+	target.NoCache = true
+	state.Cache = cache
+	err := buildTarget(1, state, target)
+	assert.NoError(t, err)
+	assert.Equal(t, core.Built, target.State())
+}
+
 func TestPostBuildFunctionAndCache(t *testing.T) {
 	// Test the often subtle and quick to anger interaction of post-build function and cache.
 	// In this case when it fails to retrieve the post-build output it should still call the function after building.
@@ -227,6 +239,140 @@ func TestLicenceEnforcement(t *testing.T) {
 	}, "Trying to add GPL should panic (case insensitive)")
 }
 
+func TestDescribeRebuild(t *testing.T) {
+	state, target := newState("//package1:target11")
+	target.AddOutput("file11")
+	assert.NoError(t, prepareDirectory(target.OutDir(), false))
+	assert.NoError(t, writeRuleHashFile(state, target))
+	assert.Equal(t, "its build rule has changed", describeRuleChange(target))
+	target.AddSource(core.FileLabel{File: "src5", Package: "package1"})
+	assert.Equal(t, "source package1/src5 has been added", describeSourceChange(state, target))
+	target.Command = "echo 'something else' > $OUT"
+	assert.Equal(t, "its command has changed", describeRuleChange(target))
+}
+
+func TestInputHashFileOnlyWrittenOnChange(t *testing.T) {
+	state, target := newState("//package1:target12")
+	target.AddOutput("file12")
+	assert.NoError(t, prepareDirectory(target.OutDir(), false))
+	assert.NoError(t, writeInputHashFile(state, target))
+	filename := inputHashFileName(target)
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.NoError(t, os.Chtimes(filename, past, past))
+
+	assert.NoError(t, writeInputHashFile(state, target))
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, past, info.ModTime(), "Shouldn't be rewritten when nothing has changed")
+
+	target.Command = "echo 'something else' > $OUT"
+	assert.NoError(t, writeInputHashFile(state, target))
+	info, err = os.Stat(filename)
+	assert.NoError(t, err)
+	assert.NotEqual(t, past, info.ModTime(), "Should be rewritten when an input has changed")
+}
+
+func TestToolHashes(t *testing.T) {
+	tool := path.Join(os.TempDir(), "build_step_test_tool")
+	assert.NoError(t, ioutil.WriteFile(tool, []byte("#!/bin/sh\n"), 0755))
+	defer os.Remove(tool)
+	state, target := newState("//package3:tool_hashes")
+	target.AddOutput("file1")
+	target.AddTool(core.SystemFileLabel{Path: tool})
+	target.AddToolHash(tool, "b9e7bc2ff8d5ef5988cc2ea4b4c37e2b8bfda7279844c7e662be155e6b2f12a8")
+	err := buildTarget(1, state, target)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "was a8076d3d28d21e02012b20eaf7dbf75409a6277134439025f282e368e3305abf but expected b9e7bc2ff8d5ef5988cc2ea4b4c37e2b8bfda7279844c7e662be155e6b2f12a8")
+	target.AddToolHash(tool, "a8076d3d28d21e02012b20eaf7dbf75409a6277134439025f282e368e3305abf")
+	assert.NoError(t, buildTarget(1, state, target))
+}
+
+func TestOutputGlobs(t *testing.T) {
+	state, target := newState("//package3:output_globs")
+	target.OutputGlobs = []string{"out/*.txt"}
+	target.Command = "mkdir out && echo a > out/a.txt && echo b > out/b.txt && echo c > out/c.log"
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.Equal(t, core.Built, target.State())
+	assert.Equal(t, []string{"out/a.txt", "out/b.txt"}, target.Outputs())
+	assert.True(t, core.FileExists("plz-out/gen/package3/out/b.txt"))
+	assert.False(t, core.PathExists("plz-out/gen/package3/out/c.log"))
+
+	// Anything that isn't produced next time should disappear.
+	target.Command = "mkdir out && echo a > out/a.txt"
+	target.RuleHash = nil // Have to force a reset of this
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.Equal(t, core.Built, target.State())
+	assert.Equal(t, []string{"out/a.txt"}, target.Outputs())
+	assert.False(t, core.PathExists("plz-out/gen/package3/out/b.txt"))
+
+	// A fresh target should pick up what matched from before without needing to rebuild.
+	state, target = newState("//package3:output_globs")
+	target.OutputGlobs = []string{"out/*.txt"}
+	target.Command = "mkdir out && echo a > out/a.txt"
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.Equal(t, core.Reused, target.State())
+	assert.Equal(t, []string{"out/a.txt"}, target.Outputs())
+}
+
+func TestOutputGlobsDependencyChanged(t *testing.T) {
+	state, target := newState("//package3:output_globs_dep")
+	target.OutputGlobs = []string{"dep/*.txt"}
+	target.Command = "mkdir dep && echo a > dep/a.txt && echo b > dep/b.txt"
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.True(t, core.FileExists("plz-out/gen/package3/dep/b.txt"))
+
+	// Rebuilding because a dependency changed should still remove outputs that weren't produced again.
+	state, target = newState("//package3:output_globs_dep")
+	target.OutputGlobs = []string{"dep/*.txt"}
+	target.Command = "mkdir dep && echo a > dep/a.txt"
+	dep := core.NewBuildTarget(core.ParseBuildLabel("//package3:output_globs_dep_dep", ""))
+	dep.SetState(core.Built)
+	state.Graph.AddTarget(dep)
+	target.AddDependency(dep.Label)
+	state.Graph.AddDependency(target.Label, dep.Label)
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.Equal(t, core.Built, target.State())
+	assert.Equal(t, []string{"dep/a.txt"}, target.Outputs())
+	assert.False(t, core.PathExists("plz-out/gen/package3/dep/b.txt"))
+}
+
+func TestOutputGlobsCacheRetrieval(t *testing.T) {
+	state, target := newState("//package3:output_globs_cache")
+	target.OutputGlobs = []string{"*.txt"}
+	target.Command = "false" // Will fail if we try to build it.
+	state.Cache = cache
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.Equal(t, core.Cached, target.State())
+	assert.Equal(t, []string{"x.txt", "y.txt"}, target.Outputs())
+	assert.True(t, core.FileExists("plz-out/gen/package3/y.txt"))
+}
+
+func TestUnchangedOutputsDontRebuildDependents(t *testing.T) {
+	// If a rule gets rebuilt but produces exactly the same output, the things that
+	// depend on it shouldn't need to be rebuilt as well.
+	state, dep := newState("//package4:dep")
+	dep.AddOutput("dep.txt")
+	target := core.NewBuildTarget(core.ParseBuildLabel("//package4:target", ""))
+	target.AddOutput("target.txt")
+	target.AddSource(dep.Label)
+	target.AddDependency(dep.Label)
+	target.Command = "cat $SRCS > $OUT"
+	state.Graph.AddTarget(target)
+	state.Graph.AddDependency(target.Label, dep.Label)
+	assert.NoError(t, buildTarget(1, state, dep))
+	assert.Equal(t, core.Built, dep.State())
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.Equal(t, core.Built, target.State())
+
+	// Change the command in a way that doesn't change what it produces.
+	dep.Command = "echo 'output of //package4:dep' | cat > $OUT"
+	dep.RuleHash = nil
+	assert.NoError(t, buildTarget(1, state, dep))
+	assert.Equal(t, core.Unchanged, dep.State())
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.Equal(t, core.Reused, target.State())
+}
+
 func newState(label string) (*core.BuildState, *core.BuildTarget) {
 	config, _ := core.ReadConfigFiles(nil)
 	state := core.NewBuildState(1, nil, 4, config)
@@ -263,9 +409,17 @@ func (*mockCache) Retrieve(target *core.BuildTarget, key []byte) bool {
 	if target.Label.Name == "target8" {
 		ioutil.WriteFile("plz-out/gen/package1/file8", []byte("retrieved from cache"), 0664)
 		return true
+	} else if target.Label.Name == "target8a" {
+		ioutil.WriteFile("plz-out/gen/package1/file8a", []byte("retrieved from cache"), 0664)
+		return true
 	} else if target.Label.Name == "target10" {
 		ioutil.WriteFile("plz-out/gen/package1/file10", []byte("retrieved from cache"), 0664)
 		return true
+	} else if target.Label.Name == "output_globs_cache" {
+		for _, output := range target.Outputs() {
+			ioutil.WriteFile(path.Join("plz-out/gen/package3", output), []byte("retrieved from cache"), 0664)
+		}
+		return true
 	}
 	return false
 }
@@ -274,10 +428,18 @@ func (*mockCache) RetrieveExtra(target *core.BuildTarget, key []byte, file strin
 	if target.Label.Name == "target10" && file == target.PostBuildOutputFileName() {
 		ioutil.WriteFile(postBuildOutputFileName(target), []byte("retrieved from cache"), 0664)
 		return true
+	} else if target.Label.Name == "output_globs_cache" && file == target.GlobOutputsFileName() {
+		os.MkdirAll("plz-out/gen/package3", core.DirPermissions)
+		ioutil.WriteFile(globOutputsFileName(target), []byte("x.txt\ny.txt\n"), 0664)
+		return true
 	}
 	return false
 }
 
+func (*mockCache) Exists(target *core.BuildTarget, key []byte) bool {
+	return target.Label.Name == "target8" || target.Label.Name == "target8a" || target.Label.Name == "target10"
+}
+
 func (*mockCache) Clean(target *core.BuildTarget) {}
 func (*mockCache) CleanAll()                      {}
 func (*mockCache) Shutdown()                      {}
@@ -52,55 +52,71 @@ var boolFalseHashValue = []byte{1}
 func needsBuilding(state *core.BuildState, target *core.BuildTarget, postBuild bool) bool {
 	// Check the dependencies first, because they don't need any disk I/O.
 	if target.NeedsTransitiveDependencies {
-		if anyDependencyHasChanged(target) {
+		if dep := changedTransitiveDependency(target); dep != nil {
+			logRebuild(state, target, "dependency %s has changed", dep.Label)
 			return true // one of the transitive deps has changed, need to rebuild
 		}
 	} else {
 		for _, dep := range target.Dependencies() {
 			if dep.State() < core.Unchanged {
-				log.Debug("Need to rebuild %s, %s has changed", target.Label, dep.Label)
+				logRebuild(state, target, "dependency %s has changed", dep.Label)
 				return true // dependency has just been rebuilt, do this too.
 			}
 		}
 	}
+	if inputsChanged(state, target, postBuild) {
+		return true
+	}
+	// Maybe we've forced a rebuild. Do this last; might be interesting to see if it needed building anyway.
+	return state.ForceRebuild && (state.IsOriginalTarget(target.Label) || state.IsOriginalTarget(target.Label.Parent()))
+}
+
+// inputsChanged returns true if any of the inputs to a rule (other than its dependencies) have
+// changed since it was last built, or if its outputs are missing.
+func inputsChanged(state *core.BuildState, target *core.BuildTarget, postBuild bool) bool {
 	oldRuleHash, oldConfigHash, oldSourceHash, oldSecretHash := readRuleHashFile(ruleHashFileName(target), postBuild)
+	// We need to know what matched the output globs last time before we can check the outputs.
+	globErr := loadGlobOutputs(target)
 	if !bytes.Equal(oldConfigHash, state.Hashes.Config) {
 		if len(oldConfigHash) == 0 {
 			// Small nicety to make it a bit clearer what's going on.
-			log.Debug("Need to build %s, outputs aren't there", target.Label)
+			logRebuild(state, target, "outputs aren't there")
 		} else {
-			log.Debug("Need to rebuild %s, config has changed (was %s, need %s)", target.Label, b64(oldConfigHash), b64(state.Hashes.Config))
+			logRebuild(state, target, "config has changed (was %s, need %s)", b64(oldConfigHash), b64(state.Hashes.Config))
 		}
 		return true
 	}
 	newRuleHash := RuleHash(target, false, postBuild)
 	if !bytes.Equal(oldRuleHash, newRuleHash) {
-		log.Debug("Need to rebuild %s, rule has changed (was %s, need %s)", target.Label, b64(oldRuleHash), b64(newRuleHash))
+		logRebuild(state, target, "%s (was %s, need %s)", describeRuleChange(target), b64(oldRuleHash), b64(newRuleHash))
 		return true
 	}
 	newSourceHash, err := sourceHash(state.Graph, target)
 	if err != nil || !bytes.Equal(oldSourceHash, newSourceHash) {
-		log.Debug("Need to rebuild %s, sources have changed (was %s, need %s)", target.Label, b64(oldSourceHash), b64(newSourceHash))
+		logRebuild(state, target, "%s (was %s, need %s)", describeSourceChange(state, target), b64(oldSourceHash), b64(newSourceHash))
 		return true
 	}
 	newSecretHash, err := secretHash(target)
 	if err != nil || !bytes.Equal(oldSecretHash, newSecretHash) {
-		log.Debug("Need to rebuild %s, secrets have changed (was %s, need %s)", target.Label, b64(oldSecretHash), b64(newSecretHash))
+		logRebuild(state, target, "secrets have changed (was %s, need %s)", b64(oldSecretHash), b64(newSecretHash))
 		return true
 	}
 
+	if globErr != nil {
+		logRebuild(state, target, "its glob outputs weren't recorded (%s)", globErr)
+		return true
+	}
 	// Check the outputs of this rule exist. This would only happen if the user had
 	// removed them but it's incredibly aggravating if you remove an output and the
 	// rule won't rebuild itself.
 	for _, output := range target.Outputs() {
 		realOutput := path.Join(target.OutDir(), output)
 		if !core.PathExists(realOutput) {
-			log.Debug("Output %s doesn't exist for rule %s; will rebuild.", realOutput, target.Label)
+			logRebuild(state, target, "output %s doesn't exist", realOutput)
 			return true
 		}
 	}
-	// Maybe we've forced a rebuild. Do this last; might be interesting to see if it needed building anyway.
-	return state.ForceRebuild && (state.IsOriginalTarget(target.Label) || state.IsOriginalTarget(target.Label.Parent()))
+	return false
 }
 
 // b64 base64 encodes a string of bytes for printing.
@@ -111,25 +127,35 @@ func b64(b []byte) string {
 	return base64.RawStdEncoding.EncodeToString(b)
 }
 
-// Returns true if any transitive dependency of this target has changed.
-func anyDependencyHasChanged(target *core.BuildTarget) bool {
+// logRebuild logs the reason that a target needs rebuilding.
+// It's only visible at high verbosity unless --why_rebuild was passed.
+func logRebuild(state *core.BuildState, target *core.BuildTarget, format string, args ...interface{}) {
+	reason := fmt.Sprintf(format, args...)
+	if state.WhyRebuild {
+		log.Warning("Rebuilding %s: %s", target.Label, reason)
+	} else {
+		log.Debug("Need to rebuild %s, %s", target.Label, reason)
+	}
+}
+
+// Returns the first transitive dependency of this target that has changed, or nil if none have.
+func changedTransitiveDependency(target *core.BuildTarget) *core.BuildTarget {
 	done := map[core.BuildLabel]bool{}
-	var inner func(*core.BuildTarget) bool
-	inner = func(dependency *core.BuildTarget) bool {
+	var inner func(*core.BuildTarget) *core.BuildTarget
+	inner = func(dependency *core.BuildTarget) *core.BuildTarget {
 		done[dependency.Label] = true
 		if dependency != target && dependency.State() < core.Unchanged {
-			return true
+			return dependency
 		} else if !dependency.OutputIsComplete || dependency == target {
 			for _, dep := range dependency.Dependencies() {
 				if !done[dep.Label] {
-					if inner(dep) {
-						log.Debug("Need to rebuild %s, %s has changed", target.Label, dep.Label)
-						return true
+					if changed := inner(dep); changed != nil {
+						return changed
 					}
 				}
 			}
 		}
-		return false
+		return nil
 	}
 	return inner(target)
 }
@@ -171,6 +197,116 @@ func sourceHash(graph *core.BuildGraph, target *core.BuildTarget) ([]byte, error
 	return h.Sum(nil), nil
 }
 
+// An inputHash is the hash of a single input to a rule, which we record individually
+// so we can later explain which one changed.
+type inputHash struct {
+	Name string
+	Hash []byte
+}
+
+// inputHashes returns the hashes of each individual input to a target; its command, sources and tools.
+// This is more detailed than sourceHash, but it's only used for diagnostics.
+func inputHashes(state *core.BuildState, target *core.BuildTarget) ([]inputHash, error) {
+	command := sha1.Sum([]byte(target.GetCommand()))
+	ret := []inputHash{{Name: "command", Hash: command[:]}}
+	for source := range core.IterSources(state.Graph, target) {
+		result, err := pathHash(source.Src, false)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, inputHash{Name: "source " + source.Src, Hash: result})
+	}
+	for _, tool := range target.AllTools() {
+		if label := tool.Label(); label != nil {
+			ret = append(ret, inputHash{Name: "tool " + label.String(), Hash: mustTargetHash(state, state.Graph.TargetOrDie(*label))})
+		} else {
+			p := tool.FullPaths(state.Graph)[0]
+			result, err := pathHash(p, false)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, inputHash{Name: "tool " + p, Hash: result})
+		}
+	}
+	return ret, nil
+}
+
+// describeRuleChange returns a description of why the rule hash of a target has changed.
+// We don't have the individual fields of the old rule, so this can't be very specific.
+func describeRuleChange(target *core.BuildTarget) string {
+	oldInputs := readInputHashFile(inputHashFileName(target))
+	command := sha1.Sum([]byte(target.GetCommand()))
+	if old, present := oldInputs["command"]; present && !bytes.Equal(old, command[:]) {
+		return "its command has changed"
+	}
+	return "its build rule has changed"
+}
+
+// describeSourceChange returns a description of which input of a target has changed
+// since it was last built.
+func describeSourceChange(state *core.BuildState, target *core.BuildTarget) string {
+	newInputs, err := inputHashes(state, target)
+	if err != nil {
+		return fmt.Sprintf("failed to hash sources: %s", err)
+	}
+	oldInputs := readInputHashFile(inputHashFileName(target))
+	if len(oldInputs) == 0 {
+		return "sources have changed"
+	}
+	for _, input := range newInputs {
+		if old, present := oldInputs[input.Name]; !present {
+			return input.Name + " has been added"
+		} else if !bytes.Equal(old, input.Hash) {
+			return input.Name + " has changed"
+		}
+		delete(oldInputs, input.Name)
+	}
+	if len(oldInputs) > 0 {
+		removed := make([]string, 0, len(oldInputs))
+		for name := range oldInputs {
+			removed = append(removed, name)
+		}
+		sort.Strings(removed)
+		return removed[0] + " has been removed"
+	}
+	return "sources have been reordered"
+}
+
+// readInputHashFile reads the per-input hashes for a target that were written when it was last built.
+// The returned map is empty if there's any error reading the file.
+func readInputHashFile(filename string) map[string][]byte {
+	ret := map[string][]byte{}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ret
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if parts := strings.SplitN(line, " ", 2); len(parts) == 2 {
+			if h, err := base64.RawStdEncoding.DecodeString(parts[0]); err == nil {
+				ret[parts[1]] = h
+			}
+		}
+	}
+	return ret
+}
+
+// writeInputHashFile writes the per-input hashes for a target for later diagnostics.
+func writeInputHashFile(state *core.BuildState, target *core.BuildTarget) error {
+	inputs, err := inputHashes(state, target)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, input := range inputs {
+		buf.WriteString(b64(input.Hash) + " " + input.Name + "\n")
+	}
+	filename := inputHashFileName(target)
+	if existing, err := ioutil.ReadFile(filename); err == nil && bytes.Equal(existing, buf.Bytes()) {
+		return nil // Don't touch it if nothing's changed, so no-op builds leave plz-out alone.
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
+
 // Used to memoize the results of pathHash so we don't hash the same files multiple times.
 var pathHashMemoizer = map[string][]byte{}
 var pathHashMutex sync.RWMutex // Of course it will be accessed concurrently.
@@ -315,6 +451,15 @@ func ruleHash(target *core.BuildTarget, runtime bool) []byte {
 	for _, hsh := range target.Hashes {
 		h.Write([]byte(hsh))
 	}
+	tools := make([]string, 0, len(target.ToolHashes))
+	for tool := range target.ToolHashes {
+		tools = append(tools, tool)
+	}
+	sort.Strings(tools)
+	for _, tool := range tools {
+		h.Write([]byte(tool))
+		h.Write([]byte(target.ToolHashes[tool]))
+	}
 	for _, source := range target.AllSources() {
 		h.Write([]byte(source.String()))
 	}
@@ -337,6 +482,9 @@ func ruleHash(target *core.BuildTarget, runtime bool) []byte {
 	for _, output := range target.OptionalOutputs {
 		h.Write([]byte(output))
 	}
+	for _, glob := range target.OutputGlobs {
+		h.Write([]byte(glob))
+	}
 	for _, label := range target.Labels {
 		h.Write([]byte(label))
 	}
@@ -359,6 +507,15 @@ func ruleHash(target *core.BuildTarget, runtime bool) []byte {
 		}
 		hashBool(h, target.Containerise)
 		hashOptionalBool(h, target.TestSandbox)
+		hashOptionalBool(h, target.Shuffle)
+		hashOptionalBool(h, target.TestSharding)
+		hashOptionalBool(h, target.ExpectedToFail)
+		if target.TestSetup != nil {
+			h.Write([]byte("setup " + target.TestSetup.String()))
+		}
+		if target.TestTeardown != nil {
+			h.Write([]byte("teardown " + target.TestTeardown.String()))
+		}
 		if target.ContainerSettings != nil {
 			e := gob.NewEncoder(h)
 			if err := e.Encode(target.ContainerSettings); err != nil {
@@ -461,7 +618,7 @@ func writeRuleHashFile(state *core.BuildState, target *core.BuildTarget) error {
 	} else if n != hashFileLength {
 		return fmt.Errorf("Wrote %d bytes to rule hash file; should be %d", n, hashFileLength)
 	}
-	return nil
+	return writeInputHashFile(state, target)
 }
 
 // Returns the filename we'll store the hashes for this file in.
@@ -469,6 +626,11 @@ func ruleHashFileName(target *core.BuildTarget) string {
 	return path.Join(target.OutDir(), ".rule_hash_"+target.Label.Name)
 }
 
+// Returns the filename we'll store the hashes of each individual input to this rule in.
+func inputHashFileName(target *core.BuildTarget) string {
+	return path.Join(target.OutDir(), ".rule_inputs_"+target.Label.Name)
+}
+
 func postBuildOutputFileName(target *core.BuildTarget) string {
 	return path.Join(target.OutDir(), target.PostBuildOutputFileName())
 }
@@ -497,6 +659,43 @@ func storePostBuildOutput(state *core.BuildState, target *core.BuildTarget, out
 	}
 }
 
+func globOutputsFileName(target *core.BuildTarget) string {
+	return path.Join(target.OutDir(), target.GlobOutputsFileName())
+}
+
+// For targets with output globs, we record which outputs matched them when they were built
+// so we know what they are later without rebuilding (or after retrieving them from the cache).
+func loadGlobOutputs(target *core.BuildTarget) error {
+	if len(target.OutputGlobs) == 0 {
+		return nil
+	}
+	b, err := ioutil.ReadFile(globOutputsFileName(target))
+	if err != nil {
+		return err
+	}
+	outputs := []string{}
+	for _, output := range strings.Split(string(b), "\n") {
+		if output != "" {
+			outputs = append(outputs, output)
+		}
+	}
+	target.SetGlobOutputs(outputs)
+	return nil
+}
+
+func storeGlobOutputs(target *core.BuildTarget) error {
+	filename := globOutputsFileName(target)
+	if err := os.RemoveAll(filename); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, output := range target.GlobOutputs() {
+		buf.WriteString(output)
+		buf.WriteByte('\n')
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
+
 // targetHash returns the hash for a target and any error encountered while calculating it.
 func targetHash(state *core.BuildState, target *core.BuildTarget) ([]byte, error) {
 	hash := append(RuleHash(target, false, false), RuleHash(target, false, true)...)
@@ -541,6 +740,23 @@ func RuntimeHash(state *core.BuildState, target *core.BuildTarget) ([]byte, erro
 		}
 		h.Write(result)
 	}
+	// So can whatever sets the test up or tears it down.
+	for _, label := range []*core.BuildLabel{target.TestSetup, target.TestTeardown} {
+		if label != nil {
+			result, err := OutputHash(state.Graph.TargetOrDie(*label))
+			if err != nil {
+				return result, err
+			}
+			h.Write(result)
+		}
+	}
+	// Variables passed through from our environment can affect the results as much as any file can.
+	for _, name := range target.PassEnv {
+		h.Write([]byte(name + "=" + os.Getenv(name)))
+	}
+	if state.HermeticTestEnv {
+		h.Write([]byte("hermetic"))
+	}
 	return append(hash, h.Sum(nil)...), nil
 }
 
@@ -18,6 +18,7 @@ var KnownFields = map[string]bool{
 	"Label":                       true,
 	"dependencies":                true,
 	"Hashes":                      true,
+	"ToolHashes":                  true,
 	"Sources":                     true,
 	"NamedSources":                true,
 	"IsBinary":                    true,
@@ -30,6 +31,7 @@ var KnownFields = map[string]bool{
 	"TestCommands":                true,
 	"NeedsTransitiveDependencies": true,
 	"OptionalOutputs":             true,
+	"OutputGlobs":                 true,
 	"OutputIsComplete":            true,
 	"Requires":                    true,
 	"Provides":                    true,
@@ -49,9 +51,15 @@ var KnownFields = map[string]bool{
 
 	// These only contribute to the runtime hash, not at build time.
 	"Data":              true,
+	"TestSetup":         true,
+	"TestTeardown":      true,
 	"Containerise":      true,
 	"TestSandbox":       true,
+	"Shuffle":           true,
+	"TestSharding":      true,
+	"ExpectedToFail":    true,
 	"ContainerSettings": true,
+	"PassEnv":           true,
 
 	// These would ideally not contribute to the hash, but we need that at present
 	// because we don't have a good way to force a recheck of its reverse dependencies.
@@ -63,12 +71,20 @@ var KnownFields = map[string]bool{
 	// hash because they don't affect the actual output of the target.
 	"AddedPostBuild":      true,
 	"Flakiness":           true,
+	"FlakyRetryRegex":     true,
 	"NoTestOutput":        true,
+	"SymlinkData":         true, // Only changes how the data gets into the test directory.
 	"BuildTimeout":        true,
 	"TestTimeout":         true,
+	"PerCaseTimeout":      true,
+	"ExpectedDuration":    true,
+	"Priority":            true,
 	"state":               true,
+	"globOutputs":         true, // These are what the build produced, not part of the rule.
 	"Results":             true, // Recall that unsuccessful test results aren't cached...
 	"BuildingDescription": true,
+	"NoCache":             true,
+	"Resources":           true,
 
 	// Used to save the rule hash rather than actually being hashed itself.
 	"RuleHash": true,
@@ -0,0 +1,142 @@
+// Support for planning a build without actually doing it.
+
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"core"
+)
+
+// A PlanAction describes what we'd do with a single target in a build.
+type PlanAction int
+
+const (
+	// PlanUnchanged means the target is already built and up to date.
+	PlanUnchanged PlanAction = iota
+	// PlanCached means the target would be retrieved from the cache.
+	PlanCached
+	// PlanBuild means the target would be built.
+	PlanBuild
+	// PlanUnknown means the target would need rebuilding because its dependencies do, so we
+	// can't know yet whether it'd be found in the cache.
+	PlanUnknown
+)
+
+var planActionNames = [...]string{"unchanged", "cached", "build", "build?"}
+
+func (action PlanAction) String() string {
+	return planActionNames[action]
+}
+
+// A PlanStep is a single target in a build plan.
+type PlanStep struct {
+	Label  core.BuildLabel
+	Action PlanAction
+}
+
+// Plan works out what we'd do to build the given targets, without building anything.
+// The result is in the order targets would be built in (dependencies always come before the
+// targets that use them) and is deterministic for any given state of the repo and cache.
+// Cache lookups only check for existence of artifacts; nothing is downloaded.
+func Plan(state *core.BuildState, labels []core.BuildLabel) []PlanStep {
+	steps := []PlanStep{}
+	actions := map[*core.BuildTarget]PlanAction{}
+	var visit func(target *core.BuildTarget)
+	visit = func(target *core.BuildTarget) {
+		if _, present := actions[target]; present {
+			return
+		}
+		actions[target] = PlanUnchanged // Placeholder; the graph has no cycles by now.
+		deps := target.Dependencies()   // These are sorted already.
+		for _, dep := range deps {
+			visit(dep)
+		}
+		action := planTarget(state, target, deps, actions)
+		actions[target] = action
+		steps = append(steps, PlanStep{Label: target.Label, Action: action})
+	}
+	sorted := make(core.BuildLabels, len(labels))
+	copy(sorted, labels)
+	sort.Sort(sorted)
+	for _, label := range sorted {
+		visit(state.Graph.TargetOrDie(label))
+	}
+	return steps
+}
+
+// planTarget works out what we'd do with a single target, given what we'll do with its dependencies.
+func planTarget(state *core.BuildState, target *core.BuildTarget, deps []*core.BuildTarget, actions map[*core.BuildTarget]PlanAction) PlanAction {
+	for _, dep := range deps {
+		if actions[dep] != PlanUnchanged {
+			// Its outputs aren't there yet, so we can't work out the hash of this target.
+			return PlanUnknown
+		}
+	}
+	if !inputsChanged(state, target, false) {
+		return PlanUnchanged
+	} else if state.Cache == nil || target.NoCache {
+		return PlanBuild
+	}
+	hash, err := targetHash(state, target)
+	if err != nil {
+		log.Debug("Can't calculate hash for %s: %s", target.Label, err)
+		return PlanBuild
+	} else if state.Cache.Exists(target, core.CollapseHash(hash)) {
+		return PlanCached
+	}
+	return PlanBuild
+}
+
+// CriticalPath returns the longest chain of dependent targets in the plan that need doing
+// something to them (i.e. anything other than being unchanged), ordered from the first
+// target that would be built to the last.
+func CriticalPath(state *core.BuildState, steps []PlanStep) []core.BuildLabel {
+	type entry struct {
+		length int
+		prev   *core.BuildTarget
+	}
+	entries := map[*core.BuildTarget]entry{}
+	var last *core.BuildTarget
+	for _, step := range steps { // Steps are in dependency order, so deps are always done first.
+		target := state.Graph.TargetOrDie(step.Label)
+		e := entry{}
+		for _, dep := range target.Dependencies() {
+			if d := entries[dep]; d.length > e.length {
+				e = entry{length: d.length, prev: dep}
+			}
+		}
+		if step.Action != PlanUnchanged {
+			e.length++
+		}
+		entries[target] = e
+		if last == nil || e.length > entries[last].length {
+			last = target
+		}
+	}
+	path := []core.BuildLabel{}
+	for t := last; t != nil && entries[t].length > 0; t = entries[t].prev {
+		path = append([]core.BuildLabel{t.Label}, path...)
+	}
+	return path
+}
+
+// PrintPlan prints a build plan to stdout.
+func PrintPlan(state *core.BuildState, steps []PlanStep) {
+	counts := make([]int, len(planActionNames))
+	for _, step := range steps {
+		fmt.Printf("%-10s %s\n", step.Action, step.Label)
+		counts[step.Action]++
+	}
+	fmt.Printf("\n%d targets: %d unchanged, %d from cache, %d to build, %d to build unless found in cache after their dependencies are built\n",
+		len(steps), counts[PlanUnchanged], counts[PlanCached], counts[PlanBuild], counts[PlanUnknown])
+	if path := CriticalPath(state, steps); len(path) > 0 {
+		labels := make([]string, len(path))
+		for i, label := range path {
+			labels[i] = label.String()
+		}
+		fmt.Printf("Critical path (%d steps): %s\n", len(path), strings.Join(labels, " -> "))
+	}
+}
@@ -0,0 +1,46 @@
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestPlan(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	a := addPlanTarget(state, "//src/build/plan:a")
+	b := addPlanTarget(state, "//src/build/plan:b", a)
+	c := addPlanTarget(state, "//src/build/plan:c", a, b)
+	steps := Plan(state, []core.BuildLabel{c.Label, b.Label})
+	assert.Equal(t, []PlanStep{
+		{Label: a.Label, Action: PlanBuild},
+		{Label: b.Label, Action: PlanUnknown},
+		{Label: c.Label, Action: PlanUnknown},
+	}, steps)
+	assert.Equal(t, []core.BuildLabel{a.Label, b.Label, c.Label}, CriticalPath(state, steps))
+}
+
+func TestCriticalPathIgnoresUnchangedTargets(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	a := addPlanTarget(state, "//src/build/plan:a")
+	b := addPlanTarget(state, "//src/build/plan:b", a)
+	steps := []PlanStep{
+		{Label: a.Label, Action: PlanUnchanged},
+		{Label: b.Label, Action: PlanCached},
+	}
+	assert.Equal(t, []core.BuildLabel{b.Label}, CriticalPath(state, steps))
+}
+
+func addPlanTarget(state *core.BuildState, label string, deps ...*core.BuildTarget) *core.BuildTarget {
+	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	target.Command = "echo hello > $OUT"
+	target.AddOutput(target.Label.Name + ".txt")
+	state.Graph.AddTarget(target)
+	for _, dep := range deps {
+		target.AddDependency(dep.Label)
+		state.Graph.AddDependency(target.Label, dep.Label)
+	}
+	return target
+}
@@ -0,0 +1,174 @@
+// Support for auditing which files sandboxed build actions access, to find missing dependencies.
+
+package build
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"core"
+)
+
+// straceLine matches a line of strace output and extracts the first path argument of the syscall,
+// e.g. 1234 openat(AT_FDCWD, "src/core/utils.go", O_RDONLY) = 3
+var straceLine = regexp.MustCompile(`^[0-9]+ +[a-z0-9_]+\((?:AT_FDCWD, |[0-9]+, )?"((?:[^"\\]|\\.)*)"`)
+
+// A sandboxViolation is a file that a build action accessed without having declared it.
+type sandboxViolation struct {
+	// Path of the file, relative to the repo root.
+	Path string
+	// The target that owns the file, if we could find one.
+	Owner *core.BuildLabel
+}
+
+// reportSandboxViolations reads the file accesses recorded for a target's build action and warns
+// about any outside its declared inputs, along with the targets it should probably depend on.
+func reportSandboxViolations(state *core.BuildState, target *core.BuildTarget) {
+	filename := path.Join(target.TmpDir(), core.SandboxAuditFile)
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Debug("No sandbox audit for %s: %s", target.Label, err)
+		return
+	}
+	accessed := readSandboxAudit(f)
+	f.Close()
+	if err := os.Remove(filename); err != nil {
+		log.Warning("Failed to remove sandbox audit for %s: %s", target.Label, err)
+	}
+	violations := sandboxViolations(state.Graph, target, accessed)
+	if len(violations) == 0 {
+		return
+	}
+	lines := make([]string, len(violations))
+	for i, violation := range violations {
+		if violation.Owner != nil {
+			lines[i] = "  " + violation.Owner.String() + " (for " + violation.Path + ")"
+		} else {
+			lines[i] = "  " + violation.Path + " (not owned by any target)"
+		}
+	}
+	log.Warning("%s accessed files outside its declared inputs; it may be missing dependencies on:\n%s",
+		target.Label, strings.Join(lines, "\n"))
+}
+
+// readSandboxAudit returns the paths accessed in the given strace output, in the order they were seen.
+func readSandboxAudit(f *os.File) []string {
+	paths := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if match := straceLine.FindStringSubmatch(scanner.Text()); match != nil {
+			paths = append(paths, match[1])
+		}
+	}
+	return paths
+}
+
+// sandboxViolations works out which of the given accessed paths are outside the declared inputs of
+// a target. Relative paths are taken to be relative to its temp directory, where it was run.
+// Files that don't exist anywhere in the repo are ignored since lots of tools probe for things that
+// turn out not to be there, and so are files outside the repo entirely.
+func sandboxViolations(graph *core.BuildGraph, target *core.BuildTarget, accessed []string) []sandboxViolation {
+	root := core.RepoRoot
+	tmpDir := path.Join(root, target.TmpDir())
+	inputs := []string{}
+	for source := range core.IterSources(graph, target) {
+		inputs = append(inputs, source.Src, strings.TrimPrefix(source.Tmp, target.TmpDir()+"/"))
+	}
+	for _, tool := range target.AllTools() {
+		inputs = append(inputs, tool.FullPaths(graph)...)
+	}
+	owners := fileOwners(graph)
+	seen := map[string]bool{}
+	violations := []sandboxViolation{}
+	for _, p := range accessed {
+		if !path.IsAbs(p) {
+			p = path.Join(tmpDir, p)
+		}
+		p = path.Clean(p)
+		var rel string
+		if strings.HasPrefix(p, tmpDir+"/") {
+			rel = p[len(tmpDir)+1:]
+			if core.PathExists(p) {
+				continue // It's either an input or something the action created itself.
+			}
+		} else if strings.HasPrefix(p, root+"/") {
+			rel = p[len(root)+1:]
+			if strings.HasPrefix(rel, "plz-out/") && !strings.HasPrefix(rel, "plz-out/gen/") && !strings.HasPrefix(rel, "plz-out/bin/") {
+				continue
+			}
+		} else {
+			continue
+		}
+		if seen[rel] || isInput(rel, inputs) {
+			continue
+		}
+		seen[rel] = true
+		if owner, present := owners[rel]; present {
+			if owner != target.Label {
+				violations = append(violations, sandboxViolation{Path: rel, Owner: &owner})
+			}
+		} else if core.FileExists(path.Join(root, rel)) {
+			violations = append(violations, sandboxViolation{Path: rel})
+		}
+	}
+	sort.Slice(violations, func(i, j int) bool { return violations[i].Path < violations[j].Path })
+	return violations
+}
+
+// isInput returns true if the given path is one of the given inputs or within one of them.
+func isInput(p string, inputs []string) bool {
+	for _, input := range inputs {
+		if p == input || strings.HasPrefix(p, input+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// fileOwners returns a map of every file known to the graph to the target that owns it, which is
+// the one that outputs it or failing that one that has it as a source.
+// Where more than one target could own a file we pick the first by label so it's consistent.
+func fileOwners(graph *core.BuildGraph) map[string]core.BuildLabel {
+	owners := map[string]core.BuildLabel{}
+	add := func(file string, label core.BuildLabel) {
+		if existing, present := owners[file]; !present || label.Less(existing) {
+			owners[file] = label
+		}
+	}
+	targets := graph.AllTargets()
+	for _, target := range targets {
+		for _, source := range target.AllSources() {
+			if source.Label() == nil {
+				for _, p := range source.FullPaths(graph) {
+					add(p, target.Label)
+				}
+			}
+		}
+	}
+	// Outputs take precedence over sources, since something that outputs a file is a better
+	// thing to depend on than something else that happens to consume it. They're recorded both
+	// where they really are and where they'd appear in the temp directory of a dependent rule.
+	outputs := map[string]core.BuildLabel{}
+	addOutput := func(file string, label core.BuildLabel) {
+		if existing, present := outputs[file]; !present || label.Less(existing) {
+			outputs[file] = label
+		}
+	}
+	for _, target := range targets {
+		if target.IsFilegroup {
+			continue
+		}
+		for _, output := range target.Outputs() {
+			addOutput(path.Join(target.OutDir(), output), target.Label)
+			addOutput(path.Join(target.Label.PackageName, output), target.Label)
+		}
+	}
+	for p, label := range outputs {
+		owners[p] = label
+	}
+	return owners
+}
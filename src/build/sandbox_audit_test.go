@@ -0,0 +1,66 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+const testAudit = `1234 execve("/bin/bash", ["bash", "-c", "cat pkg1/lib.h"], 0x7ffd /* 12 vars */) = 0
+1234 openat(AT_FDCWD, "/usr/lib/libc.so.6", O_RDONLY|O_CLOEXEC) = 3
+1235 openat(AT_FDCWD, "pkg1/lib.h", O_RDONLY) = -1 ENOENT (No such file or directory)
+1235 openat(AT_FDCWD, "pkg4/main.c", O_RDONLY) = 3
+1235 stat("%[1]s/pkg3/data.txt", {st_mode=S_IFREG|0644, st_size=12, ...}) = 0
+1235 open("%[1]s/pkg2/unowned.txt", O_RDONLY <unfinished ...>
+1236 access("%[1]s/pkg2/nonexistent", R_OK) = -1 ENOENT (No such file or directory)
+1236 openat(AT_FDCWD, "%[1]s/plz-out/tmp/pkg5/other._build/x", O_RDONLY) = 3
+1236 openat(AT_FDCWD, "pkg1/lib.h", O_RDONLY) = -1 ENOENT (No such file or directory)
+1235 <... open resumed>) = 3
++++ exited with 0 +++
+`
+
+func TestSandboxViolations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandbox_audit_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldRoot := core.RepoRoot
+	core.RepoRoot = dir
+	defer func() { core.RepoRoot = oldRoot }()
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "pkg2"), core.DirPermissions))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "pkg2/unowned.txt"), nil, 0644))
+
+	graph := core.NewGraph()
+	lib := core.NewBuildTarget(core.ParseBuildLabel("//pkg1:lib", ""))
+	lib.AddOutput("lib.h")
+	graph.AddTarget(lib)
+	data := core.NewBuildTarget(core.ParseBuildLabel("//pkg3:data", ""))
+	data.AddSource(core.FileLabel{File: "data.txt", Package: "pkg3"})
+	graph.AddTarget(data)
+	target := core.NewBuildTarget(core.ParseBuildLabel("//pkg4:audited", ""))
+	target.AddSource(core.FileLabel{File: "main.c", Package: "pkg4"})
+	graph.AddTarget(target)
+
+	filename := path.Join(dir, core.SandboxAuditFile)
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(fmt.Sprintf(testAudit, dir)), 0644))
+	f, err := os.Open(filename)
+	assert.NoError(t, err)
+	defer f.Close()
+	accessed := readSandboxAudit(f)
+	assert.Equal(t, 9, len(accessed))
+	assert.Equal(t, "/bin/bash", accessed[0])
+	assert.Equal(t, path.Join(dir, "pkg2/unowned.txt"), accessed[5])
+
+	libLabel := lib.Label
+	dataLabel := data.Label
+	assert.Equal(t, []sandboxViolation{
+		{Path: "pkg1/lib.h", Owner: &libLabel},
+		{Path: "pkg2/unowned.txt"},
+		{Path: "pkg3/data.txt", Owner: &dataLabel},
+	}, sandboxViolations(graph, target, accessed))
+}
@@ -61,6 +61,10 @@ func (c *asyncCache) RetrieveExtra(target *core.BuildTarget, key []byte, file st
 	return c.realCache.RetrieveExtra(target, key, file)
 }
 
+func (c *asyncCache) Exists(target *core.BuildTarget, key []byte) bool {
+	return c.realCache.Exists(target, key)
+}
+
 func (c *asyncCache) Clean(target *core.BuildTarget) {
 	c.realCache.Clean(target)
 }
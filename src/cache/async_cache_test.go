@@ -124,6 +124,10 @@ func (c *mockCache) RetrieveExtra(target *core.BuildTarget, key []byte, file str
 	return c.Retrieve(target, key)
 }
 
+func (c *mockCache) Exists(target *core.BuildTarget, key []byte) bool {
+	return false
+}
+
 func (c *mockCache) Clean(target *core.BuildTarget) {
 	c.Retrieve(target, nil)
 }
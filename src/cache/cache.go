@@ -27,6 +27,9 @@ func newSyncCache(config *core.Configuration, remoteOnly bool) core.Cache {
 	if config.Cache.Dir != "" && !remoteOnly {
 		mplex.caches = append(mplex.caches, newDirCache(config))
 	}
+	if config.Cache.ExternalCommand != "" {
+		mplex.caches = append(mplex.caches, newExternalCache(config))
+	}
 	if config.Cache.RpcUrl != "" {
 		cache, err := newRpcCache(config)
 		if err == nil {
@@ -129,6 +132,15 @@ func (mplex cacheMultiplexer) RetrieveExtra(target *core.BuildTarget, key []byte
 	return false
 }
 
+func (mplex cacheMultiplexer) Exists(target *core.BuildTarget, key []byte) bool {
+	for _, cache := range mplex.caches {
+		if cache.Exists(target, key) {
+			return true
+		}
+	}
+	return false
+}
+
 func (mplex cacheMultiplexer) Clean(target *core.BuildTarget) {
 	for _, cache := range mplex.caches {
 		cache.Clean(target)
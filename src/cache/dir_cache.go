@@ -3,14 +3,24 @@
 package cache
 
 import (
+	"crypto/sha1"
 	"encoding/base64"
+	"fmt"
+	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"syscall"
+	"time"
 
 	"core"
 )
 
+// casDir is the directory within the cache that stores artifacts by their content hash.
+// The per-target directories hardlink into it, so identical outputs of different targets
+// only take up space once. The cache cleaner knows to remove blobs that are no longer linked.
+const casDir = ".cas"
+
 type dirCache struct {
 	Dir string
 }
@@ -54,12 +64,89 @@ func (cache *dirCache) storeFile(target *core.BuildTarget, out, cacheDir string)
 	} else if err := os.MkdirAll(cacheDir, core.DirPermissions); err != nil {
 		log.Warning("Failed to create cache directory %s: %s", cacheDir, err)
 		return
-	} else if err := core.RecursiveCopyFile(outFile, cachedFile, fileMode(target), true, true); err != nil {
-		// Cannot hardlink files into the cache, must copy them for reals.
+	} else if err := cache.storeContent(outFile, cachedFile, fileMode(target)); err != nil {
 		log.Warning("Failed to store cache file %s: %s", cachedFile, err)
 	}
 }
 
+// storeContent stores a file or directory into the cache via the content-addressed store.
+// It follows the same rules as core.RecursiveCopyFile for directories and symlinks.
+func (cache *dirCache) storeContent(from, to string, mode os.FileMode) error {
+	if info, err := os.Stat(from); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return cache.storeBlob(from, to, mode)
+	}
+	return filepath.Walk(from, func(name string, info os.FileInfo, err error) error {
+		dest := path.Join(to, name[len(from):])
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			return os.MkdirAll(dest, core.DirPermissions)
+		} else if (info.Mode() & os.ModeSymlink) != 0 {
+			if fi, err := os.Stat(name); err != nil {
+				return err
+			} else if fi.IsDir() {
+				return cache.storeContent(name+"/", dest+"/", mode)
+			}
+		}
+		return cache.storeBlob(name, dest, mode)
+	})
+}
+
+// storeBlob stores a single file in the content-addressed store, if it's not there already,
+// and links it into place in the cache.
+func (cache *dirCache) storeBlob(from, to string, mode os.FileMode) error {
+	blob, err := cache.blobPath(from)
+	if err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		if !core.PathExists(blob) {
+			// Write to a temporary name first so nobody else can see it half-written.
+			tmp := blob + "="
+			if err := os.MkdirAll(path.Dir(blob), core.DirPermissions); err != nil {
+				return err
+			} else if err := os.RemoveAll(tmp); err != nil {
+				return err
+			} else if err := core.RecursiveCopyFile(from, tmp, mode, true, true); err != nil {
+				// Cannot hardlink files into the cache, must copy them for reals.
+				return err
+			} else if err := os.Rename(tmp, blob); err != nil {
+				return err
+			}
+		} else {
+			log.Debug("%s already exists in dir cache, not storing it again", blob)
+		}
+		err := core.RecursiveCopyFile(blob, to, mode, true, true)
+		if err == nil || !os.IsNotExist(err) || i > 0 {
+			return err
+		}
+		// The cache cleaner removed the blob between us checking for it and linking to it.
+		log.Debug("%s was removed while storing %s, storing it again", blob, to)
+	}
+}
+
+// blobPath returns the path in the content-addressed store for the given file.
+// The permission bits are part of the key since they're shared between hardlinks.
+func (cache *dirCache) blobPath(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	hash := fmt.Sprintf("%x", h.Sum(nil))
+	return path.Join(cache.Dir, casDir, hash[:2], fmt.Sprintf("%s_%o", hash, info.Mode().Perm())), nil
+}
+
 func (cache *dirCache) Retrieve(target *core.BuildTarget, key []byte) bool {
 	cacheDir := cache.getPath(target, key)
 	if !core.PathExists(cacheDir) {
@@ -71,6 +158,31 @@ func (cache *dirCache) Retrieve(target *core.BuildTarget, key []byte) bool {
 			return false
 		}
 	}
+	cache.markAccessed(cacheDir)
+	return true
+}
+
+// markAccessed updates the access time of a cache entry so the cleaner knows it's still in use.
+// We can't rely on the filesystem to do it for us; retrieving only hardlinks files out of the
+// entry, and many systems are mounted with noatime or relatime anyway.
+func (cache *dirCache) markAccessed(cacheDir string) {
+	if info, err := os.Stat(cacheDir); err != nil {
+		log.Warning("Failed to update access time of %s: %s", cacheDir, err)
+	} else if err := os.Chtimes(cacheDir, time.Now(), info.ModTime()); err != nil {
+		log.Warning("Failed to update access time of %s: %s", cacheDir, err)
+	}
+}
+
+func (cache *dirCache) Exists(target *core.BuildTarget, key []byte) bool {
+	cacheDir := cache.getPath(target, key)
+	if !core.PathExists(cacheDir) {
+		return false
+	}
+	for out := range cacheArtifacts(target) {
+		if !core.PathExists(path.Join(cacheDir, out)) {
+			return false
+		}
+	}
 	return true
 }
 
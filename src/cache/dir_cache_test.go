@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/djherbis/atime"
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func writeOutput(target *core.BuildTarget, contents string) {
+	target.AddOutput("out.txt")
+	os.MkdirAll(target.OutDir(), core.DirPermissions)
+	ioutil.WriteFile(path.Join(target.OutDir(), "out.txt"), []byte(contents), 0644)
+}
+
+func TestStoreDeduplicatesIdenticalOutputs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dir_cache_test")
+	defer os.RemoveAll(dir)
+	cache := &dirCache{Dir: dir}
+	target1 := core.NewBuildTarget(core.ParseBuildLabel("//pkg1:dedup", ""))
+	target2 := core.NewBuildTarget(core.ParseBuildLabel("//pkg2:dedup", ""))
+	target3 := core.NewBuildTarget(core.ParseBuildLabel("//pkg3:dedup", ""))
+	writeOutput(target1, "same")
+	writeOutput(target2, "same")
+	writeOutput(target3, "different")
+	key := []byte("dedup_key")
+	cache.Store(target1, key)
+	cache.Store(target2, key)
+	cache.Store(target3, key)
+	info1, err1 := os.Stat(path.Join(cache.getPath(target1, key), "out.txt"))
+	info2, err2 := os.Stat(path.Join(cache.getPath(target2, key), "out.txt"))
+	info3, err3 := os.Stat(path.Join(cache.getPath(target3, key), "out.txt"))
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.NoError(t, err3)
+	assert.True(t, os.SameFile(info1, info2))
+	assert.False(t, os.SameFile(info1, info3))
+}
+
+func TestRetrieveDeduplicatedOutput(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dir_cache_test")
+	defer os.RemoveAll(dir)
+	cache := &dirCache{Dir: dir}
+	target := core.NewBuildTarget(core.ParseBuildLabel("//pkg4:dedup", ""))
+	writeOutput(target, "retrieve me")
+	key := []byte("dedup_key")
+	cache.Store(target, key)
+	os.Remove(path.Join(target.OutDir(), "out.txt"))
+	assert.True(t, cache.Retrieve(target, key))
+	b, err := ioutil.ReadFile(path.Join(target.OutDir(), "out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "retrieve me", string(b))
+}
+
+func TestRetrieveMarksEntryAccessed(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dir_cache_test")
+	defer os.RemoveAll(dir)
+	cache := &dirCache{Dir: dir}
+	target := core.NewBuildTarget(core.ParseBuildLabel("//pkg5:accessed", ""))
+	writeOutput(target, "access me")
+	key := []byte("accessed_key")
+	cache.Store(target, key)
+	old := time.Now().Add(-24 * time.Hour)
+	assert.NoError(t, os.Chtimes(cache.getPath(target, key), old, old))
+	assert.True(t, cache.Retrieve(target, key))
+	info, err := os.Stat(cache.getPath(target, key))
+	assert.NoError(t, err)
+	assert.True(t, atime.Get(info).After(old.Add(time.Hour)))
+}
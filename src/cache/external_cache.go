@@ -0,0 +1,265 @@
+// Cache implementation that delegates to an external helper binary.
+//
+// This allows integrating with arbitrary artifact stores without having to add support for
+// them to Please itself. The helper is invoked once per artifact as
+//   <command> exists <artifact>
+//   <command> get <artifact>
+//   <command> put <artifact>
+// where <artifact> is a slash-separated name of the form
+//   <os_arch>/<package>/<target name>/<base64 key>/outputs
+// for the outputs of a target, or
+//   <os_arch>/<package>/<target name>/<base64 key>/extra/<file>
+// for extra files stored against it (e.g. test results).
+//
+// The artifact itself is an uncompressed tar stream of the files, with names relative to the
+// target's output directory; the helper doesn't need to understand it and should just store
+// and return the bytes verbatim. For put it's written to the helper's stdin, for get the helper
+// should write it to stdout. Nothing is written for exists.
+//
+// The helper must exit with 0 on success (i.e. the artifact exists, was retrieved or was stored),
+// 1 if the artifact isn't in the cache and any other code for an error. Errors are logged along
+// with anything the helper writes to stderr, and otherwise treated as a miss. So is a retrieved
+// artifact that doesn't contain all the files it should, e.g. if the helper wrote nothing.
+
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"core"
+)
+
+// exitMiss is the exit code the helper uses to indicate an artifact isn't in the cache.
+const exitMiss = 1
+
+type externalCache struct {
+	Command   []string
+	Writeable bool
+	Timeout   time.Duration
+}
+
+func (cache *externalCache) Store(target *core.BuildTarget, key []byte, files ...string) {
+	if cache.Writeable {
+		cache.put(target, cache.artifactName(target, key, "outputs"), cacheArtifacts(target, files...))
+	}
+}
+
+func (cache *externalCache) StoreExtra(target *core.BuildTarget, key []byte, file string) {
+	if cache.Writeable {
+		ch := make(chan string, 1)
+		ch <- file
+		close(ch)
+		cache.put(target, cache.artifactName(target, key, "extra/"+file), ch)
+	}
+}
+
+func (cache *externalCache) Retrieve(target *core.BuildTarget, key []byte) bool {
+	return cache.get(target, cache.artifactName(target, key, "outputs"), target.Outputs())
+}
+
+func (cache *externalCache) RetrieveExtra(target *core.BuildTarget, key []byte, file string) bool {
+	return cache.get(target, cache.artifactName(target, key, "extra/"+file), []string{file})
+}
+
+func (cache *externalCache) Exists(target *core.BuildTarget, key []byte) bool {
+	return cache.run("exists", cache.artifactName(target, key, "outputs"), nil, nil) == nil
+}
+
+func (cache *externalCache) Clean(target *core.BuildTarget) {
+	log.Debug("Not cleaning %s from external cache, the protocol doesn't support it", target.Label)
+}
+
+func (cache *externalCache) CleanAll() {
+	log.Warning("Can't clean the external cache, the protocol doesn't support it")
+}
+
+func (cache *externalCache) Shutdown() {}
+
+// artifactName returns the name of a single artifact for a target.
+func (cache *externalCache) artifactName(target *core.BuildTarget, key []byte, name string) string {
+	return path.Join(
+		core.OsArch,
+		target.Label.PackageName,
+		target.Label.Name,
+		base64.RawURLEncoding.EncodeToString(key),
+		name,
+	)
+}
+
+// put stores the given files, which are relative to the target's output directory, as a single artifact.
+func (cache *externalCache) put(target *core.BuildTarget, artifact string, files <-chan string) {
+	log.Info("Storing %s: %s in external cache...", target.Label, artifact)
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeTar(w, path.Join(core.RepoRoot, target.OutDir()), files))
+	}()
+	err := cache.run("put", artifact, r, nil)
+	r.Close() // Make sure the writer doesn't block forever if the helper didn't read everything.
+	if err != nil {
+		log.Warning("Failed to store %s in external cache: %s", artifact, err)
+	}
+}
+
+// get retrieves a single artifact into the target's output directory.
+// It's only successful if the artifact contained all the given files, so a helper that claims
+// success without returning anything (or returns something truncated) counts as a miss.
+func (cache *externalCache) get(target *core.BuildTarget, artifact string, files []string) bool {
+	log.Debug("Retrieving %s: %s from external cache...", target.Label, artifact)
+	r, w := io.Pipe()
+	ch := make(chan error, 1)
+	var extracted map[string]bool
+	go func() {
+		var err error
+		extracted, err = readTar(r, path.Join(core.RepoRoot, target.OutDir()), fileMode(target))
+		io.Copy(ioutil.Discard, r) // Drain anything left so the helper can exit.
+		ch <- err
+	}()
+	err := cache.run("get", artifact, nil, w)
+	w.Close()
+	if tarErr := <-ch; err == nil && tarErr != nil {
+		err = fmt.Errorf("Invalid artifact: %s", tarErr)
+	}
+	if err == nil {
+		for _, file := range files {
+			if !extracted[path.Clean(file)] {
+				err = fmt.Errorf("Artifact doesn't contain %s", file)
+				break
+			}
+		}
+	}
+	if err == errMiss {
+		return false
+	} else if err != nil {
+		log.Warning("Failed to retrieve %s from external cache: %s", artifact, err)
+		return false
+	}
+	log.Info("Retrieved %s from external cache", target.Label)
+	return true
+}
+
+// errMiss is returned by run when the helper reports that the artifact isn't in the cache.
+var errMiss = fmt.Errorf("Artifact not in cache")
+
+// run runs the helper with the given subcommand and artifact, connected to the given
+// stdin and stdout. It returns errMiss if the helper reported a miss.
+func (cache *externalCache) run(subcommand, artifact string, stdin io.Reader, stdout io.Writer) error {
+	var stderr bytes.Buffer
+	args := append(cache.Command[1:], subcommand, artifact)
+	cmd := exec.Command(cache.Command[0], args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	timer := time.AfterFunc(cache.Timeout, func() { cmd.Process.Kill() })
+	defer timer.Stop()
+	err := cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == exitMiss {
+			return errMiss
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s %s: %s %s", cache.Command[0], subcommand, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// writeTar writes the given files, relative to the given directory, to a tar stream.
+// Directories are written recursively.
+func writeTar(w io.Writer, dir string, files <-chan string) error {
+	tw := tar.NewWriter(w)
+	for file := range files {
+		if err := filepath.Walk(path.Join(dir, file), func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			link := ""
+			if info.Mode()&os.ModeSymlink != 0 {
+				if link, err = os.Readlink(name); err != nil {
+					return err
+				}
+			}
+			hdr, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			hdr.Name = strings.TrimPrefix(name[len(dir):], "/")
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			} else if info.Mode().IsRegular() {
+				f, err := os.Open(name)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				_, err = io.Copy(tw, f)
+				return err
+			}
+			return nil
+		}); err != nil {
+			// Drain the channel so the goroutine feeding it can finish.
+			for range files {
+			}
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// readTar extracts a tar stream into the given directory. Files are given the given mode.
+// It returns the names of everything it extracted, relative to that directory.
+func readTar(r io.Reader, dir string, mode os.FileMode) (map[string]bool, error) {
+	extracted := map[string]bool{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return extracted, nil
+		} else if err != nil {
+			return extracted, err
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return extracted, fmt.Errorf("Refusing to extract %s outside the output directory", hdr.Name)
+		}
+		out := path.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(out, core.DirPermissions); err != nil {
+				return extracted, err
+			}
+		case tar.TypeSymlink:
+			os.RemoveAll(out)
+			if err := os.Symlink(hdr.Linkname, out); err != nil {
+				return extracted, err
+			}
+		default:
+			if err := core.WriteFile(tr, out, mode); err != nil {
+				return extracted, err
+			}
+		}
+		extracted[name] = true
+	}
+}
+
+func newExternalCache(config *core.Configuration) *externalCache {
+	return &externalCache{
+		Command:   strings.Fields(config.Cache.ExternalCommand),
+		Writeable: config.Cache.ExternalWriteable,
+		Timeout:   time.Duration(config.Cache.ExternalTimeout),
+	}
+}
@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+// A minimal implementation of the protocol that stores artifacts in the directory given as its first argument.
+const externalCacheScript = `#!/bin/sh
+f="$1/$3"
+case "$2" in
+    exists) test -f "$f" || exit 1 ;;
+    get) test -f "$f" || exit 1; cat "$f" ;;
+    put) mkdir -p "$(dirname "$f")" && cat > "$f" ;;
+    *) echo "unknown command $2" >&2; exit 2 ;;
+esac
+`
+
+func newTestExternalCache(t *testing.T) (*externalCache, string) {
+	dir, err := ioutil.TempDir("", "external_cache_test")
+	assert.NoError(t, err)
+	script := path.Join(dir, "cache.sh")
+	assert.NoError(t, ioutil.WriteFile(script, []byte(externalCacheScript), 0755))
+	store := path.Join(dir, "store")
+	return &externalCache{Command: []string{script, store}, Writeable: true, Timeout: 10 * time.Second}, dir
+}
+
+func writeExternalOutput(target *core.BuildTarget, name, contents string) {
+	target.AddOutput(name)
+	os.MkdirAll(path.Dir(path.Join(target.OutDir(), name)), core.DirPermissions)
+	ioutil.WriteFile(path.Join(target.OutDir(), name), []byte(contents), 0644)
+}
+
+func TestExternalStoreAndRetrieve(t *testing.T) {
+	cache, dir := newTestExternalCache(t)
+	defer os.RemoveAll(dir)
+	target := core.NewBuildTarget(core.ParseBuildLabel("//pkg1:external", ""))
+	writeExternalOutput(target, "out.txt", "retrieve me")
+	writeExternalOutput(target, "sub/out2.txt", "and me")
+	key := []byte("external_key")
+	assert.False(t, cache.Exists(target, key))
+	cache.Store(target, key)
+	assert.True(t, cache.Exists(target, key))
+	os.RemoveAll(target.OutDir())
+	assert.True(t, cache.Retrieve(target, key))
+	b, err := ioutil.ReadFile(path.Join(target.OutDir(), "out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "retrieve me", string(b))
+	b, err = ioutil.ReadFile(path.Join(target.OutDir(), "sub/out2.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "and me", string(b))
+	info, err := os.Stat(path.Join(target.OutDir(), "out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0444), info.Mode())
+}
+
+func TestExternalStoreAndRetrieveExtra(t *testing.T) {
+	cache, dir := newTestExternalCache(t)
+	defer os.RemoveAll(dir)
+	target := core.NewBuildTarget(core.ParseBuildLabel("//pkg2:external", ""))
+	os.MkdirAll(target.OutDir(), core.DirPermissions)
+	ioutil.WriteFile(path.Join(target.OutDir(), "test.results"), []byte("results"), 0644)
+	key := []byte("external_key")
+	cache.StoreExtra(target, key, "test.results")
+	os.RemoveAll(target.OutDir())
+	assert.False(t, cache.Retrieve(target, key))
+	assert.True(t, cache.RetrieveExtra(target, key, "test.results"))
+	b, err := ioutil.ReadFile(path.Join(target.OutDir(), "test.results"))
+	assert.NoError(t, err)
+	assert.Equal(t, "results", string(b))
+}
+
+func TestExternalReadOnly(t *testing.T) {
+	cache, dir := newTestExternalCache(t)
+	defer os.RemoveAll(dir)
+	cache.Writeable = false
+	target := core.NewBuildTarget(core.ParseBuildLabel("//pkg3:external", ""))
+	writeExternalOutput(target, "out.txt", "don't store me")
+	key := []byte("external_key")
+	cache.Store(target, key)
+	assert.False(t, cache.Exists(target, key))
+}
+
+func TestExternalCommandFails(t *testing.T) {
+	cache := &externalCache{Command: []string{"false"}, Timeout: 10 * time.Second}
+	target := core.NewBuildTarget(core.ParseBuildLabel("//pkg4:external", ""))
+	assert.Equal(t, errMiss, cache.run("get", "whatever", nil, nil))
+	cache.Command = []string{"sh", "-c", "echo oops >&2; exit 2", "sh"}
+	err := cache.run("get", "whatever", nil, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "oops")
+	assert.False(t, cache.Retrieve(target, []byte("external_key")))
+}
+
+func TestExternalCommandTimeout(t *testing.T) {
+	cache := &externalCache{Command: []string{"sh", "-c", "exec sleep 10", "sh"}, Timeout: 100 * time.Millisecond}
+	err := cache.run("exists", "whatever", nil, nil)
+	assert.Error(t, err)
+	assert.NotEqual(t, errMiss, err)
+}
+
+func TestReadTarRejectsEscapingPaths(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "external_cache_test")
+	defer os.RemoveAll(dir)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "../escaped.txt", Mode: 0644, Size: 4, Typeflag: tar.TypeReg})
+	tw.Write([]byte("evil"))
+	tw.Close()
+	_, err := readTar(&buf, path.Join(dir, "out"), 0444)
+	assert.Error(t, err)
+	_, err = os.Stat(path.Join(dir, "escaped.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestExternalRetrieveEmptyOutput(t *testing.T) {
+	// Claims success for everything but never returns anything.
+	cache := &externalCache{Command: []string{"true"}, Timeout: 10 * time.Second}
+	target := core.NewBuildTarget(core.ParseBuildLabel("//pkg1:external_empty", ""))
+	target.AddOutput("out.txt")
+	key := []byte("external_key")
+	assert.False(t, cache.Retrieve(target, key))
+	assert.False(t, cache.RetrieveExtra(target, key, "test.results"))
+}
+
+func TestExternalRetrieveIncompleteOutput(t *testing.T) {
+	cache, dir := newTestExternalCache(t)
+	defer os.RemoveAll(dir)
+	target := core.NewBuildTarget(core.ParseBuildLabel("//pkg1:external_incomplete", ""))
+	writeExternalOutput(target, "out.txt", "retrieve me")
+	key := []byte("external_key")
+	cache.Store(target, key)
+	target.AddOutput("out2.txt")
+	assert.False(t, cache.Retrieve(target, key), "Shouldn't count as retrieved since out2.txt wasn't stored")
+}
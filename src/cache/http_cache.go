@@ -7,19 +7,25 @@ import (
 	"io"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"core"
 )
 
 type httpCache struct {
-	Url       string
-	Writeable bool
-	Timeout   time.Duration
+	Url        string
+	Writeable  bool
+	Timeout    time.Duration
+	Retries    int
+	RetryDelay time.Duration
+	clientOnce sync.Once
+	httpClient *http.Client
 }
 
 func (cache *httpCache) Store(target *core.BuildTarget, key []byte, files ...string) {
@@ -54,15 +60,16 @@ func (cache *httpCache) StoreExtra(target *core.BuildTarget, key []byte, file st
 		)
 		log.Info("Storing %s: %s in http cache...", target.Label, artifact)
 
-		// NB. Don't need to close this file, http.Post will do it for us.
+		// NB. Don't need to close this file, Post will do it for us.
 		file, err := os.Open(path.Join(target.OutDir(), file))
 		if err != nil {
 			log.Warning("Failed to read artifact: %s", err)
 			return
 		}
-		response, err := http.Post(cache.Url+"/artifact/"+artifact, "application/octet-stream", file)
+		response, err := cache.client().Post(cache.Url+"/artifact/"+artifact, "application/octet-stream", file)
 		if err != nil {
 			log.Warning("Failed to send artifact to %s: %s", cache.Url+"/artifact/"+artifact, err)
+			return
 		} else if response.StatusCode < 200 || response.StatusCode > 299 {
 			log.Warning("Failed to send artifact to %s: got response %s", cache.Url+"/artifact/"+artifact, response.Status)
 		}
@@ -86,16 +93,7 @@ func (cache *httpCache) Retrieve(target *core.BuildTarget, key []byte) bool {
 
 func (cache *httpCache) RetrieveExtra(target *core.BuildTarget, key []byte, file string) bool {
 	log.Debug("Retrieving %s:%s from http cache...", target.Label, file)
-
-	artifact := path.Join(
-		core.OsArch,
-		target.Label.PackageName,
-		target.Label.Name,
-		base64.RawURLEncoding.EncodeToString(key),
-		file,
-	)
-
-	response, err := http.Get(cache.Url + "/artifact/" + artifact)
+	response, err := cache.get(cache.artifactUrl(target, key, file))
 	if err != nil {
 		return false
 	}
@@ -127,6 +125,78 @@ func (cache *httpCache) RetrieveExtra(target *core.BuildTarget, key []byte, file
 	}
 }
 
+func (cache *httpCache) Exists(target *core.BuildTarget, key []byte) bool {
+	exists := false
+	for out := range cacheArtifacts(target) {
+		response, err := cache.client().Head(cache.artifactUrl(target, key, out))
+		if err != nil {
+			log.Debug("Failed to check for %s:%s in http cache: %s", target.Label, out, err)
+			return false
+		}
+		response.Body.Close()
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return false
+		}
+		exists = true
+	}
+	return exists
+}
+
+// client returns the HTTP client to use for requests to the cache. The configured timeout
+// applies to connecting and to waiting for the server to respond; it doesn't limit how long
+// the body takes to transfer, since large artifacts can legitimately take a while.
+func (cache *httpCache) client() *http.Client {
+	cache.clientOnce.Do(func() {
+		dialer := &net.Dialer{Timeout: cache.Timeout}
+		cache.httpClient = &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   cache.Timeout,
+			ResponseHeaderTimeout: cache.Timeout,
+		}}
+	})
+	return cache.httpClient
+}
+
+// artifactUrl returns the URL of a single artifact for a target.
+func (cache *httpCache) artifactUrl(target *core.BuildTarget, key []byte, file string) string {
+	return cache.Url + "/artifact/" + path.Join(
+		core.OsArch,
+		target.Label.PackageName,
+		target.Label.Name,
+		base64.RawURLEncoding.EncodeToString(key),
+		file,
+	)
+}
+
+// get fetches the given URL, retrying with exponential backoff on transient errors.
+func (cache *httpCache) get(url string) (*http.Response, error) {
+	delay := cache.RetryDelay
+	for i := 0; ; i++ {
+		response, err := cache.client().Get(url)
+		if i >= cache.Retries || !shouldRetry(response, err) {
+			return response, err
+		}
+		if err != nil {
+			log.Debug("Failed to fetch %s from http cache, retrying in %s: %s", url, delay, err)
+		} else {
+			log.Debug("Error %d fetching %s from http cache, retrying in %s", response.StatusCode, url, delay)
+			response.Body.Close()
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// shouldRetry returns true if the given response or error from the cache is likely to be transient.
+// A 404 is a genuine miss and isn't worth retrying, nor are other client errors.
+func shouldRetry(response *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+}
+
 func (cache *httpCache) writeFile(target *core.BuildTarget, file string, r io.Reader) bool {
 	outFile := path.Join(target.OutDir(), file)
 	if err := os.MkdirAll(path.Dir(outFile), core.DirPermissions); err != nil {
@@ -155,16 +225,17 @@ func (cache *httpCache) Clean(target *core.BuildTarget) {
 		target.Label.Name,
 	)
 	req, _ := http.NewRequest("DELETE", cache.Url+"/artifact/"+artifact, reader)
-	response, err := http.DefaultClient.Do(req)
+	response, err := cache.client().Do(req)
 	if err != nil {
 		log.Warning("Failed to remove artifacts for %s from http cache: %s", target.Label, err)
+		return
 	}
 	response.Body.Close()
 }
 
 func (cache *httpCache) CleanAll() {
 	req, _ := http.NewRequest("DELETE", cache.Url, nil)
-	if _, err := http.DefaultClient.Do(req); err != nil {
+	if _, err := cache.client().Do(req); err != nil {
 		log.Warning("Failed to remove artifacts from http cache: %s", err)
 	}
 }
@@ -173,8 +244,10 @@ func (cache *httpCache) Shutdown() {}
 
 func newHttpCache(config *core.Configuration) *httpCache {
 	return &httpCache{
-		Url:       config.Cache.HttpUrl.String(),
-		Writeable: config.Cache.HttpWriteable,
-		Timeout:   time.Duration(config.Cache.HttpTimeout),
+		Url:        config.Cache.HttpUrl.String(),
+		Writeable:  config.Cache.HttpWriteable,
+		Timeout:    time.Duration(config.Cache.HttpTimeout),
+		Retries:    config.Cache.HttpRetries,
+		RetryDelay: time.Duration(config.Cache.HttpRetryDelay),
 	}
 }
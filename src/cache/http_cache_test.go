@@ -2,12 +2,15 @@ package cache
 
 import (
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"path"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
+
 	"cache/server"
 	"core"
 )
@@ -56,3 +59,74 @@ func TestClean(t *testing.T) {
 		t.Errorf("File %s was not removed from cache.", filename)
 	}
 }
+
+func TestRetrieveRetriesTransientErrors(t *testing.T) {
+	requests := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests++; requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("retried"))
+	}))
+	defer s.Close()
+	c := &httpCache{Url: s.URL, Retries: 2, RetryDelay: time.Millisecond}
+	assert.True(t, c.RetrieveExtra(target, []byte("retry_key"), "retryfile"))
+	assert.Equal(t, 3, requests)
+}
+
+func TestRetrieveDoesNotRetryMisses(t *testing.T) {
+	requests := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer s.Close()
+	c := &httpCache{Url: s.URL, Retries: 2, RetryDelay: time.Millisecond}
+	assert.False(t, c.RetrieveExtra(target, []byte("retry_key"), "retryfile"))
+	assert.Equal(t, 1, requests)
+}
+
+func TestRetrieveGivesUpAfterRetries(t *testing.T) {
+	requests := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer s.Close()
+	c := &httpCache{Url: s.URL, Retries: 2, RetryDelay: time.Millisecond}
+	assert.False(t, c.RetrieveExtra(target, []byte("retry_key"), "retryfile"))
+	assert.Equal(t, 3, requests)
+}
+
+func TestRetrieveTimesOut(t *testing.T) {
+	requests := 0
+	done := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		<-done // Hang until the test is over.
+	}))
+	defer s.Close()
+	defer close(done)
+	c := &httpCache{Url: s.URL, Timeout: 10 * time.Millisecond, Retries: 1, RetryDelay: time.Millisecond}
+	assert.False(t, c.RetrieveExtra(target, []byte("retry_key"), "retryfile"))
+	assert.Equal(t, 2, requests, "Timeouts should be retried")
+}
+
+func TestRetrieveSlowBody(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// The timeout only covers getting the response, not transferring all of it.
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer s.Close()
+	c := &httpCache{Url: s.URL, Timeout: 20 * time.Millisecond}
+	assert.True(t, c.RetrieveExtra(target, []byte("slow_key"), "slowfile"))
+	contents, err := ioutil.ReadFile(path.Join(target.OutDir(), "slowfile"))
+	assert.NoError(t, err)
+	assert.Equal(t, "slow", string(contents))
+}
@@ -46,6 +46,8 @@ type rpcCache struct {
 	maxMsgSize int
 	nodes      []cacheNode
 	hostname   string
+	// Set to 1 once we find that the server can't check for artifacts without sending them.
+	existsUnsupported int32
 }
 
 type cacheNode struct {
@@ -168,6 +170,46 @@ func (cache *rpcCache) RetrieveExtra(target *core.BuildTarget, key []byte, file
 	return cache.retrieveArtifacts(target, &req, false)
 }
 
+func (cache *rpcCache) Exists(target *core.BuildTarget, key []byte) bool {
+	if !cache.isConnected() {
+		return false
+	}
+	req := pb.RetrieveRequest{Hash: key, Os: runtime.GOOS, Arch: runtime.GOARCH, ExistsOnly: true}
+	for out := range cacheArtifacts(target) {
+		artifact := pb.Artifact{Package: target.Label.PackageName, Target: target.Label.Name, File: out}
+		req.Artifacts = append(req.Artifacts, &artifact)
+	}
+	if len(req.Artifacts) == 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
+	defer cancel()
+	exists := false
+	cache.runRpc(req.Hash, func(cache *rpcCache) (bool, []*pb.Artifact) {
+		if atomic.LoadInt32(&cache.existsUnsupported) != 0 {
+			return true, nil
+		}
+		response, err := cache.client.Retrieve(ctx, &req)
+		if code := grpc.Code(err); code == codes.Unimplemented || code == codes.ResourceExhausted || (err == nil && len(response.Artifacts) > 0) {
+			// Older servers don't know about exists_only; they either reject the request or try to
+			// send us everything. That's not a problem with the connection, we just can't tell
+			// what's there without downloading it, so give up asking.
+			if atomic.CompareAndSwapInt32(&cache.existsUnsupported, 0, 1) {
+				log.Warning("RPC cache server doesn't support checking for artifacts; it'll be assumed not to have them")
+			}
+			exists = err == nil && response.Success
+			return true, nil
+		} else if err != nil {
+			log.Warning("Failed to check for artifacts for %s: %s", target.Label, err)
+			cache.error()
+			return false, nil
+		}
+		exists = response.Success
+		return true, nil
+	})
+	return exists
+}
+
 func (cache *rpcCache) retrieveArtifacts(target *core.BuildTarget, req *pb.RetrieveRequest, remove bool) bool {
 	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
 	defer cancel()
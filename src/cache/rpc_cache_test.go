@@ -9,8 +9,11 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 
+	pb "cache/proto/rpc_cache"
 	"cache/server"
 	"core"
 )
@@ -96,6 +99,37 @@ func TestStoreAndRetrieve(t *testing.T) {
 	}
 }
 
+func TestExists(t *testing.T) {
+	target := core.NewBuildTarget(label)
+	target.AddOutput("testfile2")
+	rpccache.Store(target, []byte("test_key"))
+	assert.True(t, rpccache.Exists(target, []byte("test_key")))
+	assert.False(t, rpccache.Exists(target, []byte("other_key")))
+}
+
+func TestExistsOnOlderServer(t *testing.T) {
+	target := core.NewBuildTarget(label)
+	target.AddOutput("testfile")
+	client := &unimplementedClient{}
+	c := &rpcCache{client: client, Connected: true, timeout: time.Second}
+	for i := 0; i < maxErrors; i++ {
+		assert.False(t, c.Exists(target, []byte("test_key")))
+	}
+	assert.True(t, c.Connected, "Should not count as connection errors")
+	assert.Equal(t, 1, client.calls, "Should stop asking once it knows the server can't answer")
+}
+
+// unimplementedClient is a client for a server that doesn't implement anything.
+type unimplementedClient struct {
+	pb.RpcCacheClient
+	calls int
+}
+
+func (c *unimplementedClient) Retrieve(ctx context.Context, req *pb.RetrieveRequest, opts ...grpc.CallOption) (*pb.RetrieveResponse, error) {
+	c.calls++
+	return nil, grpc.Errorf(codes.Unimplemented, "unknown method Retrieve")
+}
+
 func TestClean(t *testing.T) {
 	target := core.NewBuildTarget(label)
 	rpccache.Clean(target)
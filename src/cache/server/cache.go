@@ -3,6 +3,7 @@ package server
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -12,6 +13,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/djherbis/atime"
@@ -24,6 +26,11 @@ import (
 // metadataFileName is the filename we store metadata in.
 const metadataFileName = ".plz_metadata"
 
+// casDir is the directory within the cache that stores artifacts by their content hash.
+// Artifacts are hardlinks into it, so identical ones stored for different targets only take
+// up space once. Blobs that nothing links to any more are removed when the cache is cleaned.
+const casDir = ".cas"
+
 // metadataTemplate is the template for writing the metadata files
 const metadataTemplate = `Address:    %s
 Hostname:   %s
@@ -94,6 +101,8 @@ func (cache *Cache) scan() {
 	filepath.Walk(cache.rootPath, func(name string, info os.FileInfo, err error) error {
 		if err != nil {
 			log.Fatalf("%s", err)
+		} else if info.IsDir() && info.Name() == casDir {
+			return filepath.SkipDir // Blobs are accounted for via the artifacts linking to them.
 		} else if !info.IsDir() { // We don't have directory entries.
 			name = name[len(cache.rootPath)+1:]
 			log.Debug("Found file %s", name)
@@ -208,6 +217,19 @@ func (cache *Cache) RetrieveArtifact(artPath string) (map[string][]byte, error)
 	return ret, nil
 }
 
+// ArtifactExists returns true if the given artifact path exists in the cache.
+// It's much cheaper than RetrieveArtifact since it doesn't need to read anything.
+func (cache *Cache) ArtifactExists(artPath string) bool {
+	if core.IsGlob(artPath) {
+		return len(core.Glob(cache.rootPath, []string{artPath}, nil, nil, true)) > 0
+	} else if _, present := cache.cachedFiles.Get(artPath); present {
+		return true
+	}
+	// Might be a directory, which we don't track directly.
+	info, err := os.Stat(path.Join(cache.rootPath, artPath))
+	return err == nil && info.IsDir()
+}
+
 // retrieveDir retrieves a directory of artifacts. We don't track the directory itself
 // but allow its traversal to retrieve them.
 func (cache *Cache) retrieveDir(artPath string) (map[string][]byte, error) {
@@ -249,7 +271,7 @@ func (cache *Cache) StoreArtifact(artPath string, key []byte) error {
 		return err
 	}
 	log.Debug("Writing artifact to %s", fullPath)
-	if err := core.WriteFile(bytes.NewReader(key), fullPath, 0); err != nil {
+	if err := cache.storeBlob(key, fullPath); err != nil {
 		log.Errorf("Could not create %s artifact: %s", fullPath, err)
 		cache.removeAndDeleteFile(artPath, lock)
 		return err
@@ -257,6 +279,30 @@ func (cache *Cache) StoreArtifact(artPath string, key []byte) error {
 	return nil
 }
 
+// storeBlob stores the given contents in the content-addressed store, if they're not there
+// already, and links them into place at the given path.
+func (cache *Cache) storeBlob(contents []byte, to string) error {
+	blob := path.Join(cache.rootPath, casDir, fmt.Sprintf("%x", sha1.Sum(contents)))
+	for i := 0; ; i++ {
+		if !core.PathExists(blob) {
+			if err := core.WriteFile(bytes.NewReader(contents), blob, 0); err != nil {
+				return err
+			}
+		} else {
+			log.Debug("%s already exists, not storing it again", blob)
+		}
+		if err := os.RemoveAll(to); err != nil {
+			return err
+		}
+		err := os.Link(blob, to)
+		if err == nil || !os.IsNotExist(err) || i > 0 {
+			return err
+		}
+		// The cleaner removed the blob between us checking for it and linking to it.
+		log.Debug("%s was removed while storing %s, storing it again", blob, to)
+	}
+}
+
 // StoreMetadata stores some metadata about the given artifact in a simple format.
 // This mostly just identifies where it came from.
 func (cache *Cache) StoreMetadata(artPath, hostname, address, peer string) error {
@@ -309,6 +355,26 @@ func (cache *Cache) clean(cleanFrequency, maxArtifactAge time.Duration, lowWater
 	for range time.NewTicker(cleanFrequency).C {
 		cache.cleanOldFiles(maxArtifactAge)
 		cache.singleClean(lowWaterMark, highWaterMark)
+		cache.cleanBlobs()
+	}
+}
+
+// cleanBlobs removes any content-addressed blobs that are no longer linked to by any artifacts.
+func (cache *Cache) cleanBlobs() {
+	if err := filepath.Walk(path.Join(cache.rootPath, casDir), func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if len(info.Name()) != 2*sha1.Size {
+			return nil // Not a blob, probably a temporary file for one that's still being written.
+		} else if stat, ok := info.Sys().(*syscall.Stat_t); ok && !info.IsDir() && stat.Nlink <= 1 {
+			log.Debug("Removing unreferenced blob %s", name)
+			if err := os.Remove(name); err != nil {
+				log.Error("Failed to delete blob %s: %s", name, err)
+			}
+		}
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		log.Error("Error walking blob directory: %s", err)
 	}
 }
 
@@ -123,3 +123,27 @@ func TestDeleteAll(t *testing.T) {
 		t.Error("The cache was not cleaned.")
 	}
 }
+
+func TestStoreDeduplicates(t *testing.T) {
+	c := newCache("test_store_deduplicates")
+	defer os.RemoveAll("test_store_deduplicates")
+	contents := []byte("identical contents")
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pack/label1/hash/out.txt", contents))
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pack/label2/hash/out.txt", contents))
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pack/label3/hash/out.txt", []byte("different contents")))
+	assert.True(t, core.IsSameFile("test_store_deduplicates/linux_amd64/pack/label1/hash/out.txt", "test_store_deduplicates/linux_amd64/pack/label2/hash/out.txt"))
+	assert.False(t, core.IsSameFile("test_store_deduplicates/linux_amd64/pack/label1/hash/out.txt", "test_store_deduplicates/linux_amd64/pack/label3/hash/out.txt"))
+
+	// Blobs aren't removed until nothing links to them any more.
+	assert.NoError(t, c.DeleteArtifact("linux_amd64/pack/label1"))
+	assert.NoError(t, c.DeleteArtifact("linux_amd64/pack/label3"))
+	c.cleanBlobs()
+	blobs, _ := filepath.Glob("test_store_deduplicates/.cas/*")
+	assert.Equal(t, 1, len(blobs))
+	ret, err := c.RetrieveArtifact("linux_amd64/pack/label2/hash/out.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"linux_amd64/pack/label2/hash/out.txt": contents}, ret)
+
+	// Blobs also aren't counted as artifacts in their own right.
+	assert.Equal(t, 1, newCache("test_store_deduplicates").NumFiles())
+}
@@ -65,6 +65,15 @@ func (s *httpServer) getHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// The headHandler function handles the HEAD endpoint for the artifact path.
+// It reports whether the artifact exists without returning its contents.
+func (s *httpServer) headHandler(w http.ResponseWriter, r *http.Request) {
+	artifactPath := strings.TrimPrefix(r.URL.Path, "/artifact/")
+	if !s.cache.ArtifactExists(artifactPath) {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
 // The postHandler function handles the POST endpoint for the artifact path.
 // It reads the request body and sends it to the StoreArtifact function, along with the path where it should
 // be stored.
@@ -124,6 +133,7 @@ func BuildRouter(cache *Cache) *mux.Router {
 	r := mux.NewRouter()
 	r.HandleFunc("/ping", s.pingHandler).Methods("GET")
 	r.HandleFunc("/artifact/{os_name}/{artifact:.*}", s.getHandler).Methods("GET")
+	r.HandleFunc("/artifact/{os_name}/{artifact:.*}", s.headHandler).Methods("HEAD")
 	r.HandleFunc("/artifact/{os_name}/{artifact:.*}", s.postHandler).Methods("POST")
 	r.HandleFunc("/artifact/{artifact:.*}", s.deleteHandler).Methods("DELETE")
 	r.HandleFunc("/", s.deleteAllHandler).Methods("DELETE")
@@ -57,6 +57,24 @@ func TestGetHandlerError(t *testing.T) {
 	}
 }
 
+func TestHeadHandler(t *testing.T) {
+	res, err := http.Head(realURL)
+	if err != nil {
+		t.Error(err)
+	} else if res.StatusCode < 200 || res.StatusCode > 299 {
+		t.Error("Expected response Status Accepted, got:", res.Status)
+	}
+}
+
+func TestHeadHandlerError(t *testing.T) {
+	res, err := http.Head(fakeURL)
+	if err != nil {
+		t.Error(err)
+	} else if res.StatusCode != 404 {
+		t.Error("Expected nil and found artifact.")
+	}
+}
+
 func TestPostHandler(t *testing.T) {
 	fileContent := "This is a newly created file."
 	reader = strings.NewReader(fileContent)
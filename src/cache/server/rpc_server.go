@@ -80,6 +80,12 @@ func (r *RpcCacheServer) Retrieve(ctx context.Context, req *pb.RetrieveRequest)
 	for _, artifact := range req.Artifacts {
 		root := path.Join(arch, artifact.Package, artifact.Target, hash)
 		fileRoot := path.Join(root, artifact.File)
+		if req.ExistsOnly {
+			if !r.cache.ArtifactExists(fileRoot) {
+				return &pb.RetrieveResponse{Success: false}, nil
+			}
+			continue
+		}
 		art, err := r.cache.RetrieveArtifact(fileRoot)
 		if err != nil {
 			log.Debug("Failed to retrieve artifact %s: %s", fileRoot, err)
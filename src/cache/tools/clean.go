@@ -0,0 +1,213 @@
+// Cleaning of the directory cache, shared between cache_cleaner and plz cache gc.
+
+package tools
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/djherbis/atime"
+	"github.com/dustin/go-humanize"
+	"gopkg.in/op/go-logging.v1"
+)
+
+var log = logging.MustGetLogger("cache")
+
+// Period of time in seconds between which two artifacts are considered to have the same atime.
+const accessTimeGracePeriod = 600 // Ten minutes
+
+// Name of the directory holding content-addressed blobs. Cache entries are hardlinks into here.
+const casDir = ".cas"
+
+// A CacheEntry is a single entry in the directory cache, i.e. the artifacts of one target at one hash.
+type CacheEntry struct {
+	Path  string
+	Size  int64
+	Atime int64
+}
+
+// CacheEntries implements sort.Interface to order entries least recently used first.
+type CacheEntries []CacheEntry
+
+func (entries CacheEntries) Len() int      { return len(entries) }
+func (entries CacheEntries) Swap(i, j int) { entries[i], entries[j] = entries[j], entries[i] }
+func (entries CacheEntries) Less(i, j int) bool {
+	diff := entries[i].Atime - entries[j].Atime
+	if diff > -accessTimeGracePeriod && diff < accessTimeGracePeriod {
+		return entries[i].Size > entries[j].Size
+	}
+	return entries[i].Atime < entries[j].Atime
+}
+
+// An inode identifies a file uniquely; since cache entries are hardlinked to one another we
+// use these to avoid counting the same file multiple times.
+type inode struct {
+	Dev, Ino uint64
+}
+
+func findSize(path string, seen map[inode]bool) (int64, error) {
+	var totalSize int64 = 0
+	if err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && !info.IsDir() {
+			key := inode{Dev: uint64(stat.Dev), Ino: uint64(stat.Ino)}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+		totalSize += info.Size()
+		return nil
+	}); err != nil {
+		return 0, err
+	} else {
+		return totalSize, nil
+	}
+}
+
+// findBlobs returns the inodes of all the content-addressed blobs in the given directory.
+func findBlobs(directory string) (map[inode]bool, error) {
+	blobs := map[inode]bool{}
+	if err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if stat, ok := info.Sys().(*syscall.Stat_t); ok && !info.IsDir() {
+			blobs[inode{Dev: uint64(stat.Dev), Ino: uint64(stat.Ino)}] = true
+		}
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// findFreeableSize returns the number of bytes that removing the given entry would free.
+// Files that are also linked from other entries don't count, since they'll still be there
+// afterwards; files whose only other link is their blob do, since cleanBlobs will remove those.
+func findFreeableSize(path string, blobs map[inode]bool) (int64, error) {
+	var totalSize int64 = 0
+	links := map[inode]uint64{}
+	sizes := map[inode]int64{}
+	nlinks := map[inode]uint64{}
+	if err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if stat, ok := info.Sys().(*syscall.Stat_t); ok && !info.IsDir() {
+			key := inode{Dev: uint64(stat.Dev), Ino: uint64(stat.Ino)}
+			links[key]++
+			sizes[key] = info.Size()
+			nlinks[key] = uint64(stat.Nlink)
+		} else {
+			totalSize += info.Size()
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	for key, n := range links {
+		if remaining := nlinks[key] - n; remaining == 0 || (remaining == 1 && blobs[key]) {
+			totalSize += sizes[key]
+		}
+	}
+	return totalSize, nil
+}
+
+// CleanDir cleans the directory cache in the given directory if it's bigger than highWaterMark,
+// evicting the least recently used entries until it's smaller than lowWaterMark.
+// It's safe to run while builds are using the cache; entries that are still being written are
+// left alone. Returns the size of the cache before cleaning and the number of bytes freed.
+func CleanDir(directory string, highWaterMark, lowWaterMark int64) (int64, int64) {
+	entries := CacheEntries{}
+	seen := map[inode]bool{}
+	var totalSize int64 = 0
+	if err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() && info.Name() == casDir {
+			return filepath.SkipDir // Blobs are accounted for via the entries linking to them.
+		} else if (len(info.Name()) == 28 || len(info.Name()) == 29) && info.Name()[27] == '=' {
+			// Directory has the right length. We do this in an attempt to clean only entire
+			// entries in the cache, not just individual files from them.
+			// 28 == length of 20-byte sha1 hash, encoded to base64, which always gets a trailing =
+			// as padding so we can check that to be "sure".
+			// Also 29 in case we appended an extra = (see below); entries are written under
+			// that name too, so we leave any that have been modified recently alone.
+			if len(info.Name()) == 29 && time.Since(info.ModTime()) < accessTimeGracePeriod*time.Second {
+				log.Debug("Skipping %s, it's probably still being written", path)
+				return filepath.SkipDir
+			} else if size, err := findSize(path, seen); err != nil {
+				return err
+			} else {
+				entries = append(entries, CacheEntry{path, size, atime.Get(info).Unix()})
+				totalSize += size
+				return filepath.SkipDir
+			}
+		} else {
+			return nil // nothing particularly to do for other entries
+		}
+	}); err != nil {
+		log.Fatalf("error walking cache directory: %s\n", err)
+	}
+	log.Notice("Total cache size: %s", humanize.Bytes(uint64(totalSize)))
+	defer cleanBlobs(filepath.Join(directory, casDir))
+	if totalSize < highWaterMark {
+		return totalSize, 0 // Nothing to do, cache is small enough.
+	}
+	// OK, we need to slim it down a bit. We implement a simple LRU algorithm.
+	sort.Sort(entries)
+	blobs, err := findBlobs(filepath.Join(directory, casDir))
+	if err != nil {
+		log.Fatalf("error walking blob directory: %s\n", err)
+	}
+	var freed int64
+	for _, entry := range entries {
+		// Measure this now rather than using entry.Size; that only counts files shared with other
+		// entries once, and whichever entry happened to be walked first gets them.
+		size, err := findFreeableSize(entry.Path, blobs)
+		if err != nil {
+			log.Errorf("Couldn't measure %s: %s", entry.Path, err)
+			continue
+		}
+		log.Notice("Cleaning %s, accessed %s, saves %s", entry.Path, humanize.Time(time.Unix(entry.Atime, 0)), humanize.Bytes(uint64(size)))
+		// Try to rename the directory first so we don't delete bits while someone might access them.
+		newPath := entry.Path + "="
+		if err := os.Rename(entry.Path, newPath); err != nil {
+			log.Errorf("Couldn't rename %s: %s", entry.Path, err)
+			continue
+		}
+		if err := os.RemoveAll(newPath); err != nil {
+			log.Errorf("Couldn't remove %s: %s", newPath, err)
+			continue
+		}
+		freed += size
+		if totalSize-freed < lowWaterMark {
+			break
+		}
+	}
+	return totalSize, freed
+}
+
+// cleanBlobs removes any content-addressed blobs that are no longer linked to by any cache entries.
+func cleanBlobs(directory string) {
+	if err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if strings.HasSuffix(path, "=") {
+			return nil // Still being written.
+		} else if stat, ok := info.Sys().(*syscall.Stat_t); ok && !info.IsDir() && stat.Nlink <= 1 {
+			log.Debug("Removing unreferenced blob %s", path)
+			if err := os.Remove(path); err != nil {
+				log.Errorf("Couldn't remove %s: %s", path, err)
+			}
+		}
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		log.Errorf("error walking blob directory: %s\n", err)
+	}
+}
@@ -0,0 +1,165 @@
+package tools
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheEntriesSortByTime(t *testing.T) {
+	entries := CacheEntries{
+		CacheEntry{Path: "path1", Size: 1000, Atime: 1449488976},
+		CacheEntry{Path: "path2", Size: 1000, Atime: 1449688978},
+		CacheEntry{Path: "path3", Size: 1000, Atime: 1449588977},
+	}
+	sort.Sort(entries)
+	// Oldest first.
+	assert.Equal(t, "path1", entries[0].Path)
+	assert.Equal(t, "path3", entries[1].Path)
+	assert.Equal(t, "path2", entries[2].Path)
+}
+
+func TestCacheEntriesSortBySizeAfterTime(t *testing.T) {
+	entries := CacheEntries{
+		CacheEntry{Path: "path1", Size: 10, Atime: 1449488976},
+		CacheEntry{Path: "path2", Size: 100000, Atime: 1449488976},
+		CacheEntry{Path: "path3", Size: 1000, Atime: 1449488976},
+	}
+	sort.Sort(entries)
+	// Largest first.
+	assert.Equal(t, "path2", entries[0].Path)
+	assert.Equal(t, "path3", entries[1].Path)
+	assert.Equal(t, "path1", entries[2].Path)
+}
+
+func TestCacheEntriesSortingWithTolerance(t *testing.T) {
+	entries := CacheEntries{
+		CacheEntry{Path: "path1", Size: 10, Atime: 1449488976},
+		CacheEntry{Path: "path2", Size: 100000, Atime: 1449488978},
+		CacheEntry{Path: "path3", Size: 1000, Atime: 1449488977},
+	}
+	sort.Sort(entries)
+	// Similar to the previous test, but times aren't exactly the same; we should prefer to
+	// delete the 100kB file over the 10B one, it being two seconds newer shouldn't be enough
+	// to save it.
+	assert.Equal(t, "path2", entries[0].Path)
+	assert.Equal(t, "path3", entries[1].Path)
+	assert.Equal(t, "path1", entries[2].Path)
+}
+
+func TestCleanBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache_cleaner_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	blobs := filepath.Join(dir, casDir)
+	assert.NoError(t, os.MkdirAll(blobs, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(blobs, "linked"), []byte("linked"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(blobs, "unlinked"), []byte("unlinked"), 0644))
+	assert.NoError(t, os.Link(filepath.Join(blobs, "linked"), filepath.Join(dir, "entry")))
+	cleanBlobs(blobs)
+	_, err = os.Stat(filepath.Join(blobs, "linked"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(blobs, "unlinked"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFindSizeCountsHardlinksOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache_cleaner_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte("12345"), 0644))
+	assert.NoError(t, os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")))
+	size, err := findSize(dir, map[inode]bool{})
+	assert.NoError(t, err)
+	info, _ := os.Stat(dir)
+	assert.EqualValues(t, 5+info.Size(), size)
+}
+
+func TestCleanDirEvictsLeastRecentlyUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache_cleaner_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	old := writeEntry(t, dir, "old", 100000, now.Add(-3*time.Hour))
+	middle := writeEntry(t, dir, "middle", 100000, now.Add(-2*time.Hour))
+	recent := writeEntry(t, dir, "recent", 100000, now.Add(-1*time.Hour))
+	total, freed := CleanDir(dir, 250000, 250000)
+	assert.True(t, total > 300000)
+	assert.True(t, freed > 100000)
+	assert.False(t, pathExists(old))
+	assert.True(t, pathExists(middle))
+	assert.True(t, pathExists(recent))
+}
+
+func TestCleanDirCountsSharedBlobsWhenFreed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache_cleaner_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	old := writeEntry(t, dir, "a", 0, now.Add(-3*time.Hour))
+	middle := writeEntry(t, dir, "b", 0, now.Add(-2*time.Hour))
+	recent := writeEntry(t, dir, "recent", 100000, now.Add(-1*time.Hour))
+	// The old and middle entries share a blob, so evicting just one of them doesn't free it.
+	// The old one is walked first so it's the one that gets credited with its size.
+	blob := filepath.Join(dir, casDir, "blob")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(blob), 0755))
+	assert.NoError(t, ioutil.WriteFile(blob, make([]byte, 100000), 0644))
+	for _, entry := range []string{old, middle} {
+		assert.NoError(t, os.Remove(filepath.Join(entry, "out")))
+		assert.NoError(t, os.Link(blob, filepath.Join(entry, "out")))
+		assert.NoError(t, os.Chtimes(entry, now.Add(-3*time.Hour), now.Add(-3*time.Hour)))
+	}
+	assert.NoError(t, os.Chtimes(middle, now.Add(-2*time.Hour), now.Add(-2*time.Hour)))
+	total, freed := CleanDir(dir, 150000, 150000)
+	assert.True(t, total > 200000)
+	assert.True(t, freed > 100000)
+	assert.True(t, freed < 200000)
+	assert.False(t, pathExists(old))
+	assert.False(t, pathExists(middle))
+	assert.True(t, pathExists(recent))
+	assert.False(t, pathExists(blob))
+}
+
+func TestCleanDirDoesNothingUnderLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache_cleaner_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	entry := writeEntry(t, dir, "entry", 1000, time.Now().Add(-time.Hour))
+	_, freed := CleanDir(dir, 1000000, 1000000)
+	assert.EqualValues(t, 0, freed)
+	assert.True(t, pathExists(entry))
+}
+
+func TestCleanDirSkipsEntriesBeingWritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache_cleaner_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	entry := writeEntry(t, dir, "entry", 1000, time.Now().Add(-time.Hour))
+	// This is the name the dir cache writes an entry under before moving it into place.
+	writing := entry + "="
+	assert.NoError(t, os.Rename(entry, writing))
+	assert.NoError(t, os.Chtimes(writing, time.Now().Add(-time.Hour), time.Now()))
+	_, freed := CleanDir(dir, 0, 0)
+	assert.EqualValues(t, 0, freed)
+	assert.True(t, pathExists(writing))
+}
+
+// writeEntry writes a cache entry for the given target of the given size, last accessed at the given time.
+func writeEntry(t *testing.T, dir, name string, size int, accessed time.Time) string {
+	entry := filepath.Join(dir, "pkg", name, base64.URLEncoding.EncodeToString(make([]byte, 20)))
+	assert.NoError(t, os.MkdirAll(entry, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(entry, "out"), make([]byte, size), 0644))
+	assert.NoError(t, os.Chtimes(entry, accessed, accessed))
+	return entry
+}
+
+func pathExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
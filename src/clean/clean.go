@@ -5,10 +5,13 @@ package clean
 import (
 	"fmt"
 	"os"
+	"path"
 
+	"github.com/dustin/go-humanize"
 	"gopkg.in/op/go-logging.v1"
 
 	"build"
+	"cache/tools"
 	"core"
 	"test"
 )
@@ -46,6 +49,24 @@ func CleanTargets(state *core.BuildState, labels []core.BuildLabel, cleanCache b
 	}
 }
 
+// GcDirCache evicts the least recently used entries from the directory cache until it's
+// smaller than maxSize, and reports how much space it freed.
+func GcDirCache(config *core.Configuration, maxSize uint64) {
+	if config.Cache.Dir == "" {
+		log.Fatalf("There's no directory cache configured")
+	}
+	dir := config.Cache.Dir
+	if !path.IsAbs(dir) {
+		dir = path.Join(core.RepoRoot, dir)
+	}
+	if !core.PathExists(dir) {
+		fmt.Printf("Directory cache %s doesn't exist, nothing to do\n", dir)
+		return
+	}
+	total, freed := tools.CleanDir(dir, int64(maxSize), int64(maxSize))
+	fmt.Printf("Freed %s, the directory cache is now %s\n", humanize.Bytes(uint64(freed)), humanize.Bytes(uint64(total-freed)))
+}
+
 func cleanTarget(state *core.BuildState, target *core.BuildTarget, cleanCache bool) {
 	if err := build.RemoveOutputs(target); err != nil {
 		log.Fatalf("Failed to remove output: %s", err)
@@ -60,11 +81,11 @@ func cleanTarget(state *core.BuildState, target *core.BuildTarget, cleanCache bo
 	}
 }
 
-func clean(path string) {
-	if core.PathExists(path) {
-		log.Info("Cleaning path %s", path)
-		if err := os.RemoveAll(path); err != nil {
-			log.Fatalf("Failed to clean path %s: %s", path, err)
+func clean(dir string) {
+	if core.PathExists(dir) {
+		log.Info("Cleaning path %s", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			log.Fatalf("Failed to clean path %s: %s", dir, err)
 		}
 	}
 }
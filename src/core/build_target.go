@@ -54,6 +54,11 @@ type BuildTarget struct {
 	// Optional output files of this rule. Same as outs but aren't required to be produced always.
 	// Can be glob patterns.
 	OptionalOutputs []string `name:"optional_outs"`
+	// Glob patterns for outputs of this rule that aren't known until it's been built.
+	// Everything matching them is collected as an output, unlike optional outputs.
+	OutputGlobs []string `name:"output_glob"`
+	// The outputs that matched OutputGlobs the last time this rule was built.
+	globOutputs []string `print:"false"`
 	// Optional labels applied to this rule. Used for including/excluding rules.
 	Labels []string
 	// Shell command to run.
@@ -79,9 +84,22 @@ type BuildTarget struct {
 	Sandbox bool
 	// True if the test action is sandboxed.
 	TestSandbox bool `name:"test_sandbox"`
+	// True if the test's data files are symlinked into its test directory instead of being copied.
+	SymlinkData bool `name:"symlink_data"`
 	// True if the target is a test and has no output file.
 	// Default is false, meaning all tests must produce test.results as output.
 	NoTestOutput bool `name:"no_test_output"`
+	// True if the test shuffles the order it runs in; it's given a seed to do so with
+	// so that any given ordering can be reproduced later.
+	Shuffle bool `name:"shuffle"`
+	// True if the test supports being split into shards, each of which runs a subset of its cases.
+	TestSharding bool `name:"test_sharding"`
+	// True if the test is expected to fail. Failures are reported as success, but an unexpected
+	// pass is reported as a failure so the marker can be removed.
+	ExpectedToFail bool `name:"expected_to_fail"`
+	// True if this target's outputs (and test results) should never be stored in or retrieved
+	// from the cache, typically because they're nondeterministic.
+	NoCache bool `name:"no_cache"`
 	// True if this target needs access to its transitive dependencies to build.
 	// This would be false for most 'normal' genrules but true for eg. compiler steps
 	// that need to build in everything.
@@ -132,6 +150,15 @@ type BuildTarget struct {
 	Requires []string
 	// Dependent rules this rule provides for each language. Matches up to Requires as described above.
 	Provides map[string]BuildLabel
+	// Named resources (e.g. GPUs) that this target needs while it runs, and how much of each.
+	// Only as many targets as the configured totals allow will run at once.
+	Resources map[string]int `name:"resources"`
+	// Expected SHA256 hashes of the tools of this target, keyed by the tool as declared.
+	// They're checked before the target is built.
+	ToolHashes map[string]string `name:"tool_hashes"`
+	// Environment variables to pass through to the test from the environment plz is run in.
+	// With --hermetic_env these are also the only ones besides Please's own that the test gets.
+	PassEnv []string `name:"pass_env"`
 	// Stores the hash of this build rule before any post-build function is run.
 	RuleHash []byte `name:"exported_deps"` // bit of a hack to call this exported_deps...
 	// Tools that this rule will use, ie. other rules that it may use at build time which are not
@@ -142,9 +169,24 @@ type BuildTarget struct {
 	// Flakiness of test, ie. number of times we will rerun it before giving up. 0 is the default and
 	// is interpreted the same way as 1 would be (ie. one run only).
 	Flakiness int `name:"flaky"`
+	// If set, failed runs of a flaky test are only retried if their output matches this regex.
+	// Any other failure fails the test immediately.
+	FlakyRetryRegex string `name:"flaky_retry_regex"`
 	// Timeouts for build/test actions
 	BuildTimeout time.Duration `name:"timeout"`
 	TestTimeout  time.Duration `name:"test_timeout"`
+	// Timeout for each individual case within a test. This is only a hint given to the test
+	// itself; TestTimeout remains the hard limit that we enforce on the whole thing.
+	PerCaseTimeout time.Duration `name:"per_case_timeout"`
+	// Length of time the test is expected to take. Tests that take longer are flagged as slow
+	// even if they pass. Zero means there's no expectation.
+	ExpectedDuration time.Duration `name:"expected_duration"`
+	// Targets that are run once before and after all the runs of a test, for example to start
+	// and stop a database that it uses. They share a scratch directory with the test.
+	TestSetup    *BuildLabel `name:"test_setup"`
+	TestTeardown *BuildLabel `name:"test_teardown"`
+	// Niceness to run the build and test actions of this target at, from 0 (normal) to 19 (lowest).
+	Priority int `name:"priority"`
 	// Extra output files from the test.
 	// These are in addition to the usual test.results output file.
 	TestOutputs []string
@@ -406,8 +448,9 @@ func (target *BuildTarget) Outputs() []string {
 		}
 	} else {
 		// Must really copy the slice before sorting it ([:] is too shallow)
-		ret = make([]string, len(target.outputs))
+		ret = make([]string, len(target.outputs), len(target.outputs)+len(target.globOutputs))
 		copy(ret, target.outputs)
+		ret = append(ret, target.globOutputs...)
 	}
 	if target.namedOutputs != nil {
 		for _, outputs := range target.namedOutputs {
@@ -681,6 +724,24 @@ func (target *BuildTarget) AddProvide(language string, label BuildLabel) {
 	}
 }
 
+// AddResource adds a resource requirement to this target.
+func (target *BuildTarget) AddResource(name string, amount int) {
+	if target.Resources == nil {
+		target.Resources = map[string]int{name: amount}
+	} else {
+		target.Resources[name] = amount
+	}
+}
+
+// AddToolHash adds the expected hash of one of this target's tools.
+func (target *BuildTarget) AddToolHash(tool, hash string) {
+	if target.ToolHashes == nil {
+		target.ToolHashes = map[string]string{tool: hash}
+	} else {
+		target.ToolHashes[tool] = hash
+	}
+}
+
 // ProvideFor returns the build label that we'd provide for the given target.
 func (target *BuildTarget) ProvideFor(other *BuildTarget) []BuildLabel {
 	ret := []BuildLabel{}
@@ -941,6 +1002,19 @@ func (target *BuildTarget) AddOutput(output string) {
 	target.outputs = target.insert(target.outputs, output)
 }
 
+// GlobOutputs returns the outputs of this target that were discovered from its output globs.
+func (target *BuildTarget) GlobOutputs() []string {
+	return target.globOutputs
+}
+
+// SetGlobOutputs replaces the outputs of this target that were discovered from its output globs.
+func (target *BuildTarget) SetGlobOutputs(outputs []string) {
+	target.globOutputs = nil
+	for _, output := range outputs {
+		target.globOutputs = target.insert(target.globOutputs, output)
+	}
+}
+
 // AddNamedOutput adds a new output to the target under a named group.
 // No attempt to deduplicate against unnamed outputs is currently made.
 func (target *BuildTarget) AddNamedOutput(name, output string) {
@@ -1008,6 +1082,11 @@ func (target *BuildTarget) PostBuildOutputFileName() string {
 	return ".build_output_" + target.Label.Name
 }
 
+// GlobOutputsFileName returns the file recording which outputs matched this target's output globs.
+func (target *BuildTarget) GlobOutputsFileName() string {
+	return ".glob_outputs_" + target.Label.Name
+}
+
 // Parent finds the parent of a build target, or nil if the target is parentless.
 // Note that this is a fairly informal relationship; we identify it by labels with the convention of
 // a leading _ and trailing hashtag on child rules, rather than storing pointers between them in the graph.
@@ -16,6 +16,9 @@ type Cache interface {
 	// Retrieves an extra file previously stored by StoreExtra.
 	// If successful, the file will be placed into the output file tree.
 	RetrieveExtra(target *BuildTarget, key []byte, file string) bool
+	// Returns true if the results of a single build target are present in the cache,
+	// without retrieving them. This should be fairly cheap to call.
+	Exists(target *BuildTarget, key []byte) bool
 	// Cleans any artifacts associated with this target from the cache, for any possible key.
 	Clean(target *BuildTarget)
 	// Cleans the entire cache.
@@ -119,7 +119,9 @@ func DefaultConfiguration() *Configuration {
 	config.BuildConfig = map[string]string{}
 	config.Aliases = map[string]string{}
 	config.Cache.HttpTimeout = cli.Duration(5 * time.Second)
+	config.Cache.HttpRetryDelay = cli.Duration(200 * time.Millisecond)
 	config.Cache.RpcTimeout = cli.Duration(5 * time.Second)
+	config.Cache.ExternalTimeout = cli.Duration(30 * time.Second)
 	config.Cache.Dir = ".plz-cache"
 	config.Cache.DirCacheHighWaterMark = "10G"
 	config.Cache.DirCacheLowWaterMark = "8G"
@@ -206,6 +208,7 @@ type Configuration struct {
 		FallbackConfig    string       `help:"The build config to use when one is chosen and a required target does not have one by the same name. Also defaults to opt." example:"opt | dbg"`
 		Sandbox           bool         `help:"True to sandbox individual build actions, which isolates them using namespaces. Somewhat experimental, only works on Linux and requires please_sandbox to be installed separately."`
 		PleaseSandboxTool string       `help:"The location of the please_sandbox tool to use."`
+		Resources         []string     `help:"Total amount of each named resource available for tests to declare with the resources attribute, in the form name=amount. Tests that need more than is currently free wait until enough is released. Resources that aren't listed here are unlimited." example:"gpu=2"`
 	}
 	BuildConfig map[string]string `help:"A section of arbitrary key-value properties that are made available in the BUILD language. These are often useful for writing custom rules that need some configurable property.\n\n[buildconfig]\nandroid-tools-version = 23.0.2\n\nFor example, the above can be accessed as CONFIG.ANDROID_TOOLS_VERSION."`
 	Cache       struct {
@@ -216,7 +219,9 @@ type Configuration struct {
 		DirCacheLowWaterMark  string       `help:"When cleaning the directory cache, it's reduced to at most this size."`
 		HttpUrl               cli.URL      `help:"Base URL of the HTTP cache.\nNot set to anything by default which means the cache will be disabled."`
 		HttpWriteable         bool         `help:"If True this plz instance will write content back to the HTTP cache.\nBy default it runs in read-only mode."`
-		HttpTimeout           cli.Duration `help:"Timeout for operations contacting the HTTP cache, in seconds."`
+		HttpTimeout           cli.Duration `help:"Timeout for connecting to the HTTP cache and waiting for it to respond, in seconds. Transferring artifacts can take longer than this."`
+		HttpRetries           int          `help:"Number of times to retry fetching an artifact from the HTTP cache after a transient error (e.g. a 5xx response or timeout).\nMisses are never retried. Defaults to 0."`
+		HttpRetryDelay        cli.Duration `help:"Delay before the first retry of a failed fetch from the HTTP cache. It doubles on each subsequent retry."`
 		RpcUrl                cli.URL      `help:"Base URL of the RPC cache.\nNot set to anything by default which means the cache will be disabled."`
 		RpcWriteable          bool         `help:"If True this plz instance will write content back to the RPC cache.\nBy default it runs in read-only mode."`
 		RpcTimeout            cli.Duration `help:"Timeout for operations contacting the RPC cache, in seconds."`
@@ -225,6 +230,9 @@ type Configuration struct {
 		RpcCACert             string       `help:"File containing a PEM-encoded certificate which is used to validate the RPC cache's certificate." example:"ca.pem"`
 		RpcSecure             bool         `help:"Forces SSL on for the RPC cache. It will be activated if any of rpcpublickey, rpcprivatekey or rpccacert are set, but this can be used if none of those are needed and SSL is still in use."`
 		RpcMaxMsgSize         cli.ByteSize `help:"Maximum size of a single message that we'll send to the RPC server.\nThis should agree with the server's limit, if it's higher the artifacts will be rejected.\nThe value is given as a byte size so can be suffixed with M, GB, KiB, etc."`
+		ExternalCommand       string       `help:"Command to run to get and put artifacts in an external cache. It's invoked with a subcommand (one of exists, get or put) and the name of an artifact as further arguments, and transfers the artifact on stdout / stdin. See the documentation for details of the protocol.\nNot set to anything by default which means the cache will be disabled." example:"/usr/local/bin/plz_s3_cache --bucket=artifacts"`
+		ExternalWriteable     bool         `help:"If True this plz instance will write content back to the external cache.\nBy default it runs in read-only mode."`
+		ExternalTimeout       cli.Duration `help:"Timeout for a single invocation of the external cache command, after which it's killed and treated as a miss."`
 	} `help:"Please has several built-in caches that can be configured in its config file.\n\nThe simplest one is the directory cache which by default is written into the .plz-cache directory. This allows for fast retrieval of code that has been built before (for example, when swapping Git branches).\n\nThere is also a remote RPC cache which allows using a centralised server to store artifacts. A typical pattern here is to have your CI system write artifacts into it and give developers read-only access so they can reuse its work.\n\nFinally there's a HTTP cache which is very similar, but a little obsolete now since the RPC cache outperforms it and has some extra features. Otherwise the two have similar semantics and share quite a bit of implementation.\n\nPlease has server implementations for both the RPC and HTTP caches."`
 	Metrics struct {
 		PushGatewayURL cli.URL      `help:"The URL of the pushgateway to send metrics to."`
@@ -237,6 +245,7 @@ type Configuration struct {
 		Timeout          cli.Duration `help:"Default timeout applied to all tests. Can be overridden on a per-rule basis."`
 		DefaultContainer string       `help:"Sets the default type of containerisation to use for tests that are given container = True.\nCurrently the only available option is 'docker', we expect to add support for more engines in future."`
 		Sandbox          bool         `help:"True to sandbox individual tests, which isolates them using namespaces. Somewhat experimental, only works on Linux and requires please_sandbox to be installed separately."`
+		SymlinkData      bool         `help:"True to symlink data files into each test's directory instead of copying them. Can be overridden on a per-rule basis with symlink_data. Has no effect on containerised or sandboxed tests."`
 	}
 	Cover struct {
 		FileExtension    []string `help:"Extensions of files to consider for coverage.\nDefaults to a reasonably obvious set for the builtin rules including .go, .py, .java, etc."`
@@ -0,0 +1,64 @@
+// Support for streaming the output of several subprocesses to the console at once.
+
+package core
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// streamMutex serialises writes from all the targets that are streaming their output at once,
+// so lines from different targets don't get mixed up with one another.
+var streamMutex sync.Mutex
+
+// A LineStreamer writes complete lines of output to an underlying writer, each prefixed with
+// the label of the target they came from. Partial lines are held back until they're completed
+// or the streamer is flushed.
+type LineStreamer struct {
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+	mutex  sync.Mutex
+}
+
+// NewLineStreamer returns a new LineStreamer that writes to the given writer.
+func NewLineStreamer(w io.Writer, label BuildLabel) *LineStreamer {
+	return &LineStreamer{w: w, prefix: []byte(label.String() + ": ")}
+}
+
+// Write implements the io.Writer interface.
+// It never returns an error; failing to display output shouldn't cause whatever's producing it to fail.
+func (s *LineStreamer) Write(b []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.buf = append(s.buf, b...)
+	if idx := bytes.LastIndexByte(s.buf, '\n'); idx != -1 {
+		s.writeLines(s.buf[:idx+1])
+		s.buf = append([]byte{}, s.buf[idx+1:]...)
+	}
+	return len(b), nil
+}
+
+// Flush writes out any partial line that's still buffered.
+func (s *LineStreamer) Flush() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.buf) > 0 {
+		s.writeLines(append(s.buf, '\n'))
+		s.buf = nil
+	}
+}
+
+// writeLines writes the given lines, which must end in a newline, prefixing each one.
+func (s *LineStreamer) writeLines(lines []byte) {
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(lines[:len(lines)-1], []byte{'\n'}) {
+		buf.Write(s.prefix)
+		buf.Write(line)
+	}
+	buf.WriteByte('\n')
+	streamMutex.Lock()
+	defer streamMutex.Unlock()
+	s.w.Write(buf.Bytes())
+}
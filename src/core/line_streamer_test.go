@@ -0,0 +1,44 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineStreamer(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewLineStreamer(&buf, ParseBuildLabel("//src/test:stream_test", ""))
+	s.Write([]byte("first line\nsecond "))
+	assert.Equal(t, "//src/test:stream_test: first line\n", buf.String())
+	s.Write([]byte("line\nthird\nfourth"))
+	assert.Equal(t, "//src/test:stream_test: first line\n//src/test:stream_test: second line\n//src/test:stream_test: third\n", buf.String())
+	s.Flush()
+	assert.Equal(t, "//src/test:stream_test: first line\n//src/test:stream_test: second line\n//src/test:stream_test: third\n//src/test:stream_test: fourth\n", buf.String())
+	s.Flush() // Should be a no-op now
+	assert.Equal(t, 4, bytes.Count(buf.Bytes(), []byte{'\n'}))
+}
+
+func TestLineStreamerConcurrentTests(t *testing.T) {
+	var buf bytes.Buffer
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := NewLineStreamer(&buf, ParseBuildLabel(fmt.Sprintf("//src/test:test%d", i), ""))
+			for j := 0; j < 100; j++ {
+				fmt.Fprintf(s, "line %d\n", j)
+			}
+		}(i)
+	}
+	wg.Wait()
+	lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), []byte{'\n'})
+	assert.Equal(t, 500, len(lines))
+	for _, line := range lines {
+		assert.Regexp(t, "^//src/test:test[0-4]: line [0-9]+$", string(line))
+	}
+}
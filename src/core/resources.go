@@ -0,0 +1,107 @@
+// Tracking of arbitrary resources (e.g. GPUs) that targets need while they run.
+
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A ResourcePool tracks the available amount of each resource and admits targets only once
+// the resources they've declared are free.
+// Resources that haven't been given a total are unlimited.
+// A nil ResourcePool is valid and never blocks anything.
+type ResourcePool struct {
+	total, available map[string]int
+	cond             *sync.Cond
+}
+
+// NewResourcePool creates a new ResourcePool with the given total amount of each resource.
+func NewResourcePool(total map[string]int) *ResourcePool {
+	available := make(map[string]int, len(total))
+	for name, amount := range total {
+		available[name] = amount
+	}
+	return &ResourcePool{total: total, available: available, cond: sync.NewCond(&sync.Mutex{})}
+}
+
+// TryAcquire acquires the given resources if they're all available, and returns true if it did so.
+func (pool *ResourcePool) TryAcquire(resources map[string]int) bool {
+	if pool == nil || len(resources) == 0 {
+		return true
+	}
+	pool.cond.L.Lock()
+	defer pool.cond.L.Unlock()
+	return pool.tryAcquire(resources)
+}
+
+// Acquire acquires the given resources, blocking until they're all available.
+func (pool *ResourcePool) Acquire(resources map[string]int) {
+	if pool == nil || len(resources) == 0 {
+		return
+	}
+	pool.cond.L.Lock()
+	defer pool.cond.L.Unlock()
+	for !pool.tryAcquire(resources) {
+		pool.cond.Wait()
+	}
+}
+
+// Release releases resources previously acquired by Acquire or TryAcquire.
+func (pool *ResourcePool) Release(resources map[string]int) {
+	if pool == nil || len(resources) == 0 {
+		return
+	}
+	pool.cond.L.Lock()
+	defer pool.cond.L.Unlock()
+	for name, amount := range resources {
+		if _, present := pool.total[name]; present {
+			pool.available[name] += pool.amount(name, amount)
+		}
+	}
+	pool.cond.Broadcast()
+}
+
+// tryAcquire is the implementation of TryAcquire. The lock must be held while calling it.
+func (pool *ResourcePool) tryAcquire(resources map[string]int) bool {
+	for name, amount := range resources {
+		if available, present := pool.available[name]; present && available < pool.amount(name, amount) {
+			return false
+		}
+	}
+	for name, amount := range resources {
+		if _, present := pool.available[name]; present {
+			pool.available[name] -= pool.amount(name, amount)
+		}
+	}
+	return true
+}
+
+// amount returns the amount of a resource that we'll actually allocate for a request.
+// Anything asking for more than exists gets all of it, otherwise it could never run.
+func (pool *ResourcePool) amount(name string, amount int) int {
+	if total := pool.total[name]; amount > total {
+		return total
+	}
+	return amount
+}
+
+// ParseResources parses a series of resource specifications in the form name=amount.
+// Later specifications for the same resource override earlier ones.
+func ParseResources(specs []string) (map[string]int, error) {
+	ret := make(map[string]int, len(specs))
+	for _, spec := range specs {
+		index := strings.IndexRune(spec, '=')
+		if index == -1 {
+			return nil, fmt.Errorf("Invalid resource specification %s; must be in the form name=amount", spec)
+		}
+		amount, err := strconv.Atoi(spec[index+1:])
+		if err != nil || amount < 0 {
+			return nil, fmt.Errorf("Invalid amount for resource %s", spec)
+		}
+		ret[spec[:index]] = amount
+	}
+	return ret, nil
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseResources(t *testing.T) {
+	resources, err := ParseResources([]string{"gpu=2", "memory=16", "gpu=3"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"gpu": 3, "memory": 16}, resources)
+	_, err = ParseResources([]string{"gpu"})
+	assert.Error(t, err)
+	_, err = ParseResources([]string{"gpu=lots"})
+	assert.Error(t, err)
+}
+
+func TestResourcePool(t *testing.T) {
+	pool := NewResourcePool(map[string]int{"gpu": 2})
+	gpu := map[string]int{"gpu": 1}
+	assert.True(t, pool.TryAcquire(gpu))
+	assert.True(t, pool.TryAcquire(gpu))
+	assert.False(t, pool.TryAcquire(gpu))
+	pool.Release(gpu)
+	assert.True(t, pool.TryAcquire(gpu))
+}
+
+func TestResourcePoolUnlimitedResources(t *testing.T) {
+	pool := NewResourcePool(map[string]int{"gpu": 1})
+	cpu := map[string]int{"cpu": 100}
+	assert.True(t, pool.TryAcquire(cpu))
+	assert.True(t, pool.TryAcquire(cpu))
+}
+
+func TestResourcePoolClampsLargeRequests(t *testing.T) {
+	pool := NewResourcePool(map[string]int{"gpu": 2})
+	lots := map[string]int{"gpu": 5}
+	assert.True(t, pool.TryAcquire(lots))
+	assert.False(t, pool.TryAcquire(map[string]int{"gpu": 1}))
+	pool.Release(lots)
+	assert.True(t, pool.TryAcquire(map[string]int{"gpu": 2}))
+}
+
+func TestResourcePoolBlocks(t *testing.T) {
+	pool := NewResourcePool(map[string]int{"gpu": 1})
+	gpu := map[string]int{"gpu": 1}
+	pool.Acquire(gpu)
+	acquired := make(chan bool)
+	go func() {
+		pool.Acquire(gpu)
+		acquired <- true
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Acquired resource that should have been unavailable")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pool.Release(gpu)
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Failed to acquire resource after it was released")
+	}
+}
+
+func TestNilResourcePool(t *testing.T) {
+	var pool *ResourcePool
+	assert.True(t, pool.TryAcquire(map[string]int{"gpu": 1}))
+	pool.Acquire(map[string]int{"gpu": 1})
+	pool.Release(map[string]int{"gpu": 1})
+}
@@ -74,6 +74,8 @@ type BuildState struct {
 	Verbosity int
 	// Cache to store / retrieve old build results.
 	Cache Cache
+	// Pool of named resources that tests must acquire before they run.
+	Resources *ResourcePool
 	// Targets that we were originally requested to build
 	OriginalTargets []BuildLabel
 	// Arguments to tests.
@@ -101,14 +103,41 @@ type BuildState struct {
 	PrepareShell bool
 	// Number of times to run each test target. 0 == once each, plus flakes if necessary.
 	NumTestRuns int
+	// If nonzero, run each test up to this many times, stopping as soon as it fails.
+	RepeatUntilFailure int
+	// Multiplier applied to the timeout of successive test runs. 1 == the same timeout for every run.
+	FlakyTimeoutMultiplier float64
+	// True to stop rerunning a test as soon as it's been seen to both pass and fail.
+	FailFastFlakes bool
+	// True to fail tests that take longer than their expected_duration, rather than just warning.
+	EnforceDurations bool
+	// True to pass tests that succeed in a majority of their runs, rather than using their flakiness.
+	FlakyMajority bool
+	// True to scrub the environment of tests down to the variables they explicitly ask for.
+	HermeticTestEnv bool
+	// Seed given to tests that shuffle their order. Successive runs of a test get successive seeds.
+	TestSeed int64
+	// Regex selecting which test cases to run within each test. Empty means all of them.
+	TestFilter string
+	// Number of shards to split tests into, and the index of the one we're running.
+	// Only applies to tests that support sharding; 0 total shards means it's not enabled.
+	NumTestShards, TestShardIndex int
 	// True to clean working directories after successful builds.
 	CleanWorkdirs bool
 	// True if we're forcing a rebuild of the original targets.
 	ForceRebuild bool
+	// True to explain why each target that gets rebuilt needed it.
+	WhyRebuild bool
 	// True to always show test output, even on success.
 	ShowTestOutput bool
 	// True to print all output of all tasks to stderr.
 	ShowAllOutput bool
+	// True to print the output of tests to stderr as they run, prefixed with their label.
+	StreamTestOutput bool
+	// Niceness to run all build and test actions at. Targets with a higher priority attribute use that instead.
+	Nice int
+	// True to record the files that sandboxed build actions access and report any outside their inputs.
+	AuditSandbox bool
 	// Number of running workers
 	numWorkers int
 	// Experimental directory
@@ -118,12 +147,24 @@ type BuildState struct {
 	numPending int64
 	numDone    int64
 	mutex      sync.Mutex
+	// Tests that couldn't be started yet because the resources they need aren't free.
+	// They're requeued when some are released, so they don't tie up a worker while they wait.
+	waitingTests []BuildLabel
+	// Tests that couldn't be started yet because their setup or teardown targets aren't built.
+	// These are re-added once another target finishes building.
+	waitingForTargets []BuildLabel
+	waitingMutex      sync.Mutex
 }
 
 // Singleton instance of one of these. Tried to avoid introducing it but it ended up being
 // inevitable to make some of the parsing code work.
 var State *BuildState
 
+// IsSharded returns true if the given target is going to be run as one shard of several.
+func (state *BuildState) IsSharded(target *BuildTarget) bool {
+	return target.TestSharding && state.NumTestShards > 1
+}
+
 func (state *BuildState) AddActiveTarget() {
 	atomic.AddInt64(&state.numActive, 1)
 }
@@ -167,6 +208,108 @@ func (state *BuildState) addPending(label BuildLabel, t TaskType) {
 	state.pendingTasks.Put(pendingTask{Label: label, Type: t})
 }
 
+// AdmitTest checks that the given test's setup and teardown targets are built and acquires the
+// resources needed to run it. If it can't run yet it returns false and the test is put back on
+// the queue once whatever it's waiting for is ready; in that case the caller should drop the
+// task without marking it as done.
+func (state *BuildState) AdmitTest(label BuildLabel) bool {
+	target := state.Graph.TargetOrDie(label)
+	state.waitingMutex.Lock()
+	defer state.waitingMutex.Unlock()
+	if state.failTestIfTargetsFailed(target) {
+		state.TaskDone()
+		return false
+	} else if !state.testTargetsBuilt(target) {
+		log.Debug("Deferring %s until its setup & teardown targets are built", label)
+		state.waitingForTargets = append(state.waitingForTargets, label)
+		// This one isn't pending any more; if they never get built (e.g. because one of their
+		// dependencies failed) we mustn't wait for it forever.
+		state.TaskDone()
+		return false
+	}
+	if state.Resources.TryAcquire(target.Resources) {
+		return true
+	}
+	log.Debug("Deferring %s until its resources are available", label)
+	state.waitingTests = append(state.waitingTests, label)
+	return false
+}
+
+// ReleaseTest releases the resources acquired by AdmitTest once the test has finished, and
+// requeues any tests that were waiting for them.
+func (state *BuildState) ReleaseTest(label BuildLabel) {
+	target := state.Graph.TargetOrDie(label)
+	if len(target.Resources) == 0 {
+		return // Nothing was released so nothing else can start now.
+	}
+	state.waitingMutex.Lock()
+	defer state.waitingMutex.Unlock()
+	state.Resources.Release(target.Resources)
+	// They're still counted as pending, so we put them straight back on the queue.
+	for _, waiting := range state.waitingTests {
+		state.pendingTasks.Put(pendingTask{Label: waiting, Type: Test})
+	}
+	state.waitingTests = nil
+}
+
+// RequeueWaitingTests re-adds any tests that were waiting for their setup or teardown targets
+// to be built. It should be called whenever a target finishes building, successfully or not.
+// Tests whose setup or teardown targets can't be built any more are failed instead.
+func (state *BuildState) RequeueWaitingTests() {
+	state.waitingMutex.Lock()
+	defer state.waitingMutex.Unlock()
+	for _, waiting := range state.waitingForTargets {
+		if !state.failTestIfTargetsFailed(state.Graph.TargetOrDie(waiting)) {
+			state.addPending(waiting, Test)
+		}
+	}
+	state.waitingForTargets = nil
+}
+
+// failTestIfTargetsFailed logs a test as failed if its setup or teardown target failed to build,
+// or never will because one of its dependencies failed. It returns true if it did so.
+func (state *BuildState) failTestIfTargetsFailed(target *BuildTarget) bool {
+	for _, label := range []*BuildLabel{target.TestSetup, target.TestTeardown} {
+		if label != nil {
+			if t := state.Graph.Target(*label); t != nil && failedToBuild(t, map[*BuildTarget]bool{}) {
+				state.LogBuildError(0, target.Label, TargetTestFailed, fmt.Errorf("Failed to build %s", t.Label), "Can't run test, %s failed to build", t.Label)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// failedToBuild returns true if the given target failed to build, or can't be built because
+// something it depends on failed.
+func failedToBuild(target *BuildTarget, done map[*BuildTarget]bool) bool {
+	if state := target.State(); state == Failed {
+		return true
+	} else if state >= Built || done[target] {
+		return false
+	}
+	done[target] = true
+	for _, dep := range target.Dependencies() {
+		if failedToBuild(dep, done) {
+			return true
+		}
+	}
+	return false
+}
+
+// testTargetsBuilt returns true if the setup and teardown targets of a test (if any) have
+// finished building. Ones that failed count too, although AdmitTest fails the test before this.
+func (state *BuildState) testTargetsBuilt(target *BuildTarget) bool {
+	for _, label := range []*BuildLabel{target.TestSetup, target.TestTeardown} {
+		if label != nil {
+			if t := state.Graph.Target(*label); t == nil || t.State() < Built {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // TaskDone indicates that a single task is finished. Should be called after one is finished with
 // a task returned from NextTask().
 func (state *BuildState) TaskDone() {
@@ -262,11 +405,27 @@ func (state *BuildState) LogTestResult(tid int, label BuildLabel, status BuildRe
 		Description: fmt.Sprintf(format, args...),
 		Tests:       *results,
 	}
+	state.recordTestStatus(label, status)
 	state.mutex.Lock()
 	defer state.mutex.Unlock()
 	state.Coverage.Aggregate(coverage)
 }
 
+// LogTestRun logs the start or end of a single run of a test (1-indexed, out of numRuns).
+func (state *BuildState) LogTestRun(tid int, label BuildLabel, run, numRuns int, finished, passed bool, description string) {
+	state.Results <- &BuildResult{
+		ThreadId:    tid,
+		Time:        time.Now(),
+		Label:       label,
+		Status:      TargetTesting,
+		Description: description,
+		Run:         run,
+		NumRuns:     numRuns,
+		RunFinished: finished,
+		RunPassed:   passed,
+	}
+}
+
 func (state *BuildState) LogBuildError(tid int, label BuildLabel, status BuildResultStatus, err error, format string, args ...interface{}) {
 	state.Results <- &BuildResult{
 		ThreadId:    tid,
@@ -276,6 +435,18 @@ func (state *BuildState) LogBuildError(tid int, label BuildLabel, status BuildRe
 		Err:         err,
 		Description: fmt.Sprintf(format, args...),
 	}
+	state.recordTestStatus(label, status)
+}
+
+// recordTestStatus records the final status of a test on its target, so things summarising
+// the results later don't have to infer it from the individual test cases.
+func (state *BuildState) recordTestStatus(label BuildLabel, status BuildResultStatus) {
+	if status != TargetTested && status != TargetTestFailed || state.Graph == nil {
+		return
+	}
+	if target := state.Graph.Target(label); target != nil {
+		target.Results.Status = status
+	}
 }
 
 func (state *BuildState) NumActive() int {
@@ -362,6 +533,10 @@ type BuildResult struct {
 	Description string
 	// Test results
 	Tests TestResults
+	// For individual runs of a test, which run this is (1-indexed) and how many there are in total.
+	Run, NumRuns int
+	// True if this marks the end of an individual test run, in which case RunPassed indicates its outcome.
+	RunFinished, RunPassed bool
 }
 
 func NewBuildError(tid int, label BuildLabel, status BuildResultStatus, err error, description string) BuildResult {
@@ -103,7 +103,7 @@ func TestComparePendingTasks(t *testing.T) {
 	assertEqualPriority(Stop, Stop)
 }
 
-func addTarget(state *BuildState, name string, labels ...string) {
+func addTarget(state *BuildState, name string, labels ...string) *BuildTarget {
 	target := NewBuildTarget(ParseBuildLabel(name, ""))
 	target.Labels = labels
 	target.IsTest = strings.HasSuffix(name, "_test")
@@ -114,4 +114,67 @@ func addTarget(state *BuildState, name string, labels ...string) {
 	}
 	pkg.Targets[target.Label.Name] = target
 	state.Graph.AddTarget(target)
+	return target
+}
+
+func TestAdmitTestDefersUntilResourcesAreReleased(t *testing.T) {
+	state := NewBuildState(1, nil, 4, DefaultConfiguration())
+	state.Resources = NewResourcePool(map[string]int{"gpu": 1})
+	target1 := addTarget(state, "//src/core:gpu_test1")
+	target1.AddResource("gpu", 1)
+	target2 := addTarget(state, "//src/core:gpu_test2")
+	target2.AddResource("gpu", 1)
+	target3 := addTarget(state, "//src/core:cpu_test")
+
+	assert.True(t, state.AdmitTest(target1.Label))
+	assert.False(t, state.AdmitTest(target2.Label), "Should have to wait for the GPU")
+	assert.True(t, state.AdmitTest(target3.Label), "Doesn't need anything so shouldn't wait")
+	state.ReleaseTest(target3.Label)
+	assert.Equal(t, 0, state.pendingTasks.Len(), "Nothing should be requeued until the GPU is released")
+
+	state.ReleaseTest(target1.Label)
+	label, _, taskType := state.NextTask()
+	assert.Equal(t, target2.Label, label)
+	assert.EqualValues(t, Test, taskType)
+	assert.True(t, state.AdmitTest(target2.Label))
+}
+
+func TestAdmitTestWaitsForSetupTargets(t *testing.T) {
+	state := NewBuildState(1, nil, 4, DefaultConfiguration())
+	setup := addTarget(state, "//src/core:setup")
+	target := addTarget(state, "//src/core:setup_test")
+	target.TestSetup = &setup.Label
+	state.addPending(target.Label, Test)
+	state.NextTask()
+
+	assert.False(t, state.AdmitTest(target.Label), "Setup isn't built yet")
+	setup.SetState(Built)
+	state.RequeueWaitingTests()
+	label, _, taskType := state.NextTask()
+	assert.Equal(t, target.Label, label)
+	assert.EqualValues(t, Test, taskType)
+	assert.True(t, state.AdmitTest(target.Label))
+}
+
+func TestAdmitTestFailsIfSetupTargetCantBeBuilt(t *testing.T) {
+	state := NewBuildState(1, nil, 4, DefaultConfiguration())
+	dep := addTarget(state, "//src/core:setup_dep")
+	setup := addTarget(state, "//src/core:failed_setup")
+	setup.AddDependency(dep.Label)
+	state.Graph.AddDependency(setup.Label, dep.Label)
+	target := addTarget(state, "//src/core:failed_setup_test")
+	target.TestSetup = &setup.Label
+	state.addPending(target.Label, Test)
+	state.NextTask()
+
+	assert.False(t, state.AdmitTest(target.Label), "Setup isn't built yet")
+	// The setup target is never going to get built now.
+	dep.SetState(Failed)
+	state.RequeueWaitingTests()
+	assert.Equal(t, 0, state.pendingTasks.Len(), "Test shouldn't be requeued")
+	result := <-state.Results
+	assert.Equal(t, target.Label, result.Label)
+	assert.EqualValues(t, TargetTestFailed, result.Status)
+	assert.Contains(t, result.Err.Error(), "//src/core:failed_setup")
+	assert.EqualValues(t, TargetTestFailed, target.Results.Status)
 }
@@ -16,10 +16,19 @@ type TestResults struct {
 	Flakes           int // Number of failed attempts to run the test
 	Failures         []TestFailure
 	Passes           []string
-	Output           string  // Stdout / stderr from the test.
-	Cached           bool    // True if the test results were retrieved from cache
-	TimedOut         bool    // True if the test failed because we timed it out.
-	Duration         float64 // Length of time this test took, in seconds.
+	Properties       []TestProperty // Arbitrary properties reported by the test (eg. git revision, random seed)
+	Output           string         // Stdout / stderr from the test.
+	Cached           bool           // True if the test results were retrieved from cache
+	TimedOut         bool           // True if the test failed because we timed it out.
+	Duration         float64        // Length of time this test took, in seconds.
+	RunDurations     []float64      // Length of time each individual run of the test took, in seconds.
+	SuccessfulRuns   int            // Number of those runs that succeeded.
+	RunPassed        []bool         // Whether each of those runs succeeded, in the same order as RunDurations.
+	ExecDurations    []float64      // Length of time the test took on each run, including any sandbox or container but not setting up its directory.
+	Slow             bool           // True if the test took longer than its expected_duration.
+	// The final status the test was logged with (TargetTested or TargetTestFailed).
+	// A test can fail without any individual test cases failing, e.g. if it timed out.
+	Status BuildResultStatus
 }
 
 // TestFailure represents information about a test failure.
@@ -31,6 +40,13 @@ type TestFailure struct {
 	Stderr    string // Standard error during test
 }
 
+// TestProperty represents a single property reported by a test, for example in a JUnit XML <properties> block.
+type TestProperty struct {
+	Name  string // Name of the property
+	Value string // Its value
+	Run   int    // Index of the run that reported it, if the test was run more than once (1-based, 0 if not)
+}
+
 // Aggregates the given results into this one.
 func (results *TestResults) Aggregate(r *TestResults) {
 	results.NumTests += r.NumTests
@@ -41,8 +57,9 @@ func (results *TestResults) Aggregate(r *TestResults) {
 	results.Flakes += r.Flakes
 	results.Failures = append(results.Failures, r.Failures...)
 	results.Passes = append(results.Passes, r.Passes...)
+	results.Properties = append(results.Properties, r.Properties...)
 	results.Duration += r.Duration
-	// Output can't really be aggregated sensibly.
+	// Output and individual runs can't really be aggregated sensibly.
 }
 
 // A LineCoverage represents a single line of coverage, which can be in one of several states.
@@ -74,9 +91,16 @@ func (coverage *TestCoverage) Aggregate(cov *TestCoverage) {
 		coverage.Files = map[string][]LineCoverage{}
 	}
 
-	// Assume that tests are independent (will currently always be the case).
+	// Tests are independent of one another, but we may see several runs of the same one
+	// (e.g. when it's flaky); a line counts as covered if any of them covered it.
 	for label, c := range cov.Tests {
-		coverage.Tests[label] = c
+		if existing, present := coverage.Tests[label]; present {
+			for filename, lines := range c {
+				existing[filename] = MergeCoverageLines(existing[filename], lines)
+			}
+		} else {
+			coverage.Tests[label] = c
+		}
 	}
 	// Files are more complex since multiple tests can cover the same file.
 	// We take the best result for each line from each test.
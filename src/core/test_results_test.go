@@ -55,3 +55,15 @@ func TestMergeCoverageLines8(t *testing.T) {
 	coverage := MergeCoverageLines(empty, empty)
 	assert.Equal(t, empty, coverage)
 }
+
+func TestAggregateCoverageFromSameTest(t *testing.T) {
+	label := ParseBuildLabel("//src/core:test_results_test", "")
+	run1 := NewTestCoverage()
+	run1.Tests[label] = map[string][]LineCoverage{"a.go": {Covered, Uncovered}}
+	run2 := NewTestCoverage()
+	run2.Tests[label] = map[string][]LineCoverage{"a.go": {Uncovered, Covered}}
+	var coverage TestCoverage
+	coverage.Aggregate(&run1)
+	coverage.Aggregate(&run2)
+	assert.Equal(t, []LineCoverage{Covered, Covered}, coverage.Tests[label]["a.go"])
+}
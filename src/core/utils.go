@@ -14,6 +14,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -39,6 +40,10 @@ var usingBazelWorkspace bool
 // DirPermissions are the default permission bits we apply to directories.
 const DirPermissions = os.ModeDir | 0775
 
+// SandboxAuditFile is the file in a target's temp directory that its file accesses are recorded in
+// while auditing the sandbox.
+const SandboxAuditFile = ".sandbox_audit"
+
 // FindRepoRoot returns the root directory of the current repo and sets the initial working dir.
 // It returns true if the repo root was found.
 func FindRepoRoot() bool {
@@ -265,10 +270,20 @@ func logProgress(label BuildLabel, ctx context.Context) {
 }
 
 // ExecWithTimeout runs an external command with a timeout.
-// If the command times out the returned error will be a context.DeadlineExceeded error.
+// If the command times out the returned error will satisfy IsTimeout.
 // If showOutput is true then output will be printed to stderr as well as returned.
 // It returns the stdout only, combined stdout and stderr and any error that occurred.
 func ExecWithTimeout(target *BuildTarget, dir string, env []string, timeout time.Duration, defaultTimeout cli.Duration, showOutput bool, argv []string) ([]byte, []byte, error) {
+	var stream io.Writer
+	if showOutput {
+		stream = os.Stderr
+	}
+	return ExecWithTimeoutStreaming(target, dir, env, timeout, defaultTimeout, stream, argv)
+}
+
+// ExecWithTimeoutStreaming is like ExecWithTimeout but copies the combined output of the command
+// to the given writer as it runs, if it's not nil.
+func ExecWithTimeoutStreaming(target *BuildTarget, dir string, env []string, timeout time.Duration, defaultTimeout cli.Duration, stream io.Writer, argv []string) ([]byte, []byte, error) {
 	if timeout == 0 {
 		if defaultTimeout == 0 {
 			timeout = 10 * time.Minute
@@ -284,9 +299,9 @@ func ExecWithTimeout(target *BuildTarget, dir string, env []string, timeout time
 
 	var out bytes.Buffer
 	var outerr safeBuffer
-	if showOutput {
-		cmd.Stdout = io.MultiWriter(os.Stderr, &out, &outerr)
-		cmd.Stderr = io.MultiWriter(os.Stderr, &outerr)
+	if stream != nil {
+		cmd.Stdout = io.MultiWriter(stream, &out, &outerr)
+		cmd.Stderr = io.MultiWriter(stream, &outerr)
 	} else {
 		cmd.Stdout = io.MultiWriter(&out, &outerr)
 		cmd.Stderr = &outerr
@@ -314,11 +329,24 @@ func ExecWithTimeout(target *BuildTarget, dir string, env []string, timeout time
 		time.Sleep(10 * time.Millisecond)
 		// Send a more forceful signal.
 		cmd.Process.Kill()
-		err = fmt.Errorf("Timeout exceeded: %s", outerr.String())
+		err = timeoutError(outerr.String())
 	}
 	return out.Bytes(), outerr.Bytes(), err
 }
 
+// A timeoutError is returned when we kill a command for running past its timeout.
+type timeoutError string
+
+func (err timeoutError) Error() string {
+	return "Timeout exceeded: " + string(err)
+}
+
+// IsTimeout returns true if the given error is from a command that was killed for running past its timeout.
+func IsTimeout(err error) bool {
+	_, ok := err.(timeoutError)
+	return ok
+}
+
 // runCommand runs a command and signals on the given channel when it's done.
 func runCommand(cmd *exec.Cmd, ch chan error) {
 	ch <- cmd.Wait()
@@ -328,6 +356,16 @@ func runCommand(cmd *exec.Cmd, ch chan error) {
 // Other arguments are as ExecWithTimeout.
 // Note that the command is deliberately a single string.
 func ExecWithTimeoutShell(target *BuildTarget, dir string, env []string, timeout time.Duration, defaultTimeout cli.Duration, showOutput bool, cmd string, sandbox bool) ([]byte, []byte, error) {
+	var stream io.Writer
+	if showOutput {
+		stream = os.Stderr
+	}
+	return ExecWithTimeoutShellStreaming(target, dir, env, timeout, defaultTimeout, stream, cmd, sandbox)
+}
+
+// ExecWithTimeoutShellStreaming runs an external command within a Bash shell, copying its output
+// to the given writer as it runs. Other arguments are as ExecWithTimeoutStreaming.
+func ExecWithTimeoutShellStreaming(target *BuildTarget, dir string, env []string, timeout time.Duration, defaultTimeout cli.Duration, stream io.Writer, cmd string, sandbox bool) ([]byte, []byte, error) {
 	c := append([]string{"bash", "-u", "-o", "pipefail", "-c"}, cmd)
 	// Runtime check is a little ugly, but we know this only works on Linux right now.
 	if sandbox && runtime.GOOS == "linux" {
@@ -335,9 +373,50 @@ func ExecWithTimeoutShell(target *BuildTarget, dir string, env []string, timeout
 		if err != nil {
 			return nil, nil, err
 		}
+		// Only build actions get audited, which we can tell since they run in the target's temp dir.
+		if State != nil && State.AuditSandbox && target != nil && dir == target.TmpDir() {
+			strace, err := LookPath("strace", State.Config.Build.Path)
+			if err != nil {
+				return nil, nil, err
+			}
+			// This goes inside the sandbox since it won't be able to trace it once it's dropped root.
+			c = append([]string{strace, "-f", "-q", "-e", "trace=file", "-o", SandboxAuditFile}, c...)
+		}
 		c = append([]string{tool}, c...)
 	}
-	return ExecWithTimeout(target, dir, env, timeout, defaultTimeout, showOutput, c)
+	if State != nil && target != nil {
+		c = append(priorityCommand(State, target), c...)
+	}
+	return ExecWithTimeoutStreaming(target, dir, env, timeout, defaultTimeout, stream, c)
+}
+
+// priorityCommand returns a command prefix that runs a target's actions at its niceness, which is
+// the greater of its priority attribute and --nice. Where ionice is available its IO priority is
+// lowered to match; otherwise we make do with just the CPU. We change the priority by running
+// these rather than calling setpriority ourselves so it can't leak back into this process.
+func priorityCommand(state *BuildState, target *BuildTarget) []string {
+	nice := target.Priority
+	if state.Nice > nice {
+		nice = state.Nice
+	}
+	if nice <= 0 {
+		return nil
+	}
+	tool, err := LookPath("nice", state.Config.Build.Path)
+	if err != nil {
+		log.Warning("Can't run %s at lower priority: %s", target.Label, err)
+		return nil
+	}
+	ret := []string{tool, "-n", strconv.Itoa(nice)}
+	if runtime.GOOS == "linux" {
+		if tool, err := LookPath("ionice", state.Config.Build.Path); err == nil {
+			// This is how the kernel derives a best-effort IO priority from niceness when none is set.
+			ret = append(ret, tool, "-c", "2", "-n", strconv.Itoa((nice+20)/5))
+		} else {
+			log.Debug("ionice not available, only lowering CPU priority of %s", target.Label)
+		}
+	}
+	return ret
 }
 
 // ExecWithTimeoutSimple runs an external command with a timeout.
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"io/ioutil"
 	"os"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
@@ -164,6 +165,7 @@ func TestExecWithTimeout(t *testing.T) {
 func TestExecWithTimeoutFailure(t *testing.T) {
 	out, err := ExecWithTimeoutSimple(tenSeconds, "false")
 	assert.Error(t, err)
+	assert.False(t, IsTimeout(err))
 	assert.Equal(t, 0, len(out))
 }
 
@@ -171,6 +173,7 @@ func TestExecWithTimeoutDeadline(t *testing.T) {
 	out, err := ExecWithTimeoutSimple(cli.Duration(1*time.Nanosecond), "sleep", "10")
 	assert.Error(t, err)
 	assert.True(t, strings.HasPrefix(err.Error(), "Timeout exceeded"))
+	assert.True(t, IsTimeout(err))
 	assert.Equal(t, 0, len(out))
 }
 
@@ -224,6 +227,30 @@ func buildGraph() *BuildGraph {
 	return graph
 }
 
+func TestPriorityCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priority_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	state := NewBuildState(1, nil, 4, DefaultConfiguration())
+	state.Config.Build.Path = []string{dir}
+	target := NewBuildTarget(ParseBuildLabel("//src/core:priority", ""))
+	assert.Nil(t, priorityCommand(state, target))
+	// Without nice on the path there's nothing we can do.
+	target.Priority = 10
+	assert.Nil(t, priorityCommand(state, target))
+	assert.NoError(t, ioutil.WriteFile(dir+"/nice", nil, 0755))
+	assert.Equal(t, []string{dir + "/nice", "-n", "10"}, priorityCommand(state, target))
+	// --nice applies to everything, but doesn't override a higher priority attribute.
+	state.Nice = 19
+	assert.Equal(t, []string{dir + "/nice", "-n", "19"}, priorityCommand(state, target))
+	state.Nice = 5
+	assert.Equal(t, []string{dir + "/nice", "-n", "10"}, priorityCommand(state, target))
+	if runtime.GOOS == "linux" {
+		assert.NoError(t, ioutil.WriteFile(dir+"/ionice", nil, 0755))
+		assert.Equal(t, []string{dir + "/nice", "-n", "10", dir + "/ionice", "-c", "2", "-n", "6"}, priorityCommand(state, target))
+	}
+}
+
 // makeTarget creates a new build target for us.
 func makeTarget(graph *BuildGraph, label string, deps ...string) *BuildTarget {
 	target := NewBuildTarget(ParseBuildLabel(label, ""))
@@ -0,0 +1,161 @@
+// Streams build events as newline-delimited JSON over a Unix domain socket,
+// which is useful for editors and other tools that want to follow the build live.
+
+package output
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"core"
+)
+
+// How long we'll wait for a consumer to accept an event before giving up on it.
+const eventWriteTimeout = 1 * time.Second
+
+// An event is the JSON representation of a single event sent to consumers.
+type event struct {
+	// One of started, finished, test_run_started, test_run_finished or done.
+	Type string `json:"type"`
+	// Which phase the event refers to (parse, build or test).
+	Category    string    `json:"category,omitempty"`
+	Label       string    `json:"label,omitempty"`
+	Time        time.Time `json:"time"`
+	Description string    `json:"description,omitempty"`
+	Cached      bool      `json:"cached,omitempty"`
+	Failed      bool      `json:"failed,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Run         int       `json:"run,omitempty"`
+	NumRuns     int       `json:"num_runs,omitempty"`
+	// Only set for the final done event.
+	Success bool `json:"success,omitempty"`
+}
+
+// An eventStream accepts connections on a socket and sends events to all of them.
+// A nil eventStream is valid and does nothing.
+type eventStream struct {
+	listener net.Listener
+	conns    []net.Conn
+	mutex    sync.Mutex
+}
+
+// newEventStream opens a socket at the given path to send events on.
+// It returns nil if the path is empty or the socket can't be opened.
+func newEventStream(socketPath string) *eventStream {
+	if socketPath == "" {
+		return nil
+	}
+	os.Remove(socketPath) // Clean up anything left over from a previous run.
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		log.Errorf("Failed to open event socket %s: %s", socketPath, err)
+		return nil
+	}
+	stream := &eventStream{listener: listener}
+	go stream.accept()
+	return stream
+}
+
+func (stream *eventStream) accept() {
+	for {
+		conn, err := stream.listener.Accept()
+		if err != nil {
+			return // Listener has been closed.
+		}
+		log.Debug("Event consumer connected")
+		stream.mutex.Lock()
+		stream.conns = append(stream.conns, conn)
+		stream.mutex.Unlock()
+	}
+}
+
+// AddResult sends an event for a build result. previous is the previous state of the thread that generated it.
+func (stream *eventStream) AddResult(result *core.BuildResult, previous buildingTargetData, active bool) {
+	if stream == nil {
+		return
+	}
+	e := event{
+		Label:       result.Label.String(),
+		Time:        result.Time,
+		Category:    strings.ToLower(result.Status.Category()),
+		Description: result.Description,
+		Cached:      result.Status == core.TargetCached || result.Tests.Cached,
+		Failed:      result.Status == core.ParseFailed || result.Status == core.TargetBuildFailed || result.Status == core.TargetTestFailed,
+	}
+	if result.Err != nil {
+		e.Error = result.Err.Error()
+	}
+	if result.Run > 0 {
+		e.Run = result.Run
+		e.NumRuns = result.NumRuns
+		if result.RunFinished {
+			e.Type = "test_run_finished"
+			e.Failed = !result.RunPassed
+		} else {
+			e.Type = "test_run_started"
+		}
+	} else if !active {
+		e.Type = "finished"
+	} else if !previous.Active || previous.Label != result.Label {
+		e.Type = "started"
+	} else {
+		return // Just an update to the description, nothing interesting to report.
+	}
+	stream.send(e)
+}
+
+// Done sends the final event and closes the stream.
+func (stream *eventStream) Done(success bool) {
+	if stream == nil {
+		return
+	}
+	stream.send(event{Type: "done", Time: time.Now(), Success: success})
+	stream.listener.Close()
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	for _, conn := range stream.conns {
+		conn.Close()
+	}
+	stream.conns = nil
+}
+
+// send sends a single event to all consumers. Any that fail to receive it are disconnected;
+// we never want a misbehaving consumer to interrupt the build.
+func (stream *eventStream) send(e event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("Failed to serialise event: %s", err)
+		return
+	}
+	data = append(data, '\n')
+	// Don't hold the lock while writing, so a slow consumer doesn't hold up anyone else.
+	stream.mutex.Lock()
+	conns := make([]net.Conn, len(stream.conns))
+	copy(conns, stream.conns)
+	stream.mutex.Unlock()
+	failed := map[net.Conn]bool{}
+	for _, conn := range conns {
+		conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if _, err := conn.Write(data); err != nil {
+			log.Debug("Event consumer disconnected: %s", err)
+			conn.Close()
+			failed[conn] = true
+		}
+	}
+	if len(failed) > 0 {
+		// New consumers may have connected in the meantime, so only remove the ones that failed.
+		stream.mutex.Lock()
+		defer stream.mutex.Unlock()
+		remaining := stream.conns[:0]
+		for _, conn := range stream.conns {
+			if !failed[conn] {
+				remaining = append(remaining, conn)
+			}
+		}
+		stream.conns = remaining
+	}
+}
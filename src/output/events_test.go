@@ -0,0 +1,95 @@
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestEventStream(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "events_test")
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "events.sock")
+	stream := newEventStream(socket)
+	assert.NotNil(t, stream)
+	conn, err := net.Dial("unix", socket)
+	assert.NoError(t, err)
+	defer conn.Close()
+	waitForConsumers(stream, 1)
+
+	label := core.ParseBuildLabel("//src/output:events_test", "")
+	building := buildingTargetData{Label: label, Active: true}
+	idle := buildingTargetData{Label: label}
+	stream.AddResult(&core.BuildResult{Label: label, Status: core.TargetBuilding, Description: "Building..."}, idle, true)
+	stream.AddResult(&core.BuildResult{Label: label, Status: core.TargetBuilding, Description: "Storing..."}, building, true)
+	stream.AddResult(&core.BuildResult{Label: label, Status: core.TargetCached}, building, false)
+	stream.AddResult(&core.BuildResult{Label: label, Status: core.TargetTesting, Run: 1, NumRuns: 2}, building, true)
+	stream.AddResult(&core.BuildResult{Label: label, Status: core.TargetTesting, Run: 1, NumRuns: 2, RunFinished: true}, building, true)
+	stream.Done(true)
+
+	events := []event{}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		e := event{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, e)
+	}
+	assert.Equal(t, 5, len(events))
+	assert.Equal(t, "started", events[0].Type)
+	assert.Equal(t, "build", events[0].Category)
+	assert.Equal(t, "//src/output:events_test", events[0].Label)
+	assert.Equal(t, "finished", events[1].Type)
+	assert.True(t, events[1].Cached)
+	assert.Equal(t, "test_run_started", events[2].Type)
+	assert.Equal(t, 2, events[2].NumRuns)
+	assert.Equal(t, "test_run_finished", events[3].Type)
+	assert.True(t, events[3].Failed)
+	assert.Equal(t, "done", events[4].Type)
+	assert.True(t, events[4].Success)
+}
+
+func TestEventStreamConsumerDisconnects(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "events_test")
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "events.sock")
+	stream := newEventStream(socket)
+	conn, err := net.Dial("unix", socket)
+	assert.NoError(t, err)
+	waitForConsumers(stream, 1)
+	conn.Close()
+	label := core.ParseBuildLabel("//src/output:events_test", "")
+	for i := 0; i < 10; i++ {
+		stream.AddResult(&core.BuildResult{Label: label, Status: core.TargetBuilt}, buildingTargetData{}, false)
+	}
+	waitForConsumers(stream, 0)
+	stream.Done(true)
+}
+
+func TestNilEventStream(t *testing.T) {
+	stream := newEventStream("")
+	assert.Nil(t, stream)
+	stream.AddResult(&core.BuildResult{}, buildingTargetData{}, false)
+	stream.Done(true)
+}
+
+// waitForConsumers waits until the stream has the given number of consumers.
+func waitForConsumers(stream *eventStream, n int) {
+	for i := 0; i < 100; i++ {
+		stream.mutex.Lock()
+		num := len(stream.conns)
+		stream.mutex.Unlock()
+		if num == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -50,7 +51,7 @@ type buildingTargetData struct {
 	Colour      string
 }
 
-func MonitorState(state *core.BuildState, numThreads int, plainOutput, keepGoing, shouldBuild, shouldTest, shouldRun, showStatus bool, traceFile string) bool {
+func MonitorState(state *core.BuildState, numThreads int, plainOutput, keepGoing, shouldBuild, shouldTest, shouldRun, showStatus bool, traceFile, eventSocket string) bool {
 	failedTargetMap := map[core.BuildLabel]error{}
 	buildingTargets := make([]buildingTarget, numThreads, numThreads)
 
@@ -62,9 +63,11 @@ func MonitorState(state *core.BuildState, numThreads int, plainOutput, keepGoing
 	aggregatedResults := core.TestResults{}
 	failedTargets := []core.BuildLabel{}
 	failedNonTests := []core.BuildLabel{}
+	events := newEventStream(eventSocket)
 	for result := range state.Results {
-		processResult(state, result, buildingTargets, &aggregatedResults, plainOutput, keepGoing, &failedTargets, &failedNonTests, failedTargetMap, traceFile != "")
+		processResult(state, result, buildingTargets, &aggregatedResults, plainOutput, keepGoing, &failedTargets, &failedNonTests, failedTargetMap, traceFile != "", events)
 	}
+	events.Done(len(failedTargetMap) == 0)
 	if !plainOutput {
 		stop <- struct{}{}
 		<-displayDone
@@ -75,11 +78,19 @@ func MonitorState(state *core.BuildState, numThreads int, plainOutput, keepGoing
 	duration := time.Since(startTime).Seconds()
 	if len(failedNonTests) > 0 { // Something failed in the build step.
 		if state.Verbosity > 0 {
-			printFailedBuildResults(failedNonTests, failedTargetMap, duration)
+			printFailedBuildResults(failedNonTests, failedTargetMap, unbuiltTargets(state), duration)
 		}
-		// Die immediately and unsuccessfully, this avoids awkward interactions with
-		// --failing_tests_ok later on.
-		os.Exit(-1)
+		if !keepGoing {
+			// Die immediately and unsuccessfully, this avoids awkward interactions with
+			// --failing_tests_ok later on.
+			os.Exit(-1)
+		}
+		// Otherwise we carry on and report the results of any tests that did get run.
+		// The caller is responsible for not letting --failing_tests_ok override this.
+		if state.Verbosity > 0 && shouldTest {
+			printTestResults(state, aggregatedResults, failedTargets, duration)
+		}
+		return false
 	}
 	// Check all the targets we wanted to build actually have been built.
 	for _, label := range state.ExpandOriginalTargets() {
@@ -109,16 +120,18 @@ func MonitorState(state *core.BuildState, numThreads int, plainOutput, keepGoing
 }
 
 func processResult(state *core.BuildState, result *core.BuildResult, buildingTargets []buildingTarget, aggregatedResults *core.TestResults, plainOutput bool,
-	keepGoing bool, failedTargets, failedNonTests *[]core.BuildLabel, failedTargetMap map[core.BuildLabel]error, shouldTrace bool) {
+	keepGoing bool, failedTargets, failedNonTests *[]core.BuildLabel, failedTargetMap map[core.BuildLabel]error, shouldTrace bool, events *eventStream) {
 	label := result.Label
 	active := result.Status == core.PackageParsing || result.Status == core.TargetBuilding || result.Status == core.TargetTesting
 	failed := result.Status == core.ParseFailed || result.Status == core.TargetBuildFailed || result.Status == core.TargetTestFailed
 	cached := result.Status == core.TargetCached || result.Tests.Cached
 	stopped := result.Status == core.TargetBuildStopped
 	if shouldTrace {
-		addTrace(result, buildingTargets[result.ThreadId].Label, active)
+		addTrace(state, result, buildingTargets[result.ThreadId].Label, active)
 	}
-	if failed && result.Tests.NumTests == 0 && result.Tests.Failed == 0 {
+	events.AddResult(result, buildingTargets[result.ThreadId].buildingTargetData, active)
+	target := state.Graph.Target(label)
+	if failed && target != nil && target.IsTest && result.Tests.NumTests == 0 && result.Tests.Failed == 0 {
 		result.Tests.NumTests = 1
 		result.Tests.Failed = 1 // Ensure there's one test failure when there're no results to parse.
 	}
@@ -126,7 +139,6 @@ func processResult(state *core.BuildState, result *core.BuildResult, buildingTar
 	if buildingTargets[result.ThreadId].Active && !active {
 		aggregatedResults.Aggregate(&result.Tests)
 	}
-	target := state.Graph.Target(label)
 	updateTarget(state, plainOutput, &buildingTargets[result.ThreadId], label, active, failed, cached, result.Description, result.Err, targetColour(target))
 	if failed {
 		failedTargetMap[label] = result.Err
@@ -152,11 +164,18 @@ func processResult(state *core.BuildState, result *core.BuildResult, buildingTar
 
 func printTestResults(state *core.BuildState, aggregatedResults core.TestResults, failedTargets []core.BuildLabel, duration float64) {
 	if len(failedTargets) > 0 {
-		for _, failed := range failedTargets {
+		// These arrive in the order they finished in; sort them so the summary is the same every time.
+		for _, failed := range sortedLabels(failedTargets) {
 			target := state.Graph.TargetOrDie(failed)
-			if len(target.Results.Failures) == 0 {
-				if target.Results.TimedOut {
+			if !target.IsTest {
+				continue // Will have been reported with the other build failures.
+			} else if len(target.Results.Failures) == 0 {
+				if target.State() == core.Failed {
+					printf("${WHITE_ON_RED}Fail:${RED_NO_BG} %s ${WHITE_ON_RED}Failed to build${RESET}\n", target.Label)
+				} else if target.Results.TimedOut {
 					printf("${WHITE_ON_RED}Fail:${RED_NO_BG} %s ${WHITE_ON_RED}Timed out${RESET}\n", target.Label)
+				} else if target.Results.Slow {
+					printf("${WHITE_ON_RED}Fail:${RED_NO_BG} %s ${WHITE_ON_RED}Took longer than its expected duration of %s${RESET}\n", target.Label, target.ExpectedDuration)
 				} else {
 					printf("${WHITE_ON_RED}Fail:${RED_NO_BG} %s ${WHITE_ON_RED}Failed to run test${RESET}\n", target.Label)
 				}
@@ -182,6 +201,11 @@ func printTestResults(state *core.BuildState, aggregatedResults core.TestResults
 			}
 		}
 	}
+	for _, label := range unbuiltTargets(state) {
+		if target := state.Graph.TargetOrDie(label); target.IsTest {
+			printf("${WHITE_ON_RED}Fail:${RED_NO_BG} %s ${WHITE_ON_RED}Not run because a dependency failed${RESET}\n", label)
+		}
+	}
 	// Print individual test results
 	i := 0
 	for _, target := range state.Graph.AllTargets() {
@@ -191,6 +215,12 @@ func printTestResults(state *core.BuildState, aggregatedResults core.TestResults
 			} else {
 				printf("${GREEN}%s${RESET} %s\n", target.Label, testResultMessage(target.Results, failedTargets))
 			}
+			if len(target.Results.RunDurations) > 1 && (state.Verbosity > 2 || target.Results.Flakes > 0 || target.Results.Failed > 0) {
+				printRunDetails(target.Results)
+			}
+			if target.Results.Slow {
+				printf("    ${BOLD_YELLOW}Slow: took longer than its expected duration of %s${RESET}\n", target.ExpectedDuration)
+			}
 			if state.ShowTestOutput && target.Results.Output != "" {
 				printf("Test output:\n%s\n", target.Results.Output)
 			}
@@ -202,6 +232,27 @@ func printTestResults(state *core.BuildState, aggregatedResults core.TestResults
 		pluralise(i, "test target", "test targets"), testResultMessage(aggregatedResults, failedTargets), duration))
 }
 
+// printRunDetails prints the outcome of each run of a test that was run more than once.
+func printRunDetails(results core.TestResults) {
+	for i, duration := range results.RunDurations {
+		if i >= len(results.RunPassed) {
+			printf("    Run %d of %d took %0.2fs\n", i+1, len(results.RunDurations), duration)
+		} else if results.RunPassed[i] {
+			printf("    Run %d of %d ${GREEN}passed${RESET} in %0.2fs\n", i+1, len(results.RunDurations), duration)
+		} else {
+			printf("    Run %d of %d ${RED}failed${RESET} in %0.2fs\n", i+1, len(results.RunDurations), duration)
+		}
+	}
+}
+
+// sortedLabels returns a sorted copy of the given labels.
+func sortedLabels(labels []core.BuildLabel) []core.BuildLabel {
+	ret := make(core.BuildLabels, len(labels))
+	copy(ret, labels)
+	sort.Sort(ret)
+	return ret
+}
+
 // Produces a string describing the results of one test (or a single aggregation).
 func testResultMessage(results core.TestResults, failedTargets []core.BuildLabel) string {
 	if results.NumTests == 0 {
@@ -312,9 +363,9 @@ func buildResult(target *core.BuildTarget) []string {
 	return results
 }
 
-func printFailedBuildResults(failedTargets []core.BuildLabel, failedTargetMap map[core.BuildLabel]error, duration float64) {
+func printFailedBuildResults(failedTargets []core.BuildLabel, failedTargetMap map[core.BuildLabel]error, unbuilt []core.BuildLabel, duration float64) {
 	printf("${WHITE_ON_RED}Build stopped after %0.2fs. %s failed:${RESET}\n", duration, pluralise(len(failedTargetMap), "target", "targets"))
-	for _, label := range failedTargets {
+	for _, label := range sortedLabels(failedTargets) {
 		err := failedTargetMap[label]
 		if err != nil {
 			printf("    ${BOLD_RED}%s\n${RESET}%s${RESET}\n", label, colouriseError(err))
@@ -322,6 +373,24 @@ func printFailedBuildResults(failedTargets []core.BuildLabel, failedTargetMap ma
 			printf("    ${BOLD_RED}%s${RESET}\n", label)
 		}
 	}
+	if len(unbuilt) > 0 {
+		printf("${BOLD_RED}%s not built because a dependency failed:${RESET}\n", pluralise(len(unbuilt), "target was", "targets were"))
+		for _, label := range unbuilt {
+			printf("    ${RED}%s${RESET}\n", label)
+		}
+	}
+}
+
+// unbuiltTargets returns the original targets that never got built because one of their
+// dependencies failed. This only happens with --keep_going; otherwise we'd have stopped already.
+func unbuiltTargets(state *core.BuildState) []core.BuildLabel {
+	labels := []core.BuildLabel{}
+	for _, label := range state.ExpandOriginalTargets() {
+		if target := state.Graph.Target(label); target != nil && target.State() >= core.Active && target.State() < core.Stopped {
+			labels = append(labels, label)
+		}
+	}
+	return labels
 }
 
 func updateTarget(state *core.BuildState, plainOutput bool, buildingTarget *buildingTarget, label core.BuildLabel,
@@ -39,6 +39,31 @@ func TestColouriseError(t *testing.T) {
 	assert.EqualValues(t, expected, colouriseError(err))
 }
 
+func TestUnbuiltTargets(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	built := makeTarget("//src/output:built")
+	built.SetState(core.Built)
+	failed := makeTarget("//src/output:failed")
+	failed.SetState(core.Failed)
+	blocked := makeTarget("//src/output:blocked", "//src/output:failed")
+	blocked.SetState(core.Active)
+	for _, target := range []*core.BuildTarget{built, failed, blocked} {
+		state.Graph.AddTarget(target)
+	}
+	state.OriginalTargets = []core.BuildLabel{blocked.Label, built.Label, failed.Label}
+	assert.Equal(t, []core.BuildLabel{blocked.Label}, unbuiltTargets(state))
+}
+
+func TestSortedLabels(t *testing.T) {
+	labels := []core.BuildLabel{
+		core.ParseBuildLabel("//src/output:b", ""),
+		core.ParseBuildLabel("//src/core:c", ""),
+		core.ParseBuildLabel("//src/output:a", ""),
+	}
+	assert.Equal(t, []core.BuildLabel{labels[1], labels[2], labels[0]}, sortedLabels(labels))
+	assert.Equal(t, "//src/output:b", labels[0].String(), "Original order should be unchanged")
+}
+
 // Factory function for build targets
 func makeTarget(label string, deps ...string) *core.BuildTarget {
 	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
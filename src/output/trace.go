@@ -11,12 +11,12 @@ import "core"
 
 var traces = make([]traceEntry, 0, 1000)
 
-func addTrace(result *core.BuildResult, previous core.BuildLabel, active bool) {
+func addTrace(state *core.BuildState, result *core.BuildResult, previous core.BuildLabel, active bool) {
 	// It's a bit fiddly to keep all the phases in line here.
 	if result.Label != previous {
 		traces = append(traces, translateEvent(result, "B"))
 	} else if !active {
-		traces = append(traces, translateEvent(result, "E"))
+		traces = append(traces, translateEndEvent(state, result))
 	} else {
 		traces = append(traces, translateEvent(result, "E"))
 		traces = append(traces, translateEvent(result, "B"))
@@ -60,6 +60,19 @@ func translateEvent(result *core.BuildResult, phase string) traceEntry {
 	return entry
 }
 
+// translateEndEvent is like translateEvent but for the event when a target finishes,
+// which also records whether it came from the cache and what it depended on.
+func translateEndEvent(state *core.BuildState, result *core.BuildResult) traceEntry {
+	entry := translateEvent(result, "E")
+	entry.Args.Cached = result.Status == core.TargetCached || result.Tests.Cached
+	if target := state.Graph.Target(result.Label); target != nil {
+		for _, dep := range target.Dependencies() {
+			entry.Args.Dependencies = append(entry.Args.Dependencies, dep.Label.String())
+		}
+	}
+	return entry
+}
+
 type traceObjectFormat struct {
 	TraceEvents []traceEntry `json:"traceEvents"`
 	OtherData   struct {
@@ -76,7 +89,9 @@ type traceEntry struct {
 	Tid  string `json:"tid"`
 	Ts   int64  `json:"ts"`
 	Args struct {
-		Description string `json:"description"`
-		Err         string `json:"err"`
+		Description  string   `json:"description"`
+		Err          string   `json:"err"`
+		Cached       bool     `json:"cached,omitempty"`
+		Dependencies []string `json:"dependencies,omitempty"`
 	} `json:"args"`
 }
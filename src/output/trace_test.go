@@ -0,0 +1,56 @@
+package output
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestTrace(t *testing.T) {
+	state := core.NewBuildState(2, nil, 4, core.DefaultConfiguration())
+	dep := core.NewBuildTarget(core.ParseBuildLabel("//src/output:dep", ""))
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/output:trace_test", ""))
+	state.Graph.AddTarget(dep)
+	state.Graph.AddTarget(target)
+	target.AddDependency(dep.Label)
+	state.Graph.AddDependency(target.Label, dep.Label)
+	defer func() { traces = traces[:0] }()
+
+	start := time.Unix(1000, 0)
+	addTrace(state, &core.BuildResult{
+		ThreadId:    1,
+		Time:        start,
+		Label:       target.Label,
+		Status:      core.TargetBuilding,
+		Description: "Building...",
+	}, core.BuildLabel{}, true)
+	addTrace(state, &core.BuildResult{
+		ThreadId:    1,
+		Time:        start.Add(1500 * time.Millisecond),
+		Label:       target.Label,
+		Status:      core.TargetCached,
+		Description: "Cached",
+	}, target.Label, false)
+
+	var out traceObjectFormat
+	assert.NoError(t, json.Unmarshal(formatTrace(), &out))
+	assert.Equal(t, 2, len(out.TraceEvents))
+
+	e := out.TraceEvents[0]
+	assert.Equal(t, "//src/output:trace_test", e.Name)
+	assert.Equal(t, "B", e.Ph)
+	assert.Equal(t, "Builder 1", e.Tid)
+	assert.EqualValues(t, 1000000000, e.Ts)
+	assert.False(t, e.Args.Cached)
+	assert.Nil(t, e.Args.Dependencies, "Only the end event should record dependencies")
+
+	e = out.TraceEvents[1]
+	assert.Equal(t, "E", e.Ph)
+	assert.EqualValues(t, 1001500000, e.Ts)
+	assert.True(t, e.Args.Cached)
+	assert.Equal(t, []string{"//src/output:dep"}, e.Args.Dependencies)
+}
@@ -203,10 +203,13 @@ def build_rule(globals_dict, package, name, cmd, test_cmd=None, srcs=None, data=
                deps=None, exported_deps=None, secrets=None, tools=None, labels=None, visibility=None,
                hashes=None, binary=False, test=False, test_only=None, building_description='Building...',
                needs_transitive_deps=False, output_is_complete=False, container=False, sandbox=None,
-               test_sandbox=None, no_test_output=False, flaky=0, build_timeout=0, test_timeout=0,
+               test_sandbox=None, symlink_data=None, no_test_output=False, shuffle=False,
+               test_sharding=False, expected_to_fail=False, flaky=0, build_timeout=0, test_timeout=0,
+               per_case_timeout=0, expected_duration=0, priority=0,
                pre_build=None, post_build=None, requires=None, provides=None, licences=None,
                test_outputs=None, system_srcs=None, stamp=False, tag='', optional_outs=None,
-               _filegroup=False, _hash_filegroup=False):
+               no_cache=False, resources=None, pass_env=None, flaky_retry_regex=None, tool_hashes=None,
+               output_glob=None, test_setup=None, test_teardown=None, _filegroup=False, _hash_filegroup=False):
     if name == 'all':
         raise ValueError('"all" is a reserved build target name.')
     if '/' in name or ':' in name:
@@ -215,6 +218,8 @@ def build_rule(globals_dict, package, name, cmd, test_cmd=None, srcs=None, data=
         raise ValueError('Only tests can have container=True')
     if test_cmd and not test:
         raise ValueError('Target %s has been given a test command but isn\'t a test' % name)
+    if not 0 <= priority <= 19:
+        raise ValueError('priority of %s must be between 0 and 19' % name)
     if tag:
         name = ''.join(['_' if not name.startswith('_') else '',
                         name,
@@ -232,6 +237,8 @@ def build_rule(globals_dict, package, name, cmd, test_cmd=None, srcs=None, data=
         sandbox = bool(globals_dict['CONFIG'].get('BUILD_SANDBOX'))
     if test_sandbox is None:
         test_sandbox = bool(globals_dict['CONFIG'].get('TEST_SANDBOX'))
+    if symlink_data is None:
+        symlink_data = bool(globals_dict['CONFIG'].get('TEST_SYMLINK_DATA'))
 
     # Further calls to package() are now banned; it's too difficult to ensure pre/post build
     # functions work as expected if the user changes things after adding the target but before
@@ -250,14 +257,22 @@ def build_rule(globals_dict, package, name, cmd, test_cmd=None, srcs=None, data=
                          bool(container),
                          sandbox,
                          test_sandbox,
+                         symlink_data,
                          no_test_output,
+                         shuffle,
+                         test_sharding,
+                         expected_to_fail,
                          test_only or test,  # Tests are implicitly test_only
                          stamp,
+                         no_cache,
                          _filegroup,
                          _hash_filegroup,
                          3 if flaky is True else flaky,  # Default is to rerun three times.
                          build_timeout,
                          test_timeout,
+                         per_case_timeout,
+                         expected_duration,
+                         priority,
                          ffi_string(building_description))
     if not target:
         # Currently this is the only reason _add_target can fail, given that we validated
@@ -282,6 +297,7 @@ def build_rule(globals_dict, package, name, cmd, test_cmd=None, srcs=None, data=
     _add_strings(target, _add_dep, deps, 'deps')
     _add_strings(target, _add_exported_dep, exported_deps, 'exported_deps')
     _add_strings(target, _add_optional_out, optional_outs, 'optional_outs')
+    _add_strings(target, _add_output_glob, output_glob, 'output_glob')
     _add_strings(target, _add_vis, visibility, 'visibility')
     _add_strings(target, _add_label, labels, 'labels')
     _add_strings(target, _add_hash, hashes, 'hashes')
@@ -293,11 +309,28 @@ def build_rule(globals_dict, package, name, cmd, test_cmd=None, srcs=None, data=
             raise ValueError('"provides" argument for rule %s is not a mapping' % name)
         for lang, rule in provides.items():
             _check_c_error(_add_provide(target, ffi_from_string(lang), ffi_from_string(rule)))
+    if resources:
+        if not isinstance(resources, Mapping):
+            raise ValueError('"resources" argument for rule %s is not a mapping' % name)
+        for resource, amount in resources.items():
+            _check_c_error(_add_resource(target, ffi_from_string(resource), amount))
+    if tool_hashes:
+        if not isinstance(tool_hashes, Mapping):
+            raise ValueError('"tool_hashes" argument for rule %s is not a mapping' % name)
+        for tool, hsh in tool_hashes.items():
+            _check_c_error(_add_tool_hash(target, ffi_from_string(tool), ffi_from_string(hsh)))
     if secrets:
         for secret in secrets:
             if (not secret.startswith('/') or secret.startswith('//')) and not secret.startswith('~'):
                 raise ValueError('Secret "%s" of %s is not an absolute path' % (secret, name))
         _add_strings(target, _add_secret, secrets, 'secrets')
+    _add_strings(target, _add_pass_env, pass_env, 'pass_env')
+    if flaky_retry_regex:
+        _check_c_error(_set_flaky_retry_regex(target, ffi_from_string(flaky_retry_regex)))
+    if test_setup:
+        _check_c_error(_set_test_setup(target, ffi_from_string(test_setup)))
+    if test_teardown:
+        _check_c_error(_set_test_teardown(target, ffi_from_string(test_teardown)))
     if pre_build:
         # Must manually ensure we keep these objects from being gc'd.
         handle = ffi.new_handle(pre_build)
@@ -385,6 +418,86 @@ def glob(package, includes, excludes=None, exclude=None, hidden=False):
     return [ffi_to_string(filename) for filename in _null_terminated_array(filenames)]
 
 
+_DEFAULT_CONDITION = '//conditions:default'
+_CONFIG_CONDITION_PREFIX = '//config:'
+
+
+def select(conditions, no_match_error=''):
+    """Chooses between values depending on the configuration the target is being built for.
+
+    Conditions are named //config:<os>, //config:<arch> or //config:<os>_<arch>, for example
+    //config:linux_amd64. The value for //conditions:default is used if none of them match.
+    """
+    if not isinstance(conditions, Mapping):
+        raise TypeError('The argument to select() should be a dict')
+    for condition in conditions:
+        if condition != _DEFAULT_CONDITION and not condition.startswith(_CONFIG_CONDITION_PREFIX):
+            raise ValueError('Unknown condition %s in select(); must be %s or start with %s' % (
+                condition, _DEFAULT_CONDITION, _CONFIG_CONDITION_PREFIX))
+    return _Select([_SelectConditions(conditions, no_match_error)])
+
+
+class _Select(object):
+    """The result of a call to select().
+
+    It isn't resolved to an actual value until the target is added in build_rule, when we know
+    the configuration. Until then it can be concatenated with other values (e.g.
+    srcs = ['a.go'] + select({...})), in which case the concatenation is deferred as well.
+    """
+
+    def __init__(self, parts):
+        self.parts = parts
+
+    def __add__(self, other):
+        return _Select(self.parts + (other.parts if isinstance(other, _Select) else [other]))
+
+    def __radd__(self, other):
+        return _Select([other] + self.parts)
+
+    def __iter__(self):
+        raise TypeError("Can't iterate over the result of select() before it's been resolved")
+
+    def resolve(self, config):
+        values = [part.resolve(config) if isinstance(part, _SelectConditions) else part
+                  for part in self.parts]
+        ret = values[0]
+        for value in values[1:]:
+            ret = ret + value
+        return ret
+
+
+class _SelectConditions(object):
+    """A single set of conditions passed to select()."""
+
+    def __init__(self, conditions, no_match_error):
+        self.conditions = conditions
+        self.no_match_error = no_match_error
+
+    def resolve(self, config):
+        os_arch = '%s_%s' % (config.get('OS'), config.get('ARCH'))
+        active = {_CONFIG_CONDITION_PREFIX + c for c in (config.get('OS'), config.get('ARCH'), os_arch)}
+        matches = sorted(condition for condition in self.conditions if condition in active)
+        if _CONFIG_CONDITION_PREFIX + os_arch in matches:
+            return self.conditions[_CONFIG_CONDITION_PREFIX + os_arch]  # Most specific one wins.
+        elif len(matches) > 1:
+            raise ValueError('Conditions %s in select() all match %s' % (', '.join(matches), os_arch))
+        elif matches:
+            return self.conditions[matches[0]]
+        elif _DEFAULT_CONDITION in self.conditions:
+            return self.conditions[_DEFAULT_CONDITION]
+        raise ValueError(self.no_match_error or 'None of the conditions in select() match %s: %s' % (
+            os_arch, ', '.join(sorted(self.conditions))))
+
+
+def _resolve_select(config, value):
+    """Resolves the given value if it's the result of a select(), including any within a dict."""
+    if isinstance(value, _Select):
+        return value.resolve(config)
+    elif isinstance(value, Mapping) and any(isinstance(v, _Select) for v in value.values()):
+        return {k: _resolve_select(config, v) for k, v in value.items()}
+    return value
+
+
 def get_labels(package, target, prefix):
     """Gets the transitive set of labels for a rule. Should be called from a pre-build function."""
     labels = _get_labels(package, ffi_from_string(target), ffi_from_string(prefix))
@@ -454,7 +567,10 @@ def _get_globals(c_package, c_package_name):
     # Need to pass some hidden arguments to these guys.
     package_name = ffi_to_string(c_package_name)
     local_globals['subinclude'] = lambda *args, **kwargs: subinclude(c_package, local_globals, *args, **kwargs)
-    local_globals['build_rule'] = lambda *args, **kwargs: build_rule(local_globals, c_package, *args, **kwargs)
+    local_globals['build_rule'] = lambda *args, **kwargs: build_rule(
+        local_globals, c_package, *[_resolve_select(local_globals['CONFIG'], arg) for arg in args],
+        **{k: _resolve_select(local_globals['CONFIG'], v) for k, v in kwargs.items()})
+    local_globals['select'] = lambda conditions, no_match_error='': select(conditions, no_match_error)
     local_globals['glob'] = lambda *args, **kwargs: glob(package_name, *args, **kwargs)
     local_globals['get_labels'] = lambda name, prefix: get_labels(c_package, name, prefix)
     local_globals['has_label'] = lambda name, prefix: has_label(c_package, name, prefix)
@@ -537,6 +653,7 @@ _please_globals['defaultdict'] = defaultdict
 _please_globals['ParseError'] = ParseError
 _please_globals['ConfigError'] = ConfigError
 _please_globals['DuplicateTargetError'] = DuplicateTargetError
+_please_globals['_Select'] = _Select  # Needed for the type checks on builtin rules.
 
 # We'll need these guys locally. Unfortunately exec is a statement so we
 # can't do it for that.
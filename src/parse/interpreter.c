@@ -59,7 +59,7 @@ int InitialiseInterpreter(char* parser_location) {
     return 3;  // This happens if Python is available but cffi isn't.
   }
   reg("_add_target", "size_t (*)(size_t, char*, char*, char*, uint8, uint8, uint8, uint8, uint8, "
-      "uint8, uint8, uint8, uint8, uint8, uint8, uint8, int64, int64, int64, char*)", AddTarget);
+      "uint8, uint8, uint8, uint8, uint8, uint8, uint8, uint8, uint8, uint8, uint8, uint8, int64, int64, int64, int64, int64, int64, char*)", AddTarget);
   reg("_add_src", "char* (*)(size_t, char*)", AddSource);
   reg("_add_data", "char* (*)(size_t, char*)", AddData);
   reg("_add_dep", "char* (*)(size_t, char*)", AddDep);
@@ -70,6 +70,7 @@ int InitialiseInterpreter(char* parser_location) {
   reg("_add_out", "char* (*)(size_t, char*)", AddOutput);
   reg("_add_named_out", "char* (*)(size_t, char*, char*)", AddNamedOutput);
   reg("_add_optional_out", "char* (*)(size_t, char*)", AddOptionalOutput);
+  reg("_add_output_glob", "char* (*)(size_t, char*)", AddOutputGlob);
   reg("_add_vis", "char* (*)(size_t, char*)", AddVis);
   reg("_add_label", "char* (*)(size_t, char*)", AddLabel);
   reg("_add_hash", "char* (*)(size_t, char*)", AddHash);
@@ -77,6 +78,12 @@ int InitialiseInterpreter(char* parser_location) {
   reg("_add_test_output", "char* (*)(size_t, char*)", AddTestOutput);
   reg("_add_require", "char* (*)(size_t, char*)", AddRequire);
   reg("_add_provide", "char* (*)(size_t, char*, char*)", AddProvide);
+  reg("_add_resource", "char* (*)(size_t, char*, int64)", AddResource);
+  reg("_add_pass_env", "char* (*)(size_t, char*)", AddPassEnv);
+  reg("_set_flaky_retry_regex", "char* (*)(size_t, char*)", SetFlakyRetryRegex);
+  reg("_set_test_setup", "char* (*)(size_t, char*)", SetTestSetup);
+  reg("_set_test_teardown", "char* (*)(size_t, char*)", SetTestTeardown);
+  reg("_add_tool_hash", "char* (*)(size_t, char*, char*)", AddToolHash);
   reg("_add_named_src", "char* (*)(size_t, char*, char*)", AddNamedSource);
   reg("_add_command", "char* (*)(size_t, char*, char*)", AddCommand);
   reg("_add_test_command", "char* (*)(size_t, char*, char*)", AddTestCommand);
@@ -15,9 +15,12 @@ package parse
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path"
+	"regexp"
 	"runtime"
 	"sort"
 	"strings"
@@ -103,6 +106,7 @@ func initializeInterpreter(state *core.BuildState) {
 	setConfigValue("PLZ_VERSION", config.Please.Version.String())
 	setConfigValue("BUILD_SANDBOX", pythonBool(config.Build.Sandbox))
 	setConfigValue("TEST_SANDBOX", pythonBool(config.Test.Sandbox))
+	setConfigValue("TEST_SYMLINK_DATA", pythonBool(config.Test.SymlinkData))
 	setConfigValue("GO_TOOL", config.Go.GoTool)
 	setConfigValue("GO_VERSION", config.Go.GoVersion)
 	setConfigValue("GO_TEST_TOOL", config.Go.TestTool)
@@ -338,22 +342,24 @@ func IsValidTargetName(name *C.char) bool {
 
 //export AddTarget
 func AddTarget(pkgPtr uintptr, cName, cCmd, cTestCmd *C.char, binary, test, needsTransitiveDeps,
-	outputIsComplete, containerise, sandbox, testSandbox, noTestOutput, testOnly, stamp, filegroup, hashFilegroup bool,
-	flakiness, buildTimeout, testTimeout int, cBuildingDescription *C.char) (ret C.size_t) {
+	outputIsComplete, containerise, sandbox, testSandbox, symlinkData, noTestOutput, shuffle, testSharding, expectedToFail, testOnly,
+	stamp, noCache, filegroup, hashFilegroup bool,
+	flakiness, buildTimeout, testTimeout, perCaseTimeout, expectedDuration, priority int, cBuildingDescription *C.char) (ret C.size_t) {
 	buildingDescription := ""
 	if cBuildingDescription != nil {
 		buildingDescription = C.GoString(cBuildingDescription)
 	}
 	return sizet(addTarget(pkgPtr, C.GoString(cName), C.GoString(cCmd), C.GoString(cTestCmd),
-		binary, test, needsTransitiveDeps, outputIsComplete, containerise, sandbox, testSandbox, noTestOutput,
-		testOnly, stamp, filegroup, hashFilegroup, flakiness, buildTimeout, testTimeout, buildingDescription))
+		binary, test, needsTransitiveDeps, outputIsComplete, containerise, sandbox, testSandbox, symlinkData, noTestOutput,
+		shuffle, testSharding, expectedToFail, testOnly, stamp, noCache, filegroup, hashFilegroup, flakiness, buildTimeout, testTimeout, perCaseTimeout, expectedDuration, priority, buildingDescription))
 }
 
 // addTarget adds a new build target to the graph.
 // Separated from AddTarget to make it possible to test (since you can't mix cgo and go test).
 func addTarget(pkgPtr uintptr, name, cmd, testCmd string, binary, test, needsTransitiveDeps,
-	outputIsComplete, containerise, sandbox, testSandbox, noTestOutput, testOnly, stamp, filegroup, hashFilegroup bool,
-	flakiness, buildTimeout, testTimeout int, buildingDescription string) *core.BuildTarget {
+	outputIsComplete, containerise, sandbox, testSandbox, symlinkData, noTestOutput, shuffle, testSharding, expectedToFail, testOnly,
+	stamp, noCache, filegroup, hashFilegroup bool,
+	flakiness, buildTimeout, testTimeout, perCaseTimeout, expectedDuration, priority int, buildingDescription string) *core.BuildTarget {
 	pkg := unsizep(pkgPtr)
 	target := core.NewBuildTarget(core.NewBuildLabel(pkg.Name, name))
 	target.IsBinary = binary
@@ -363,11 +369,19 @@ func addTarget(pkgPtr uintptr, name, cmd, testCmd string, binary, test, needsTra
 	target.Containerise = containerise
 	target.Sandbox = sandbox
 	target.TestSandbox = testSandbox
+	target.SymlinkData = symlinkData
 	target.NoTestOutput = noTestOutput
+	target.Shuffle = shuffle
+	target.TestSharding = testSharding
+	target.ExpectedToFail = expectedToFail
+	target.NoCache = noCache
 	target.TestOnly = testOnly
 	target.Flakiness = flakiness
 	target.BuildTimeout = time.Duration(buildTimeout) * time.Second
 	target.TestTimeout = time.Duration(testTimeout) * time.Second
+	target.PerCaseTimeout = time.Duration(perCaseTimeout) * time.Second
+	target.ExpectedDuration = time.Duration(expectedDuration) * time.Second
+	target.Priority = priority
 	target.Stamp = stamp
 	target.IsFilegroup = filegroup || hashFilegroup
 	target.IsHashFilegroup = hashFilegroup
@@ -629,6 +643,13 @@ func AddOptionalOutput(cTarget uintptr, cOutput *C.char) *C.char {
 	return nil
 }
 
+//export AddOutputGlob
+func AddOutputGlob(cTarget uintptr, cGlob *C.char) *C.char {
+	target := unsizet(cTarget)
+	target.OutputGlobs = append(target.OutputGlobs, C.GoString(cGlob))
+	return nil
+}
+
 //export AddDep
 func AddDep(cTarget uintptr, cDep *C.char) *C.char {
 	target := unsizet(cTarget)
@@ -745,6 +766,87 @@ func AddProvide(cTarget uintptr, cLanguage *C.char, cDep *C.char) *C.char {
 	return nil
 }
 
+//export AddResource
+func AddResource(cTarget uintptr, cName *C.char, amount int) *C.char {
+	if amount < 0 {
+		return C.CString(fmt.Sprintf("Invalid amount %d for resource %s", amount, C.GoString(cName)))
+	}
+	unsizet(cTarget).AddResource(C.GoString(cName), amount)
+	return nil
+}
+
+//export AddPassEnv
+func AddPassEnv(cTarget uintptr, cName *C.char) *C.char {
+	target := unsizet(cTarget)
+	target.PassEnv = append(target.PassEnv, C.GoString(cName))
+	return nil
+}
+
+//export SetFlakyRetryRegex
+func SetFlakyRetryRegex(cTarget uintptr, cRegex *C.char) *C.char {
+	target := unsizet(cTarget)
+	regex := C.GoString(cRegex)
+	if _, err := regexp.Compile(regex); err != nil {
+		return C.CString(fmt.Sprintf("Invalid flaky_retry_regex: %s", err))
+	}
+	target.FlakyRetryRegex = regex
+	return nil
+}
+
+//export SetTestSetup
+func SetTestSetup(cTarget uintptr, cLabel *C.char) *C.char {
+	target := unsizet(cTarget)
+	label, err := core.TryParseBuildLabel(C.GoString(cLabel), target.Label.PackageName)
+	if err != nil {
+		return C.CString(err.Error())
+	}
+	target.TestSetup = &label
+	return nil
+}
+
+//export SetTestTeardown
+func SetTestTeardown(cTarget uintptr, cLabel *C.char) *C.char {
+	target := unsizet(cTarget)
+	label, err := core.TryParseBuildLabel(C.GoString(cLabel), target.Label.PackageName)
+	if err != nil {
+		return C.CString(err.Error())
+	}
+	target.TestTeardown = &label
+	return nil
+}
+
+//export AddToolHash
+func AddToolHash(cTarget uintptr, cTool, cHash *C.char) *C.char {
+	if err := addToolHash(unsizet(cTarget), C.GoString(cTool), C.GoString(cHash)); err != nil {
+		return C.CString(err.Error())
+	}
+	return nil
+}
+
+// addToolHash adds the expected hash of a tool to a target. The tool must already have been added to it.
+func addToolHash(target *core.BuildTarget, tool, hash string) error {
+	t, err := parseTool(target, tool)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, t2 := range target.AllTools() {
+		if t2.String() == t.String() {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("tool_hashes of %s refers to %s, which isn't one of its tools", target.Label, tool)
+	}
+	hash = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(hash, "sha256:")))
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha256.Size {
+		return fmt.Errorf("Invalid hash %s for tool %s of %s; must be a hex-encoded SHA256 hash", hash, tool, target.Label)
+	}
+	target.AddToolHash(t.String(), hash)
+	return nil
+}
+
 //export SetContainerSetting
 func SetContainerSetting(cTarget uintptr, cName, cValue *C.char) *C.char {
 	target := unsizet(cTarget)
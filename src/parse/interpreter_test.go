@@ -60,7 +60,7 @@ func TestAddTarget(t *testing.T) {
 	pkg := core.NewPackage("src/parse")
 	addTargetTest1 := func(name string, binary, container, test bool, testCmd string) *core.BuildTarget {
 		return addTarget(uintptr(unsafe.Pointer(pkg)), name, "true", testCmd, binary, test,
-			false, false, container, false, false, false, false, false, false, false, 0, 0, 0, "Building...")
+			false, false, container, false, false, false, false, false, false, false, false, false, false, false, false, 0, 0, 0, 0, 0, 0, "Building...")
 	}
 	addTargetTest := func(name string, binary, container bool) *core.BuildTarget {
 		return addTargetTest1(name, binary, container, false, "")
@@ -137,6 +137,17 @@ func TestGetLabels(t *testing.T) {
 	assert.Equal(t, []string{"y"}, getLabels(target1, "p", core.Inactive))
 }
 
+func TestAddToolHash(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/parse:tool_hashes", ""))
+	target.AddTool(core.ParseBuildLabel("//src/parse:tool", ""))
+	const hash = "a8076d3d28d21e02012b20eaf7dbf75409a6277134439025f282e368e3305abf"
+	assert.NoError(t, addToolHash(target, ":tool", "sha256: "+strings.ToUpper(hash)))
+	assert.Equal(t, map[string]string{"//src/parse:tool": hash}, target.ToolHashes)
+	assert.Error(t, addToolHash(target, "//src/parse:not_a_tool", hash), "Should fail for something that isn't one of its tools")
+	assert.Error(t, addToolHash(target, ":tool", "sha1:"+hash[:40]), "Only SHA256 is supported")
+	assert.Error(t, addToolHash(target, ":tool", hash[:60]), "Should fail for a hash of the wrong length")
+}
+
 func TestMain(m *testing.M) {
 	core.NewBuildState(10, nil, 2, core.DefaultConfiguration())
 	// Need to set this before calling parseSource.
@@ -281,6 +281,15 @@ func addDep(state *core.BuildState, label, dependor core.BuildLabel, rescan, for
 			}
 		}
 	}
+	// Setup & teardown targets aren't dependencies of the test (they don't affect how it's built)
+	// but they do need to be built before it can run.
+	if target.IsTest && state.NeedTests {
+		for _, l := range []*core.BuildLabel{target.TestSetup, target.TestTeardown} {
+			if l != nil {
+				addDep(state, *l, label, false, forceBuild)
+			}
+		}
+	}
 	// If this target has no deps, add it to the queue now, otherwise handle its deps.
 	// Only add if we need to build targets (not if we're just parsing) but we might need it to parse...
 	if target.State() == core.Active && state.Graph.AllDepsBuilt(target) {
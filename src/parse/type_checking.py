@@ -39,6 +39,9 @@ def arg_checks(node):
         assert arg in docs, 'Missing docstring for argument %s to %s()' % (arg, node.name)
         doc = docs[arg]
         rtype = doc.replace('bool', 'int')  # Bools are ints so an int is acceptable.
+        if arg != 'name' and doc != 'function':
+            # Anything but the name can come from a select(), which build_rule resolves later.
+            rtype = '(%s, _Select)' % ', '.join(rtype.split(' | '))
         if '|' in doc:
             types = rtype.split(' | ')
             yield 'assert not %s or isinstance(%s, (%s)), "Argument %s to %s must be a %s"' % (
@@ -2,14 +2,18 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"path"
+	"regexp"
 	"runtime"
 	"runtime/pprof"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 	"github.com/kardianos/osext"
@@ -41,17 +45,29 @@ var log = logging.MustGetLogger("plz")
 
 var config *core.Configuration
 
+// exitCode is the code we exit with when the command is successful.
+// It's only nonzero when --flaky_exit_code applies.
+var exitCode int
+
+// failureExitCode is the code we exit with when the command fails.
+// It's something distinctive, which is sometimes useful to identify this externally.
+const failureExitCode = 7
+
 var opts struct {
 	Usage      string `usage:"Please is a high-performance multi-language build system.\n\nIt uses BUILD files to describe what to build and how to build it.\nSee https://please.build for more information about how it works and what Please can do for you."`
 	BuildFlags struct {
-		Config     string          `short:"c" long:"config" description:"Build config to use. Defaults to opt."`
-		RepoRoot   string          `short:"r" long:"repo_root" description:"Root of repository to build."`
-		KeepGoing  bool            `short:"k" long:"keep_going" description:"Don't stop on first failed target."`
-		NumThreads int             `short:"n" long:"num_threads" description:"Number of concurrent build operations. Default is number of CPUs + 2."`
-		Include    []string        `short:"i" long:"include" description:"Label of targets to include in automatic detection."`
-		Exclude    []string        `short:"e" long:"exclude" description:"Label of targets to exclude from automatic detection."`
-		Engine     string          `long:"engine" hidden:"true" description:"Parser engine .so / .dylib to load"`
-		Option     ConfigOverrides `short:"o" long:"override" description:"Options to override from .plzconfig (e.g. -o please.selfupdate:false)"`
+		Config       string          `short:"c" long:"config" description:"Build config to use. Defaults to opt."`
+		RepoRoot     string          `short:"r" long:"repo_root" description:"Root of repository to build."`
+		KeepGoing    bool            `short:"k" long:"keep_going" description:"Don't stop on first failed target."`
+		NumThreads   int             `short:"n" long:"num_threads" description:"Number of concurrent build operations. Default is number of CPUs + 2."`
+		Include      []string        `short:"i" long:"include" description:"Label of targets to include in automatic detection."`
+		Exclude      []string        `short:"e" long:"exclude" description:"Label of targets to exclude from automatic detection."`
+		Engine       string          `long:"engine" hidden:"true" description:"Parser engine .so / .dylib to load"`
+		Option       ConfigOverrides `short:"o" long:"override" description:"Options to override from .plzconfig (e.g. -o please.selfupdate:false)"`
+		WhyRebuild   bool            `long:"why_rebuild" description:"Explain which input changed for each target that gets rebuilt."`
+		Resources    []string        `long:"resources" description:"Total amount of a named resource available to tests, e.g. --resources gpu=2. Overrides the config setting."`
+		Nice         int             `long:"nice" description:"Run build and test actions at this niceness (0-19) so they don't compete with other work on the machine."`
+		AuditSandbox bool            `long:"audit_sandbox" description:"Record the files that sandboxed build actions access and report any outside their inputs as possible missing dependencies. Requires strace."`
 	} `group:"Options controlling what to build & how to build it"`
 
 	OutputFlags struct {
@@ -63,6 +79,7 @@ var opts struct {
 		Colour            bool   `long:"colour" description:"Forces coloured output from logging & other shell output."`
 		NoColour          bool   `long:"nocolour" description:"Forces colourless output from logging & other shell output."`
 		TraceFile         string `long:"trace_file" description:"File to write Chrome tracing output into"`
+		EventSocket       string `long:"event_socket" description:"Path of a Unix socket to stream build events to as JSON"`
 		ShowAllOutput     bool   `long:"show_all_output" description:"Show all output live from all commands. Implies --plain_output."`
 		CompletionScript  bool   `long:"completion_script" description:"Prints the bash / zsh completion script to stdout"`
 		Version           bool   `long:"version" description:"Print the version of the tool"`
@@ -86,6 +103,7 @@ var opts struct {
 	Build struct {
 		Prepare    bool     `long:"prepare" description:"Prepare build directory for these targets but don't build them."`
 		Shell      bool     `long:"shell" description:"Like --prepare, but opens a shell in the build directory with the appropriate environment variables."`
+		Plan       bool     `long:"plan" description:"Print what would be built and what would come from the cache, without building anything."`
 		ShowStatus bool     `long:"show_status" hidden:"true" description:"Show status of each target in output after build"`
 		Args       struct { // Inner nesting is necessary to make positional-args work :(
 			Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to build"`
@@ -107,10 +125,27 @@ var opts struct {
 	} `command:"hash" description:"Calculates hash for one or more targets"`
 
 	Test struct {
-		FailingTestsOk  bool   `long:"failing_tests_ok" hidden:"true" description:"Exit with status 0 even if tests fail (nonzero only if catastrophe happens)"`
-		NumRuns         int    `long:"num_runs" short:"n" description:"Number of times to run each test target."`
-		TestResultsFile string `long:"test_results_file" default:"plz-out/log/test_results.xml" description:"File to write combined test results to."`
-		ShowOutput      bool   `short:"s" long:"show_output" description:"Always show output of tests, even on success."`
+		FailingTestsOk         bool     `long:"failing_tests_ok" hidden:"true" description:"Exit with status 0 even if tests fail (nonzero only if catastrophe happens)"`
+		NumRuns                int      `long:"num_runs" short:"n" description:"Number of times to run each test target."`
+		FlakyTimeoutMultiplier float64  `long:"flaky_timeout_multiplier" default:"1.0" description:"Multiplier to increase the timeout by on each successive run of a test."`
+		FailFastFlakes         bool     `long:"fail_fast_flakes" description:"Stop rerunning a test once it has been seen to both pass and fail."`
+		EnforceDurations       bool     `long:"enforce_durations" description:"Fail tests that take longer than their expected_duration, rather than just warning about them."`
+		FlakyExitCode          *int     `long:"flaky_exit_code" description:"Exit code to use if all tests pass but some only did so after being retried. Can't be 0 or 7."`
+		FlakyPolicy            string   `long:"flaky_policy" choice:"default" choice:"majority" default:"default" description:"How many runs of a test must pass. majority passes tests that succeed in more than half their runs."`
+		TestSeed               *int64   `long:"test_seed" description:"Seed to give to tests that shuffle their order. A random one is chosen if not passed."`
+		NumShards              int      `long:"num_shards" description:"Number of shards to split tests that support sharding into."`
+		ShardIndex             int      `long:"shard_index" description:"Index of the shard to run, from 0 to num_shards - 1."`
+		TestFilter             string   `long:"test_filter" description:"Regex selecting which test cases to run within each test target."`
+		HermeticEnv            bool     `long:"hermetic_env" description:"Unset all environment variables in tests except Please's own and those in their pass_env."`
+		TestResultsFile        string   `long:"test_results_file" default:"plz-out/log/test_results.xml" description:"File to write combined test results to."`
+		MergeResults           []string `long:"merge_results" description:"Merge the given results files from separate shards into test_results_file instead of running any tests."`
+		Output                 string   `long:"output" choice:"text" choice:"json" default:"text" description:"Format of the results summary. json additionally writes a machine-readable summary to stdout."`
+		ShowOutput             bool     `short:"s" long:"show_output" description:"Always show output of tests, even on success."`
+		StreamOutput           bool     `long:"stream_test_output" description:"Show the output of tests live as they run, prefixed with their label. Implies --plain_output."`
+		Since                  string   `long:"since" description:"Only run tests affected by files changed since this git revision."`
+		OnlyChanged            bool     `long:"only_changed" description:"Only run tests affected by uncommitted local changes. Equivalent to --since=HEAD."`
+		LastFailed             bool     `long:"last_failed" description:"Rerun only the tests that failed in the previous run of plz test."`
+		RepeatUntilFailure     int      `long:"repeat_until_failure" description:"Run each test up to this many times, stopping at the first failure. Useful to reproduce rare flakes."`
 		// Slightly awkward since we can specify a single test with arguments or multiple test targets.
 		Args struct {
 			Target core.BuildLabel `positional-arg-name:"target" description:"Target to test"`
@@ -119,16 +154,31 @@ var opts struct {
 	} `command:"test" description:"Builds and tests one or more targets"`
 
 	Cover struct {
-		FailingTestsOk      bool     `long:"failing_tests_ok" hidden:"true" description:"Exit with status 0 even if tests fail (nonzero only if catastrophe happens)"`
-		NoCoverageReport    bool     `long:"nocoverage_report" description:"Suppress the per-file coverage report displayed in the shell"`
-		LineCoverageReport  bool     `short:"l" long:"line_coverage_report" description:" Show a line-by-line coverage report for all affected files."`
-		NumRuns             int      `short:"n" long:"num_runs" description:"Number of times to run each test target."`
-		IncludeAllFiles     bool     `short:"a" long:"include_all_files" description:"Include all dependent files in coverage (default is just those from relevant packages)"`
-		IncludeFile         []string `long:"include_file" description:"Filenames to filter coverage display to"`
-		TestResultsFile     string   `long:"test_results_file" default:"plz-out/log/test_results.xml" description:"File to write combined test results to."`
-		CoverageResultsFile string   `long:"coverage_results_file" default:"plz-out/log/coverage.json" description:"File to write combined coverage results to."`
-		ShowOutput          bool     `short:"s" long:"show_output" description:"Always show output of tests, even on success."`
-		Args                struct {
+		FailingTestsOk         bool     `long:"failing_tests_ok" hidden:"true" description:"Exit with status 0 even if tests fail (nonzero only if catastrophe happens)"`
+		NoCoverageReport       bool     `long:"nocoverage_report" description:"Suppress the per-file coverage report displayed in the shell"`
+		LineCoverageReport     bool     `short:"l" long:"line_coverage_report" description:" Show a line-by-line coverage report for all affected files."`
+		NumRuns                int      `short:"n" long:"num_runs" description:"Number of times to run each test target."`
+		FlakyTimeoutMultiplier float64  `long:"flaky_timeout_multiplier" default:"1.0" description:"Multiplier to increase the timeout by on each successive run of a test."`
+		FailFastFlakes         bool     `long:"fail_fast_flakes" description:"Stop rerunning a test once it has been seen to both pass and fail."`
+		EnforceDurations       bool     `long:"enforce_durations" description:"Fail tests that take longer than their expected_duration, rather than just warning about them."`
+		FlakyExitCode          *int     `long:"flaky_exit_code" description:"Exit code to use if all tests pass but some only did so after being retried. Can't be 0 or 7."`
+		FlakyPolicy            string   `long:"flaky_policy" choice:"default" choice:"majority" default:"default" description:"How many runs of a test must pass. majority passes tests that succeed in more than half their runs."`
+		TestSeed               *int64   `long:"test_seed" description:"Seed to give to tests that shuffle their order. A random one is chosen if not passed."`
+		NumShards              int      `long:"num_shards" description:"Number of shards to split tests that support sharding into."`
+		ShardIndex             int      `long:"shard_index" description:"Index of the shard to run, from 0 to num_shards - 1."`
+		TestFilter             string   `long:"test_filter" description:"Regex selecting which test cases to run within each test target."`
+		HermeticEnv            bool     `long:"hermetic_env" description:"Unset all environment variables in tests except Please's own and those in their pass_env."`
+		IncludeAllFiles        bool     `short:"a" long:"include_all_files" description:"Include all dependent files in coverage (default is just those from relevant packages)"`
+		IncludeFile            []string `long:"include_file" description:"Filenames to filter coverage display to"`
+		TestResultsFile        string   `long:"test_results_file" default:"plz-out/log/test_results.xml" description:"File to write combined test results to."`
+		CoverageResultsFile    string   `long:"coverage_results_file" default:"plz-out/log/coverage.json" description:"File to write combined coverage results to."`
+		CoverageReportFile     string   `long:"coverage_report_file" description:"File to additionally write combined coverage to in lcov or Go coverprofile format."`
+		CoverageReportFormat   string   `long:"coverage_report_format" choice:"lcov" choice:"go" default:"lcov" description:"Format of the file written by --coverage_report_file."`
+		CoverageThreshold      float64  `long:"coverage_threshold" description:"Fail if the combined coverage is below this percentage."`
+		Output                 string   `long:"output" choice:"text" choice:"json" default:"text" description:"Format of the results summary. json additionally writes a machine-readable summary to stdout."`
+		ShowOutput             bool     `short:"s" long:"show_output" description:"Always show output of tests, even on success."`
+		StreamOutput           bool     `long:"stream_test_output" description:"Show the output of tests live as they run, prefixed with their label. Implies --plain_output."`
+		Args                   struct {
 			Target core.BuildLabel `positional-arg-name:"target" description:"Target to test" group:"one test"`
 			Args   []string        `positional-arg-name:"arguments" description:"Arguments or test selectors" group:"one test"`
 		} `positional-args:"true"`
@@ -141,14 +191,14 @@ var opts struct {
 			PositionalArgs struct {
 				Targets []core.BuildLabel `positional-arg-name:"target" description:"Targets to run"`
 			} `positional-args:"true" required:"true"`
-			Args []string `short:"a" long:"arg" description:"Arguments to pass to the called processes."`
+			Args []string `short:"a" long:"arg" description:"Arguments to pass to the called processes (they can also be given after --)."`
 		} `command:"parallel" description:"Runs a sequence of targets in parallel"`
 		Sequential struct {
 			Quiet          bool `short:"q" long:"quiet" description:"Suppress output from successful subprocesses."`
 			PositionalArgs struct {
 				Targets []core.BuildLabel `positional-arg-name:"target" description:"Targets to run"`
 			} `positional-args:"true" required:"true"`
-			Args []string `short:"a" long:"arg" description:"Arguments to pass to the called processes."`
+			Args []string `short:"a" long:"arg" description:"Arguments to pass to the called processes (they can also be given after --)."`
 		} `command:"sequential" description:"Runs a sequence of targets sequentially."`
 		Args struct {
 			Target core.BuildLabel `positional-arg-name:"target" required:"true" description:"Target to run"`
@@ -164,8 +214,23 @@ var opts struct {
 		} `positional-args:"true"`
 	} `command:"clean" description:"Cleans build artifacts" subcommands-optional:"true"`
 
+	Cache struct {
+		Gc struct {
+			MaxSize cli.ByteSize `long:"max_size" required:"true" description:"Size to reduce the directory cache to, e.g. 20G."`
+		} `command:"gc" description:"Evicts the least recently used artifacts from the directory cache until it's under a given size."`
+	} `command:"cache" description:"Manages the local directory cache"`
+
 	Watch struct {
-		Args struct {
+		NumRuns                int     `short:"n" long:"num_runs" description:"Number of times to run each test target on each change."`
+		FlakyTimeoutMultiplier float64 `long:"flaky_timeout_multiplier" default:"1.0" description:"Multiplier to increase the timeout by on each successive run of a test."`
+		FailFastFlakes         bool    `long:"fail_fast_flakes" description:"Stop rerunning a test once it has been seen to both pass and fail."`
+		EnforceDurations       bool    `long:"enforce_durations" description:"Fail tests that take longer than their expected_duration, rather than just warning about them."`
+		FlakyPolicy            string  `long:"flaky_policy" choice:"default" choice:"majority" default:"default" description:"How many runs of a test must pass. majority passes tests that succeed in more than half their runs."`
+		TestFilter             string  `long:"test_filter" description:"Regex selecting which test cases to run within each test target."`
+		HermeticEnv            bool    `long:"hermetic_env" description:"Unset all environment variables in tests except Please's own and those in their pass_env."`
+		ShowOutput             bool    `short:"s" long:"show_output" description:"Always show output of tests, even on success."`
+		RepeatUntilFailure     int     `long:"repeat_until_failure" description:"Run each test up to this many times, stopping at the first failure. Useful to reproduce rare flakes."`
+		Args                   struct {
 			Targets []core.BuildLabel `positional-arg-name:"targets" required:"true" description:"Targets to watch the sources of for changes"`
 		} `positional-args:"true" required:"true"`
 	} `command:"watch" description:"Watches sources of targets for changes and rebuilds them"`
@@ -233,11 +298,13 @@ var opts struct {
 			} `positional-args:"true" required:"true"`
 		} `command:"reverseDeps" alias:"revdeps" description:"Queries all the reverse dependencies of a target."`
 		SomePath struct {
+			All  bool `long:"all" description:"Print every dependency on any path between the two targets, not just one path"`
 			Args struct {
 				Target1 core.BuildLabel `positional-arg-name:"target1" description:"First build target" required:"true"`
 				Target2 core.BuildLabel `positional-arg-name:"target2" description:"Second build target" required:"true"`
 			} `positional-args:"true" required:"true"`
 		} `command:"somepath" description:"Queries for a path between two targets"`
+		GraphLint  struct{} `command:"graphlint" description:"Checks the whole graph for missing dependencies, missing inputs and visibility violations without building anything"`
 		AllTargets struct {
 			Hidden bool `long:"hidden" description:"Show hidden targets as well"`
 			Args   struct {
@@ -246,6 +313,7 @@ var opts struct {
 		} `command:"alltargets" description:"Lists all targets in the graph"`
 		Print struct {
 			Fields []string `short:"f" long:"field" description:"Individual fields to print of the target"`
+			JSON   bool     `long:"json" description:"Print the fully resolved attributes of each target as JSON"`
 			Args   struct {
 				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to print" required:"true"`
 			} `positional-args:"true" required:"true"`
@@ -265,6 +333,12 @@ var opts struct {
 				Files []string `positional-arg-name:"files" description:"Files to query affected tests for"`
 			} `positional-args:"true"`
 		} `command:"affectedtargets" description:"Prints any targets affected by a set of files."`
+		AffectedTests struct {
+			Files []string `short:"f" long:"files" description:"Files to query affected tests for. Pass - to read them from stdin."`
+			Args  struct {
+				Files []string `positional-arg-name:"files" description:"Files to query affected tests for"`
+			} `positional-args:"true"`
+		} `command:"affectedtests" description:"Prints any test targets transitively affected by a set of files."`
 		Input struct {
 			Args struct {
 				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to display inputs for" required:"true"`
@@ -286,6 +360,10 @@ var opts struct {
 				Files []string `positional-arg-name:"files" description:"Files to query targets responsible for"`
 			} `positional-args:"true"`
 		} `command:"whatoutputs" description:"Prints out target(s) responsible for outputting provided file(s)"`
+		Flakes struct {
+			Top    int           `long:"top" default:"10" description:"Number of targets to show. 0 shows all of them."`
+			Window time.Duration `long:"window" default:"168h" description:"How far back in the history to look."`
+		} `command:"flakes" description:"Prints the test targets that have been flaky most often recently."`
 	} `command:"query" description:"Queries information about the build graph"`
 }
 
@@ -293,6 +371,11 @@ var opts struct {
 // Functions are called after args are parsed and return true for success.
 var buildFunctions = map[string]func() bool{
 	"build": func() bool {
+		if opts.Build.Plan {
+			return runQuery(true, opts.Build.Args.Targets, func(state *core.BuildState) {
+				build.PrintPlan(state, build.Plan(state, state.ExpandOriginalTargets()))
+			})
+		}
 		success, _ := runBuild(opts.Build.Args.Targets, true, false)
 		return success
 	},
@@ -317,11 +400,47 @@ var buildFunctions = map[string]func() bool{
 		return success
 	},
 	"test": func() bool {
+		if len(opts.Test.MergeResults) > 0 {
+			test.MergeResultsFilesOrDie(opts.Test.MergeResults, opts.Test.TestResultsFile)
+			return true
+		}
 		os.RemoveAll(opts.Test.TestResultsFile)
 		targets := testTargets(opts.Test.Args.Target, opts.Test.Args.Args)
-		success, state := runBuild(targets, true, true)
+		var graph *core.BuildGraph
+		if opts.Test.OnlyChanged || opts.Test.Since != "" {
+			if targets, graph = changedTestTargets(targets); len(targets) == 0 {
+				log.Warning("No tests are affected by local changes")
+				return true
+			}
+		}
+		if opts.Test.LastFailed {
+			lastFailed, err := test.ReadLastFailed(test.LastFailedFile)
+			if err != nil {
+				log.Fatalf("Failed to read the failed tests from the last run: %s", err)
+			} else if lastFailed == nil {
+				log.Error("Can't find the results of a previous run of plz test")
+				return false
+			} else if len(lastFailed.Targets) == 0 {
+				log.Warning("All tests passed in the last run, there's nothing to rerun")
+				return true
+			}
+			targets = lastFailedTargets(lastFailed)
+		}
+		success, state := runBuildOnGraph(targets, graph, true, true)
 		test.WriteResultsToFileOrDie(state.Graph, opts.Test.TestResultsFile)
-		return success || opts.Test.FailingTestsOk
+		if err := test.WriteLastFailed(state, test.LastFailedFile); err != nil {
+			log.Warning("Failed to record failed tests: %s", err)
+		}
+		if err := test.AppendFlakyHistory(state.Graph, test.FlakyHistoryFile, time.Now()); err != nil {
+			log.Warning("Failed to write test history: %s", err)
+		}
+		if opts.Test.Output == "json" {
+			test.WriteJSONResultsOrDie(state, os.Stdout)
+		}
+		if success && opts.Test.FlakyExitCode != nil && test.AnyFlakes(state) {
+			exitCode = *opts.Test.FlakyExitCode
+		}
+		return success || (opts.Test.FailingTestsOk && !anyBuildFailures(state))
 	},
 	"cover": func() bool {
 		if opts.BuildFlags.Config != "" {
@@ -331,18 +450,37 @@ var buildFunctions = map[string]func() bool{
 		}
 		os.RemoveAll(opts.Cover.TestResultsFile)
 		os.RemoveAll(opts.Cover.CoverageResultsFile)
+		if opts.Cover.CoverageReportFile != "" {
+			os.RemoveAll(opts.Cover.CoverageReportFile)
+		}
 		targets := testTargets(opts.Cover.Args.Target, opts.Cover.Args.Args)
 		success, state := runBuild(targets, true, true)
 		test.WriteResultsToFileOrDie(state.Graph, opts.Cover.TestResultsFile)
+		if err := test.AppendFlakyHistory(state.Graph, test.FlakyHistoryFile, time.Now()); err != nil {
+			log.Warning("Failed to write test history: %s", err)
+		}
+		if opts.Cover.Output == "json" {
+			test.WriteJSONResultsOrDie(state, os.Stdout)
+		}
 		test.AddOriginalTargetsToCoverage(state, opts.Cover.IncludeAllFiles)
 		test.RemoveFilesFromCoverage(state.Coverage, state.Config.Cover.ExcludeExtension)
 		test.WriteCoverageToFileOrDie(state.Coverage, opts.Cover.CoverageResultsFile)
+		if opts.Cover.CoverageReportFile != "" {
+			test.WriteCoverageReportOrDie(state.Coverage, opts.Cover.CoverageReportFile, opts.Cover.CoverageReportFormat)
+		}
 		if opts.Cover.LineCoverageReport {
 			output.PrintLineCoverageReport(state, opts.Cover.IncludeFile)
 		} else if !opts.Cover.NoCoverageReport {
 			output.PrintCoverage(state, opts.Cover.IncludeFile)
 		}
-		return success || opts.Cover.FailingTestsOk
+		if coverage := test.TotalCoverage(state.Coverage); float64(coverage) < opts.Cover.CoverageThreshold {
+			log.Error("Combined coverage is %0.1f%%, below the threshold of %0.1f%%", coverage, opts.Cover.CoverageThreshold)
+			return false
+		}
+		if success && opts.Cover.FlakyExitCode != nil && test.AnyFlakes(state) {
+			exitCode = *opts.Cover.FlakyExitCode
+		}
+		return success || (opts.Cover.FailingTestsOk && !anyBuildFailures(state))
 	},
 	"run": func() bool {
 		if success, state := runBuild([]core.BuildLabel{opts.Run.Args.Target}, true, false); success {
@@ -383,6 +521,10 @@ var buildFunctions = map[string]func() bool{
 		}
 		return false
 	},
+	"cache gc": func() bool {
+		clean.GcDirCache(config, uint64(opts.Cache.Gc.MaxSize))
+		return true
+	},
 	"watch": func() bool {
 		success, state := runBuild(opts.Watch.Args.Targets, false, false)
 		if success {
@@ -450,18 +592,32 @@ var buildFunctions = map[string]func() bool{
 		return runQuery(true,
 			[]core.BuildLabel{opts.Query.SomePath.Args.Target1, opts.Query.SomePath.Args.Target2},
 			func(state *core.BuildState) {
-				query.QuerySomePath(state.Graph, opts.Query.SomePath.Args.Target1, opts.Query.SomePath.Args.Target2)
+				query.QuerySomePath(state.Graph, opts.Query.SomePath.Args.Target1, opts.Query.SomePath.Args.Target2, opts.Query.SomePath.All)
 			},
 		)
 	},
+	"graphlint": func() bool {
+		problems := 0
+		success := runQuery(false, core.WholeGraph, func(state *core.BuildState) {
+			problems = query.GraphLint(state.Graph)
+		})
+		return success && problems == 0
+	},
 	"alltargets": func() bool {
 		return runQuery(true, opts.Query.AllTargets.Args.Targets, func(state *core.BuildState) {
 			query.QueryAllTargets(state.Graph, state.ExpandOriginalTargets(), opts.Query.AllTargets.Hidden)
 		})
 	},
 	"print": func() bool {
+		if opts.Query.Print.JSON && len(opts.Query.Print.Fields) > 0 {
+			log.Fatalf("--json and --field can't be used together")
+		}
 		return runQuery(false, opts.Query.Print.Args.Targets, func(state *core.BuildState) {
-			query.Print(state.Graph, state.ExpandOriginalTargets(), opts.Query.Print.Fields)
+			if opts.Query.Print.JSON {
+				query.PrintJSON(state, state.ExpandOriginalTargets())
+			} else {
+				query.Print(state.Graph, state.ExpandOriginalTargets(), opts.Query.Print.Fields)
+			}
 		})
 	},
 	"affectedtargets": func() bool {
@@ -477,6 +633,15 @@ var buildFunctions = map[string]func() bool{
 			query.QueryAffectedTargets(state.Graph, files, opts.BuildFlags.Include, opts.BuildFlags.Exclude, opts.Query.AffectedTargets.Tests, !opts.Query.AffectedTargets.Intransitive)
 		})
 	},
+	"affectedtests": func() bool {
+		files := append(opts.Query.AffectedTests.Files, opts.Query.AffectedTests.Args.Files...)
+		return runQuery(true, core.WholeGraph, func(state *core.BuildState) {
+			if len(files) == 1 && files[0] == "-" {
+				files = utils.ReadAllStdin()
+			}
+			query.QueryAffectedTests(state.Graph, files, opts.BuildFlags.Include, opts.BuildFlags.Exclude)
+		})
+	},
 	"input": func() bool {
 		return runQuery(true, opts.Query.Input.Args.Targets, func(state *core.BuildState) {
 			query.QueryTargetInputs(state.Graph, state.ExpandOriginalTargets())
@@ -507,7 +672,7 @@ var buildFunctions = map[string]func() bool{
 			os.Exit(0) // Don't do anything for empty completion, it's normally too slow.
 		}
 		labels, parseLabels, hidden := query.QueryCompletionLabels(config, fragments, core.RepoRoot)
-		if success, state := Please(parseLabels, config, false, false, false); success {
+		if success, state := Please(parseLabels, config, false, false, false, nil); success {
 			binary := opts.Query.Completions.Cmd == "run"
 			test := opts.Query.Completions.Cmd == "test" || opts.Query.Completions.Cmd == "cover"
 			query.QueryCompletions(state.Graph, labels, binary, test, hidden)
@@ -523,6 +688,10 @@ var buildFunctions = map[string]func() bool{
 			query.QueryGraph(state.Graph, state.ExpandOriginalTargets())
 		})
 	},
+	"flakes": func() bool {
+		query.QueryFlakes(test.FlakyHistoryFile, opts.Query.Flakes.Top, time.Now().Add(-opts.Query.Flakes.Window))
+		return true
+	},
 	"whatoutputs": func() bool {
 		files := opts.Query.WhatOutputs.Args.Files
 		return runQuery(true, core.WholeGraph, func(state *core.BuildState) {
@@ -573,7 +742,12 @@ func please(tid int, state *core.BuildState, parsePackageOnly bool, include, exc
 		case core.Build, core.SubincludeBuild:
 			build.Build(tid, state, label)
 		case core.Test:
+			// Any resources the test needs (e.g. GPUs) must be free before it can run.
+			if !state.AdmitTest(label) {
+				continue // It gets requeued when they're released.
+			}
 			test.Test(tid, state, label)
+			state.ReleaseTest(label)
 		}
 		state.TaskDone()
 	}
@@ -604,7 +778,9 @@ func newCache(config *core.Configuration) core.Cache {
 	return cache.NewCache(config)
 }
 
-func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput, shouldBuild, shouldTest bool) (bool, *core.BuildState) {
+// Please runs a build of the given targets. If graph is non-nil it's a graph that a previous
+// call has already parsed, which is reused rather than parsing everything again.
+func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput, shouldBuild, shouldTest bool, graph *core.BuildGraph) (bool, *core.BuildState) {
 	if opts.BuildFlags.NumThreads > 0 {
 		config.Please.NumThreads = opts.BuildFlags.NumThreads
 	} else if config.Please.NumThreads <= 0 {
@@ -616,12 +792,32 @@ func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput,
 	if opts.BuildFlags.Config != "" {
 		config.Build.Config = opts.BuildFlags.Config
 	}
+	if len(opts.BuildFlags.Resources) > 0 {
+		config.Build.Resources = opts.BuildFlags.Resources
+	}
+	resources, err := core.ParseResources(config.Build.Resources)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
 	c := newCache(config)
 	state := core.NewBuildState(config.Please.NumThreads, c, opts.OutputFlags.Verbosity, config)
+	if graph != nil {
+		// Targets that were only parsed last time need to be activated again this time round;
+		// anything that was actually built (e.g. subincludes) stays that way.
+		for _, target := range graph.AllTargets() {
+			target.SyncUpdateState(core.Semiactive, core.Inactive)
+		}
+		state.Graph = graph
+	}
 	state.VerifyHashes = !opts.FeatureFlags.NoHashVerification
-	state.NumTestRuns = opts.Test.NumRuns + opts.Cover.NumRuns            // Only one of these can be passed.
+	state.NumTestRuns = opts.Test.NumRuns + opts.Cover.NumRuns + opts.Watch.NumRuns // Only one of these can be passed.
+	state.RepeatUntilFailure = opts.Test.RepeatUntilFailure + opts.Watch.RepeatUntilFailure
+	if state.RepeatUntilFailure > 0 && state.NumTestRuns > 0 {
+		log.Fatalf("--repeat_until_failure and --num_runs can't be used together")
+	}
 	state.TestArgs = append(opts.Test.Args.Args, opts.Cover.Args.Args...) // Similarly here.
 	state.NeedCoverage = !opts.Cover.Args.Target.IsEmpty()
+	state.Resources = core.NewResourcePool(resources)
 	state.NeedBuild = shouldBuild
 	state.NeedTests = shouldTest
 	state.NeedHashesOnly = len(opts.Hash.Args.Targets) > 0
@@ -629,8 +825,36 @@ func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput,
 	state.PrepareShell = opts.Build.Shell
 	state.CleanWorkdirs = !opts.FeatureFlags.KeepWorkdirs
 	state.ForceRebuild = len(opts.Rebuild.Args.Targets) > 0
-	state.ShowTestOutput = opts.Test.ShowOutput || opts.Cover.ShowOutput
+	state.WhyRebuild = opts.BuildFlags.WhyRebuild
+	state.ShowTestOutput = opts.Test.ShowOutput || opts.Cover.ShowOutput || opts.Watch.ShowOutput
+	state.StreamTestOutput = opts.Test.StreamOutput || opts.Cover.StreamOutput
+	state.FlakyTimeoutMultiplier = math.Max(opts.Test.FlakyTimeoutMultiplier, math.Max(opts.Cover.FlakyTimeoutMultiplier, opts.Watch.FlakyTimeoutMultiplier))
+	state.FailFastFlakes = opts.Test.FailFastFlakes || opts.Cover.FailFastFlakes || opts.Watch.FailFastFlakes
+	state.EnforceDurations = opts.Test.EnforceDurations || opts.Cover.EnforceDurations || opts.Watch.EnforceDurations
+	state.FlakyMajority = opts.Test.FlakyPolicy == "majority" || opts.Cover.FlakyPolicy == "majority" || opts.Watch.FlakyPolicy == "majority"
+	state.HermeticTestEnv = opts.Test.HermeticEnv || opts.Cover.HermeticEnv || opts.Watch.HermeticEnv
+	state.NumTestShards = opts.Test.NumShards + opts.Cover.NumShards
+	state.TestShardIndex = opts.Test.ShardIndex + opts.Cover.ShardIndex
+	if state.NumTestShards > 0 && (state.TestShardIndex < 0 || state.TestShardIndex >= state.NumTestShards) {
+		log.Fatalf("Invalid --shard_index %d; must be between 0 and %d", state.TestShardIndex, state.NumTestShards-1)
+	}
+	state.TestFilter = opts.Test.TestFilter + opts.Cover.TestFilter + opts.Watch.TestFilter
+	if _, err := regexp.Compile(state.TestFilter); err != nil {
+		log.Fatalf("Invalid --test_filter: %s", err)
+	}
+	if opts.Test.TestSeed != nil {
+		state.TestSeed = *opts.Test.TestSeed
+	} else if opts.Cover.TestSeed != nil {
+		state.TestSeed = *opts.Cover.TestSeed
+	} else if shouldTest {
+		state.TestSeed = rand.New(rand.NewSource(time.Now().UnixNano())).Int63()
+		log.Notice("Using test seed %d", state.TestSeed)
+	}
 	state.ShowAllOutput = opts.OutputFlags.ShowAllOutput
+	state.AuditSandbox = opts.BuildFlags.AuditSandbox
+	if state.Nice = opts.BuildFlags.Nice; state.Nice < 0 || state.Nice > 19 {
+		log.Fatalf("Invalid --nice %d; must be between 0 and 19", state.Nice)
+	}
 	state.SetIncludeAndExclude(opts.BuildFlags.Include, opts.BuildFlags.Exclude)
 	metrics.InitFromConfig(config)
 	// Acquire the lock before we start building
@@ -659,7 +883,7 @@ func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput,
 	}()
 	// Draw stuff to the screen while there are still results coming through.
 	shouldRun := !opts.Run.Args.Target.IsEmpty()
-	success := output.MonitorState(state, config.Please.NumThreads, !prettyOutput, opts.BuildFlags.KeepGoing, shouldBuild, shouldTest, shouldRun, opts.Build.ShowStatus, opts.OutputFlags.TraceFile)
+	success := output.MonitorState(state, config.Please.NumThreads, !prettyOutput, opts.BuildFlags.KeepGoing, shouldBuild, shouldTest, shouldRun, opts.Build.ShowStatus, opts.OutputFlags.TraceFile, opts.OutputFlags.EventSocket)
 	metrics.Stop()
 	build.StopWorkers()
 	if c != nil {
@@ -707,6 +931,59 @@ func testTargets(target core.BuildLabel, args []string) []core.BuildLabel {
 	}
 }
 
+// lastFailedTargets returns the tests that failed in the last run of plz test. They're run with
+// the same flakiness settings as they were then, unless this run sets its own.
+func lastFailedTargets(lastFailed *test.LastFailed) []core.BuildLabel {
+	if opts.Test.NumRuns == 0 {
+		opts.Test.NumRuns = lastFailed.NumRuns
+	}
+	if opts.Test.FlakyPolicy == "default" && lastFailed.FlakyMajority {
+		opts.Test.FlakyPolicy = "majority"
+	}
+	return lastFailed.Labels()
+}
+
+// anyBuildFailures returns true if any target failed to build. This can only happen for
+// tests with --keep_going, and --failing_tests_ok shouldn't override it.
+func anyBuildFailures(state *core.BuildState) bool {
+	for _, target := range state.Graph.AllTargets() {
+		if target.State() == core.Failed {
+			return true
+		}
+	}
+	return false
+}
+
+// changedTestTargets returns the tests within the given targets that are affected by files
+// changed in the working tree since the revision given by --since (or HEAD for --only_changed).
+// It also returns the graph it parsed to find them, so it doesn't need parsing again to test them.
+func changedTestTargets(targets []core.BuildLabel) ([]core.BuildLabel, *core.BuildGraph) {
+	since := opts.Test.Since
+	if since == "" {
+		since = "HEAD"
+	}
+	files, deleted, err := utils.ChangedFiles(since)
+	if err != nil {
+		log.Fatalf("Failed to determine changed files: %s", err)
+	}
+	log.Debug("Changed files since %s: %s; deleted: %s", since, files, deleted)
+	success, state := runBuild(core.WholeGraph, false, false)
+	if !success {
+		os.Exit(1)
+	}
+	affected := query.AffectedTargets(state.Graph, files, deleted, opts.BuildFlags.Include, opts.BuildFlags.Exclude, true, true)
+	ret := []core.BuildLabel{}
+	for _, label := range affected {
+		for _, target := range targets {
+			if target.Includes(label) {
+				ret = append(ret, label)
+				break
+			}
+		}
+	}
+	return ret, state.Graph
+}
+
 // readConfig sets various things up and reads the initial configuration.
 func readConfig(forceUpdate bool) *core.Configuration {
 	if opts.FeatureFlags.NoHashVerification {
@@ -731,23 +1008,57 @@ func readConfig(forceUpdate bool) *core.Configuration {
 // Runs the actual build
 // Which phases get run are controlled by shouldBuild and shouldTest.
 func runBuild(targets []core.BuildLabel, shouldBuild, shouldTest bool) (bool, *core.BuildState) {
+	return runBuildOnGraph(targets, nil, shouldBuild, shouldTest)
+}
+
+// runBuildOnGraph is like runBuild but reuses a graph that's already been parsed, if it's non-nil.
+func runBuildOnGraph(targets []core.BuildLabel, graph *core.BuildGraph, shouldBuild, shouldTest bool) (bool, *core.BuildState) {
 	if len(targets) == 0 {
 		targets = core.InitialPackage()
 	}
 	pretty := prettyOutput(opts.OutputFlags.InteractiveOutput, opts.OutputFlags.PlainOutput, opts.OutputFlags.Verbosity)
-	return Please(targets, config, pretty, shouldBuild, shouldTest)
+	return Please(targets, config, pretty, shouldBuild, shouldTest, graph)
 }
 
 // activeCommand returns the name of the currently active command.
+// Subcommands of plz cache are qualified with it since otherwise plz cache gc would clash with plz gc.
 func activeCommand(command *flags.Command) string {
 	if command.Active != nil {
+		if command.Active.Name == "cache" && command.Active.Active != nil {
+			return "cache " + command.Active.Active.Name
+		}
 		return activeCommand(command.Active)
 	}
 	return command.Name
 }
 
+// splitRunArgs splits off anything after -- for plz run parallel / sequential, which take multiple
+// targets so can't tell where they end and the arguments to pass to them begin.
+func splitRunArgs(args []string) ([]string, []string) {
+	for i := 1; i < len(args)-1; i++ {
+		if args[i] == "run" && (args[i+1] == "parallel" || args[i+1] == "sequential") {
+			for j := i + 2; j < len(args); j++ {
+				if args[j] == "--" {
+					return args[:j], args[j+1:]
+				}
+			}
+			break
+		}
+	}
+	return args, nil
+}
+
+// checkFlakyExitCode dies if --flaky_exit_code was given a value that would make flaky tests
+// indistinguishable from ones that passed or failed.
+func checkFlakyExitCode(code *int) {
+	if code != nil && (*code == 0 || *code == failureExitCode) {
+		log.Fatalf("--flaky_exit_code can't be %d; 0 is used when all tests pass and %d when any fail", *code, failureExitCode)
+	}
+}
+
 func main() {
-	parser, extraArgs, flagsErr := cli.ParseFlags("Please", &opts, os.Args)
+	args, runArgs := splitRunArgs(os.Args)
+	parser, extraArgs, flagsErr := cli.ParseFlags("Please", &opts, args)
 	// Note that we must leave flagsErr for later, because it may be affected by aliases.
 	if opts.OutputFlags.Version {
 		fmt.Printf("Please version %s\n", core.PleaseVersion)
@@ -758,7 +1069,7 @@ func main() {
 	} else if opts.OutputFlags.NoColour {
 		output.SetColouredOutput(false)
 	}
-	if opts.OutputFlags.ShowAllOutput {
+	if opts.OutputFlags.ShowAllOutput || opts.Test.StreamOutput || opts.Cover.StreamOutput {
 		opts.OutputFlags.PlainOutput = true
 	}
 	// Init logging, but don't do file output until we've chdir'd.
@@ -772,7 +1083,7 @@ func main() {
 		command = "completions"
 	} else if command == "init" {
 		if flagsErr != nil { // This error otherwise doesn't get checked until later.
-			cli.ParseFlagsFromArgsOrDie("Please", core.PleaseVersion.String(), &opts, os.Args)
+			cli.ParseFlagsFromArgsOrDie("Please", core.PleaseVersion.String(), &opts, args)
 		}
 		// If we're running plz init then we obviously don't expect to read a config file.
 		utils.InitConfig(opts.Init.Dir, opts.Init.BazelCompatibility)
@@ -815,13 +1126,17 @@ func main() {
 	// Now we've read the config file, we may need to re-run the parser; the aliases in the config
 	// can affect how we parse otherwise illegal flag combinations.
 	if flagsErr != nil || len(extraArgs) > 0 {
-		argv := strings.Join(os.Args[1:], " ")
+		argv := strings.Join(args[1:], " ")
 		for k, v := range config.Aliases {
 			argv = strings.Replace(argv, k, v, 1)
 		}
-		parser = cli.ParseFlagsFromArgsOrDie("Please", core.PleaseVersion.String(), &opts, strings.Fields(os.Args[0]+" "+argv))
+		parser = cli.ParseFlagsFromArgsOrDie("Please", core.PleaseVersion.String(), &opts, strings.Fields(args[0]+" "+argv))
 		command = activeCommand(parser.Command)
 	}
+	opts.Run.Parallel.Args = append(opts.Run.Parallel.Args, runArgs...)
+	opts.Run.Sequential.Args = append(opts.Run.Sequential.Args, runArgs...)
+	checkFlakyExitCode(opts.Test.FlakyExitCode)
+	checkFlakyExitCode(opts.Cover.FlakyExitCode)
 
 	if opts.ProfilePort != 0 {
 		go func() {
@@ -840,6 +1155,8 @@ func main() {
 	}
 
 	if !buildFunctions[command]() {
-		os.Exit(7) // Something distinctive, is sometimes useful to identify this externally.
+		os.Exit(failureExitCode)
+	} else if exitCode != 0 {
+		os.Exit(exitCode)
 	}
 }
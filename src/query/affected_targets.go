@@ -1,29 +1,60 @@
 package query
 
-import "core"
-import "fmt"
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"core"
+)
 
 // QueryAffectedTargets walks over the build graph and identifies all targets that have a transitive
 // dependency on the given set of files.
 // Targets are filtered by given include / exclude labels and if 'tests' is true only
 // test targets will be returned.
 func QueryAffectedTargets(graph *core.BuildGraph, files, include, exclude []string, tests, transitive bool) {
+	for _, label := range AffectedTargets(graph, files, nil, include, exclude, tests, transitive) {
+		fmt.Printf("%s\n", label)
+	}
+}
+
+// QueryAffectedTests prints all test targets that have a transitive dependency on the given set of files.
+// It warns about any of the files that aren't known to the build graph, since they can't affect any tests.
+func QueryAffectedTests(graph *core.BuildGraph, files, include, exclude []string) {
+	for _, file := range unownedFiles(graph, files) {
+		log.Warning("%s is not an input to any target; it won't affect any tests", file)
+	}
+	for _, label := range AffectedTargets(graph, files, nil, include, exclude, true, true) {
+		fmt.Printf("%s\n", label)
+	}
+}
+
+// AffectedTargets returns all targets that have a transitive dependency on the given set of files.
+// Files that have been deleted no longer belong to any target, so they pessimistically invalidate
+// every target in the package that contained them.
+// Targets are filtered in the same way as QueryAffectedTargets.
+func AffectedTargets(graph *core.BuildGraph, files, deleted, include, exclude []string, tests, transitive bool) []core.BuildLabel {
 	affectedTargets := make(chan *core.BuildTarget, 100)
 	done := make(chan bool)
+	ret := []core.BuildLabel{}
 
 	filePaths := map[string]bool{}
 	for _, file := range files {
 		filePaths[file] = true
 	}
+	deletedPackages := map[string]bool{}
+	for _, file := range deleted {
+		filePaths[file] = true
+		if pkg := owningPackage(graph, file); pkg != nil {
+			deletedPackages[pkg.Name] = true
+		}
+	}
 
 	// Check all the targets to see if any own one of these files
 	go func() {
 		for _, target := range graph.AllTargets() {
-			for _, source := range target.AllSourcePaths(graph) {
-				if _, present := filePaths[source]; present {
-					affectedTargets <- target
-					break
-				}
+			if anyPathAffected(target.AllSourcePaths(graph), filePaths) || anyDataAffected(graph, target, files) {
+				affectedTargets <- target
 			}
 		}
 		done <- true
@@ -40,15 +71,13 @@ func QueryAffectedTargets(graph *core.BuildGraph, files, include, exclude []stri
 			}
 		}
 		for _, pkg := range graph.PackageMap() {
-			if _, present := filePaths[pkg.Filename]; present {
+			if _, present := filePaths[pkg.Filename]; present || deletedPackages[pkg.Name] {
 				invalidatePackage(pkg)
 			} else {
 				for _, subinclude := range pkg.Subincludes {
-					for _, source := range graph.TargetOrDie(subinclude).AllSourcePaths(graph) {
-						if _, present := filePaths[source]; present {
-							invalidatePackage(pkg)
-							break
-						}
+					if anyPathAffected(graph.TargetOrDie(subinclude).AllSourcePaths(graph), filePaths) {
+						invalidatePackage(pkg)
+						break
 					}
 				}
 			}
@@ -56,15 +85,86 @@ func QueryAffectedTargets(graph *core.BuildGraph, files, include, exclude []stri
 		done <- true
 	}()
 
-	go handleAffectedTargets(graph, affectedTargets, done, include, exclude, tests, transitive)
+	go handleAffectedTargets(graph, affectedTargets, done, include, exclude, tests, transitive, &ret)
 
 	<-done
 	<-done
 	close(affectedTargets)
 	<-done
+	return ret
+}
+
+// anyPathAffected returns true if any of the given paths are in the set of affected files.
+func anyPathAffected(paths []string, filePaths map[string]bool) bool {
+	for _, p := range paths {
+		if filePaths[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// anyDataAffected returns true if any of the target's data files are affected.
+// Data can be directories, in which case any file beneath them counts. Data that comes from
+// other targets is already covered since those are dependencies.
+func anyDataAffected(graph *core.BuildGraph, target *core.BuildTarget, files []string) bool {
+	for _, datum := range target.Data {
+		if datum.Label() != nil {
+			continue
+		}
+		for _, p := range datum.Paths(graph) {
+			for _, file := range files {
+				if file == p || strings.HasPrefix(file, p+"/") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// unownedFiles returns any of the given files that aren't sources, data or build files of anything in the graph.
+func unownedFiles(graph *core.BuildGraph, files []string) []string {
+	owned := map[string]bool{}
+	for _, pkg := range graph.PackageMap() {
+		owned[pkg.Filename] = true
+	}
+	ret := []string{}
+	for _, target := range graph.AllTargets() {
+		for _, src := range target.AllSourcePaths(graph) {
+			owned[src] = true
+		}
+	}
+	for _, file := range files {
+		if !owned[file] && !anyTargetHasData(graph, file) {
+			ret = append(ret, file)
+		}
+	}
+	return ret
+}
+
+// anyTargetHasData returns true if the given file is part of the data of any target in the graph.
+func anyTargetHasData(graph *core.BuildGraph, file string) bool {
+	for _, target := range graph.AllTargets() {
+		if anyDataAffected(graph, target, []string{file}) {
+			return true
+		}
+	}
+	return false
+}
+
+// owningPackage returns the package in the graph that would have contained the given file, or nil if there isn't one.
+func owningPackage(graph *core.BuildGraph, file string) *core.Package {
+	for dir := path.Dir(file); ; dir = path.Dir(dir) {
+		if dir == "." {
+			return graph.Package("")
+		} else if pkg := graph.Package(dir); pkg != nil {
+			return pkg
+		}
+	}
 }
 
-func handleAffectedTargets(graph *core.BuildGraph, affectedTargets <-chan *core.BuildTarget, done chan<- bool, include, exclude []string, tests, transitive bool) {
+func handleAffectedTargets(graph *core.BuildGraph, affectedTargets <-chan *core.BuildTarget, done chan<- bool, include, exclude []string, tests, transitive bool, ret *[]core.BuildLabel) {
 	seenTargets := map[*core.BuildTarget]bool{}
 
 	var inner func(*core.BuildTarget)
@@ -77,7 +177,7 @@ func handleAffectedTargets(graph *core.BuildGraph, affectedTargets <-chan *core.
 				}
 			}
 			if (!tests || target.IsTest) && target.ShouldInclude(include, exclude) {
-				fmt.Printf("%s\n", target.Label)
+				*ret = append(*ret, target.Label)
 			}
 		}
 	}
@@ -0,0 +1,78 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func makeAffectedTarget(g *core.BuildGraph, pkgName, name string, isTest bool, srcs, data []string, deps ...*core.BuildTarget) *core.BuildTarget {
+	t := core.NewBuildTarget(core.ParseBuildLabel("//"+pkgName+":"+name, ""))
+	t.IsTest = isTest
+	for _, src := range srcs {
+		t.AddSource(core.FileLabel{File: src, Package: pkgName})
+	}
+	for _, datum := range data {
+		t.Data = append(t.Data, core.FileLabel{File: datum, Package: pkgName})
+	}
+	for _, dep := range deps {
+		t.AddDependency(dep.Label)
+	}
+	p := g.Package(pkgName)
+	if p == nil {
+		p = core.NewPackage(pkgName)
+		p.Filename = pkgName + "/BUILD"
+		g.AddPackage(p)
+	}
+	p.Targets[name] = t
+	g.AddTarget(t)
+	for _, dep := range deps {
+		g.AddDependency(t.Label, dep.Label)
+	}
+	return t
+}
+
+func affectedGraph() *core.BuildGraph {
+	core.State = &core.BuildState{}
+	graph := core.NewGraph()
+	lib := makeAffectedTarget(graph, "src/lib", "lib", false, []string{"lib.go"}, nil)
+	makeAffectedTarget(graph, "src/lib", "lib_test", true, []string{"lib_test.go"}, nil, lib)
+	makeAffectedTarget(graph, "src/data", "data_test", true, []string{"data_test.go"}, []string{"test_data"})
+	makeAffectedTarget(graph, "src/other", "other_test", true, []string{"other_test.go"}, nil)
+	return graph
+}
+
+func TestAffectedTargetsTransitive(t *testing.T) {
+	graph := affectedGraph()
+	labels := AffectedTargets(graph, []string{"src/lib/lib.go"}, nil, nil, nil, true, true)
+	assert.Equal(t, []core.BuildLabel{core.ParseBuildLabel("//src/lib:lib_test", "")}, labels)
+}
+
+func TestAffectedTargetsData(t *testing.T) {
+	graph := affectedGraph()
+	labels := AffectedTargets(graph, []string{"src/data/test_data/input.txt"}, nil, nil, nil, true, true)
+	assert.Equal(t, []core.BuildLabel{core.ParseBuildLabel("//src/data:data_test", "")}, labels)
+}
+
+func TestAffectedTargetsDeletedFiles(t *testing.T) {
+	graph := affectedGraph()
+	labels := AffectedTargets(graph, nil, []string{"src/other/removed.go"}, nil, nil, true, true)
+	assert.Equal(t, []core.BuildLabel{core.ParseBuildLabel("//src/other:other_test", "")}, labels)
+}
+
+func TestAffectedTargetsFilegroup(t *testing.T) {
+	graph := affectedGraph()
+	fg := makeAffectedTarget(graph, "src/fg", "fg", false, []string{"file.txt"}, nil)
+	fg.IsFilegroup = true
+	makeAffectedTarget(graph, "src/fg", "fg_test", true, []string{"fg_test.go"}, nil, fg)
+	labels := AffectedTargets(graph, []string{"src/fg/file.txt"}, nil, nil, nil, true, true)
+	assert.Equal(t, []core.BuildLabel{core.ParseBuildLabel("//src/fg:fg_test", "")}, labels)
+}
+
+func TestUnownedFiles(t *testing.T) {
+	graph := affectedGraph()
+	files := []string{"src/lib/lib.go", "src/lib/BUILD", "src/data/test_data/input.txt", "src/lib/README.md"}
+	assert.Equal(t, []string{"src/lib/README.md"}, unownedFiles(graph, files))
+}
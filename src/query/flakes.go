@@ -0,0 +1,72 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"test"
+)
+
+// A flakyTarget summarises the history of a single test target.
+type flakyTarget struct {
+	Label               string
+	Invocations, Flakes int
+	Runs, Successes     int
+}
+
+// QueryFlakes prints the top n test targets that have flaked most often since the given time,
+// according to the given history file.
+func QueryFlakes(filename string, n int, since time.Time) {
+	records, err := test.ReadFlakyHistory(filename)
+	if err != nil {
+		log.Fatalf("Failed to read test history: %s", err)
+	}
+	targets := flakiestTargets(records, n, since)
+	if len(targets) == 0 {
+		fmt.Printf("No flaky tests since %s\n", since.Format(time.RFC3339))
+		return
+	}
+	for _, target := range targets {
+		fmt.Printf("%s: flaky in %d of %d invocations, passed %d of %d runs\n",
+			target.Label, target.Flakes, target.Invocations, target.Successes, target.Runs)
+	}
+}
+
+// flakiestTargets returns the top n targets that flaked most often in the given records.
+// Targets that never flaked aren't returned at all.
+func flakiestTargets(records []test.FlakyRecord, n int, since time.Time) []flakyTarget {
+	m := map[string]*flakyTarget{}
+	for _, record := range records {
+		if record.Timestamp.Before(since) {
+			continue
+		}
+		target, present := m[record.Label]
+		if !present {
+			target = &flakyTarget{Label: record.Label}
+			m[record.Label] = target
+		}
+		target.Invocations++
+		target.Runs += record.Runs
+		target.Successes += record.Successes
+		if record.Result == "flaky" {
+			target.Flakes++
+		}
+	}
+	targets := []flakyTarget{}
+	for _, target := range m {
+		if target.Flakes > 0 {
+			targets = append(targets, *target)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Flakes != targets[j].Flakes {
+			return targets[i].Flakes > targets[j].Flakes
+		}
+		return targets[i].Label < targets[j].Label
+	})
+	if n > 0 && len(targets) > n {
+		targets = targets[:n]
+	}
+	return targets
+}
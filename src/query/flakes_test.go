@@ -0,0 +1,33 @@
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"test"
+)
+
+func TestFlakiestTargets(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	records := []test.FlakyRecord{
+		{Label: "//src:a", Timestamp: now, Runs: 3, Successes: 1, Result: "flaky"},
+		{Label: "//src:b", Timestamp: now, Runs: 3, Successes: 2, Result: "flaky"},
+		{Label: "//src:b", Timestamp: now, Runs: 2, Successes: 1, Result: "flaky"},
+		{Label: "//src:c", Timestamp: now, Runs: 1, Successes: 1, Result: "pass"},
+		{Label: "//src:a", Timestamp: now, Runs: 1, Successes: 1, Result: "pass"},
+		{Label: "//src:d", Timestamp: now.Add(-48 * time.Hour), Runs: 3, Successes: 1, Result: "flaky"},
+	}
+	targets := flakiestTargets(records, 10, now.Add(-24*time.Hour))
+	assert.Equal(t, []flakyTarget{
+		{Label: "//src:b", Invocations: 2, Flakes: 2, Runs: 5, Successes: 3},
+		{Label: "//src:a", Invocations: 2, Flakes: 1, Runs: 4, Successes: 2},
+	}, targets)
+	// Limiting the number of targets keeps the flakiest ones.
+	targets = flakiestTargets(records, 1, now.Add(-24*time.Hour))
+	assert.Equal(t, 1, len(targets))
+	assert.Equal(t, "//src:b", targets[0].Label)
+	// A wider window picks up the older ones too.
+	assert.Equal(t, 3, len(flakiestTargets(records, 0, now.Add(-72*time.Hour))))
+}
@@ -0,0 +1,105 @@
+package query
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"core"
+)
+
+// A lintProblem is a single structural problem with a target in the build graph.
+type lintProblem struct {
+	Label   core.BuildLabel
+	Message string
+}
+
+// GraphLint checks the graph for structural problems that would otherwise only show up partway
+// through a build, and prints all of them. It returns the number of problems found.
+// The graph doesn't need to have been built, or even fully resolved.
+func GraphLint(graph *core.BuildGraph) int {
+	problems := lintGraph(graph)
+	targets := map[core.BuildLabel]bool{}
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", problem.Label, problem.Message)
+		targets[problem.Label] = true
+	}
+	if len(problems) == 0 {
+		fmt.Printf("No problems found in %d targets\n", len(graph.AllTargets()))
+	} else {
+		fmt.Printf("\nFound %d problems in %d of %d targets\n", len(problems), len(targets), len(graph.AllTargets()))
+	}
+	return len(problems)
+}
+
+// lintGraph returns all the problems with targets in the graph, ordered by target.
+func lintGraph(graph *core.BuildGraph) []lintProblem {
+	problems := []lintProblem{}
+	for _, target := range graph.AllTargets() {
+		problems = append(problems, lintTarget(graph, target)...)
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Label.Less(problems[j].Label) })
+	return problems
+}
+
+// lintTarget returns the problems with a single target: dependencies that don't exist or that it
+// can't use, inputs that don't exist, and outputs that are missing from plz-out when some of its
+// other outputs are there. A target whose outputs are all missing just hasn't been built, so
+// nothing is reported for those.
+func lintTarget(graph *core.BuildGraph, target *core.BuildTarget) []lintProblem {
+	problems := []lintProblem{}
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, lintProblem{Label: target.Label, Message: fmt.Sprintf(format, args...)})
+	}
+	for _, label := range target.DeclaredDependencies() {
+		dep := graph.Target(label)
+		if dep == nil {
+			if graph.Package(label.PackageName) == nil {
+				report("depends on %s, but there's no package %s", label, label.PackageName)
+			} else {
+				report("depends on %s, which doesn't exist", label)
+			}
+		} else if !target.CanSee(dep) {
+			report("depends on %s, which isn't visible to it", label)
+		} else if dep.TestOnly && !(target.IsTest || target.TestOnly) {
+			report("depends on %s, which is marked test_only", label)
+		}
+	}
+	inputs := append(target.AllSources(), target.Data...)
+	inputs = append(inputs, target.AllTools()...)
+	for _, input := range inputs {
+		switch input := input.(type) {
+		case core.FileLabel:
+			if p := path.Join(input.Package, input.File); !core.PathExists(p) {
+				report("has input %s, which doesn't exist", p)
+			}
+		case core.NamedOutputLabel:
+			if dep := graph.Target(input.BuildLabel); dep != nil && dep.PostBuildFunction == 0 {
+				if named := dep.DeclaredNamedOutputs(); len(named) == 0 {
+					report("refers to outputs named %s of %s, which doesn't declare any named outputs", input.Output, input.BuildLabel)
+				} else if _, present := named[input.Output]; !present {
+					report("refers to outputs named %s of %s, which only declares %s", input.Output, input.BuildLabel, strings.Join(dep.DeclaredOutputNames(), ", "))
+				}
+			}
+		}
+	}
+	// We can't know for sure which outputs a rule will produce without building it, but if some
+	// of them are in plz-out and others aren't, most likely a previous build failed partway
+	// through moving them because the rule didn't produce the rest.
+	if !target.IsFilegroup {
+		missing := []string{}
+		outputs := target.Outputs()
+		for _, out := range outputs {
+			if !core.PathExists(path.Join(target.OutDir(), out)) {
+				missing = append(missing, out)
+			}
+		}
+		if len(missing) > 0 && len(missing) < len(outputs) {
+			for _, out := range missing {
+				report("declares output %s, which is missing from plz-out although its other outputs are there", out)
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,70 @@
+package query
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestLintGraph(t *testing.T) {
+	core.State = &core.BuildState{}
+	graph := core.NewGraph()
+	graph.AddPackage(core.NewPackage("src/query"))
+	graph.AddPackage(core.NewPackage("src/core"))
+	lib := addTarget(graph, "//src/core:lib")
+	private := addTarget(graph, "//src/core:private")
+	testOnly := addTarget(graph, "//src/core:test_only")
+	lib.Visibility = core.WholeGraph
+	testOnly.Visibility = core.WholeGraph
+	testOnly.TestOnly = true
+	lib.AddNamedOutput("srcs", "lib.go")
+
+	target := addTarget(graph, "//src/query:query")
+	target.AddDependency(lib.Label)
+	target.AddDependency(private.Label)
+	target.AddDependency(testOnly.Label)
+	target.AddDependency(core.ParseBuildLabel("//src/core:missing", ""))
+	target.AddDependency(core.ParseBuildLabel("//src/missing:missing", ""))
+	target.AddSource(core.FileLabel{File: "graphlint.go", Package: "src/query"})
+	target.AddSource(core.FileLabel{File: "missing.go", Package: "src/query"})
+	target.AddSource(core.NamedOutputLabel{BuildLabel: lib.Label, Output: "srcs"})
+	target.AddSource(core.NamedOutputLabel{BuildLabel: lib.Label, Output: "hdrs"})
+	target.AddSource(core.NamedOutputLabel{BuildLabel: private.Label, Output: "srcs"})
+	ok := addTarget(graph, "//src/query:ok")
+	ok.AddDependency(lib.Label)
+
+	assert.Equal(t, []lintProblem{
+		{Label: target.Label, Message: "depends on //src/core:missing, which doesn't exist"},
+		{Label: target.Label, Message: "depends on //src/core:private, which isn't visible to it"},
+		{Label: target.Label, Message: "depends on //src/core:test_only, which is marked test_only"},
+		{Label: target.Label, Message: "depends on //src/missing:missing, but there's no package src/missing"},
+		{Label: target.Label, Message: "has input src/query/missing.go, which doesn't exist"},
+		{Label: target.Label, Message: "refers to outputs named hdrs of //src/core:lib, which only declares srcs"},
+		{Label: target.Label, Message: "refers to outputs named srcs of //src/core:private, which doesn't declare any named outputs"},
+	}, lintGraph(graph))
+}
+
+func TestLintGraphPartialOutputs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "graphlint_test")
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	graph := core.NewGraph()
+	target := addTarget(graph, "//src/query:outs")
+	target.AddOutput("out1")
+	target.AddOutput("out2")
+	assert.Equal(t, 0, len(lintGraph(graph)), "Nothing is reported if the target isn't built at all")
+
+	os.MkdirAll(target.OutDir(), core.DirPermissions)
+	ioutil.WriteFile(path.Join(target.OutDir(), "out1"), nil, 0644)
+	assert.Equal(t, []lintProblem{
+		{Label: target.Label, Message: "declares output out2, which is missing from plz-out although its other outputs are there"},
+	}, lintGraph(graph))
+}
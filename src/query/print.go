@@ -200,6 +200,11 @@ func (p *printer) genericPrint(v reflect.Value) (string, bool) {
 		return fmt.Sprintf("%d", v.Int()), v.Int() > 0
 	case reflect.Uintptr:
 		return "<python ref>", v.Uint() != 0
+	case reflect.Ptr:
+		if v.IsNil() {
+			return "", false
+		}
+		return p.genericPrint(v.Elem())
 	case reflect.Struct, reflect.Interface:
 		if stringer, ok := v.Interface().(fmt.Stringer); ok {
 			return p.quote(stringer.String()), true
@@ -0,0 +1,217 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"core"
+	"test"
+)
+
+// PrintJSON prints the fully resolved attributes of the given targets as a JSON object
+// keyed by their labels. Unlike Print this is intended for consumption by other tools.
+func PrintJSON(state *core.BuildState, labels []core.BuildLabel) {
+	b, err := json.MarshalIndent(makeJSONPrintTargets(state, labels), "", "    ")
+	if err != nil {
+		log.Fatalf("Failed to serialise JSON: %s\n", err)
+	}
+	fmt.Println(string(b))
+}
+
+// JSONPrintTarget is the representation of a single target printed by 'plz query print --json'.
+// Everything in it reflects the target after parsing, so globs are expanded, selects are resolved
+// and so forth. Fields are only ever added to this, never renamed or removed.
+type JSONPrintTarget struct {
+	// The target's full label, e.g. //src/core:core.
+	Label string `json:"label"`
+	// One of build_rule, filegroup or hash_filegroup.
+	Type string `json:"type"`
+	// Sources of the target; files relative to its package, or build labels.
+	Sources []string `json:"srcs,omitempty"`
+	// Named sources, keyed by name.
+	NamedSources map[string][]string `json:"named_srcs,omitempty"`
+	// Runtime data of the target, in the same form as its sources.
+	Data []string `json:"data,omitempty"`
+	// Outputs of the target, relative to its output directory.
+	Outputs []string `json:"outs,omitempty"`
+	// Named outputs, keyed by name.
+	NamedOutputs map[string][]string `json:"named_outs,omitempty"`
+	// Optional outputs; these may be globs.
+	OptionalOutputs []string `json:"optional_outs,omitempty"`
+	// Declared dependencies, excluding any added implicitly (e.g. by sources or tools).
+	Deps []string `json:"deps,omitempty"`
+	// Dependencies exported to anything depending on this target.
+	ExportedDeps []string `json:"exported_deps,omitempty"`
+	// Tools used to build the target; build labels or system binaries.
+	Tools []string `json:"tools,omitempty"`
+	// Labels of the targets this one is visible to, or PUBLIC if it's visible to everything.
+	Visibility []string `json:"visibility,omitempty"`
+	Labels     []string `json:"labels,omitempty"`
+	Requires   []string `json:"requires,omitempty"`
+	// What this target provides for each language it's required by, keyed by language.
+	Provides map[string]string `json:"provides,omitempty"`
+	// Command used to build the target under the current build config.
+	Command  string   `json:"cmd,omitempty"`
+	Binary   bool     `json:"binary,omitempty"`
+	TestOnly bool     `json:"test_only,omitempty"`
+	NoCache  bool     `json:"no_cache,omitempty"`
+	Hashes   []string `json:"hashes,omitempty"`
+	Licences []string `json:"licences,omitempty"`
+	// Timeout for building the target in seconds, or absent if it uses the default.
+	Timeout float64 `json:"timeout,omitempty"`
+	// Niceness the target is built and tested at, from 0 (normal) to 19.
+	Priority int `json:"priority,omitempty"`
+	// How the target is run as a test; absent if it isn't one.
+	Test *JSONTestConfig `json:"test,omitempty"`
+}
+
+// JSONTestConfig describes how a test target will be run.
+type JSONTestConfig struct {
+	// Command used to run the test under the current build config.
+	Command string `json:"cmd,omitempty"`
+	// Timeout for a single run in seconds, or absent if it uses the default.
+	Timeout float64 `json:"timeout,omitempty"`
+	// Timeout in seconds given to the test for each of its cases, if that's been set.
+	PerCaseTimeout float64 `json:"per_case_timeout,omitempty"`
+	// How long a run is expected to take in seconds, if that's been set.
+	ExpectedDuration float64 `json:"expected_duration,omitempty"`
+	// The flakiness declared on the target (i.e. how many times it may be run).
+	Flakiness int `json:"flaky,omitempty"`
+	// If set, failed runs are only retried if their output matches this regex.
+	FlakyRetryRegex string `json:"flaky_retry_regex,omitempty"`
+	// Total number of times the test will be run, taking into account its flakiness and any flags.
+	NumRuns int `json:"num_runs"`
+	// How many of those runs must pass for the test to pass.
+	SuccessesRequired int  `json:"successes_required"`
+	ExpectedToFail    bool `json:"expected_to_fail,omitempty"`
+	Sandbox           bool `json:"sandbox,omitempty"`
+	Container         bool `json:"container,omitempty"`
+	Shuffle           bool `json:"shuffle,omitempty"`
+	Sharding          bool `json:"test_sharding,omitempty"`
+	// True if data files are symlinked into the test directory rather than copied.
+	SymlinkData bool `json:"symlink_data,omitempty"`
+	// Named resources the test needs while it runs, and how much of each.
+	Resources map[string]int `json:"resources,omitempty"`
+	// Environment variables passed through to the test from the environment plz is run in.
+	PassEnv []string `json:"pass_env,omitempty"`
+	// True if the test is only judged on its exit code, not on any results it writes.
+	NoOutput bool `json:"no_test_output,omitempty"`
+	// Extra files the test writes that are kept as outputs.
+	Outputs []string `json:"outs,omitempty"`
+	// Labels of the targets run before and after all runs of the test.
+	Setup    string `json:"setup,omitempty"`
+	Teardown string `json:"teardown,omitempty"`
+}
+
+func makeJSONPrintTargets(state *core.BuildState, labels []core.BuildLabel) map[string]JSONPrintTarget {
+	ret := make(map[string]JSONPrintTarget, len(labels))
+	for _, label := range labels {
+		ret[label.String()] = makeJSONPrintTarget(state, state.Graph.TargetOrDie(label))
+	}
+	return ret
+}
+
+func makeJSONPrintTarget(state *core.BuildState, target *core.BuildTarget) JSONPrintTarget {
+	t := JSONPrintTarget{
+		Label:           target.Label.String(),
+		Type:            "build_rule",
+		Sources:         inputStrings(target.Sources),
+		Data:            inputStrings(target.Data),
+		Outputs:         target.DeclaredOutputs(),
+		OptionalOutputs: target.OptionalOutputs,
+		Deps:            labelStrings(target.DeclaredDependenciesStrict()),
+		ExportedDeps:    labelStrings(target.ExportedDependencies()),
+		Tools:           inputStrings(target.AllTools()),
+		Labels:          target.Labels,
+		Requires:        target.Requires,
+		Command:         target.GetCommand(),
+		Binary:          target.IsBinary,
+		TestOnly:        target.TestOnly,
+		NoCache:         target.NoCache,
+		Hashes:          target.Hashes,
+		Licences:        target.Licences,
+		Timeout:         target.BuildTimeout.Seconds(),
+		Priority:        target.Priority,
+	}
+	if target.IsHashFilegroup {
+		t.Type = "hash_filegroup"
+	} else if target.IsFilegroup {
+		t.Type = "filegroup"
+	}
+	if len(target.NamedSources) > 0 {
+		t.NamedSources = make(map[string][]string, len(target.NamedSources))
+		for name, srcs := range target.NamedSources {
+			t.NamedSources[name] = inputStrings(srcs)
+		}
+	}
+	if outs := target.DeclaredNamedOutputs(); len(outs) > 0 {
+		t.NamedOutputs = outs
+	}
+	if len(target.Visibility) == 1 && target.Visibility[0] == core.WholeGraph[0] {
+		t.Visibility = []string{"PUBLIC"}
+	} else {
+		t.Visibility = labelStrings(target.Visibility)
+	}
+	if len(target.Provides) > 0 {
+		t.Provides = make(map[string]string, len(target.Provides))
+		for lang, label := range target.Provides {
+			t.Provides[lang] = label.String()
+		}
+	}
+	if target.IsTest {
+		numRuns, successesRequired := test.NumRuns(state, target)
+		t.Test = &JSONTestConfig{
+			Command:           target.GetTestCommand(),
+			Timeout:           target.TestTimeout.Seconds(),
+			PerCaseTimeout:    target.PerCaseTimeout.Seconds(),
+			ExpectedDuration:  target.ExpectedDuration.Seconds(),
+			Flakiness:         target.Flakiness,
+			FlakyRetryRegex:   target.FlakyRetryRegex,
+			NumRuns:           numRuns,
+			SuccessesRequired: successesRequired,
+			ExpectedToFail:    target.ExpectedToFail,
+			Sandbox:           target.TestSandbox,
+			Container:         target.Containerise,
+			Shuffle:           target.Shuffle,
+			Sharding:          target.TestSharding,
+			SymlinkData:       target.SymlinkData,
+			Resources:         target.Resources,
+			PassEnv:           target.PassEnv,
+			NoOutput:          target.NoTestOutput,
+			Outputs:           target.TestOutputs,
+		}
+		if target.TestSetup != nil {
+			t.Test.Setup = target.TestSetup.String()
+		}
+		if target.TestTeardown != nil {
+			t.Test.Teardown = target.TestTeardown.String()
+		}
+	}
+	return t
+}
+
+// inputStrings converts a slice of build inputs to their string representations.
+func inputStrings(inputs []core.BuildInput) []string {
+	if len(inputs) == 0 {
+		return nil
+	}
+	ret := make([]string, len(inputs))
+	for i, input := range inputs {
+		ret[i] = input.String()
+	}
+	return ret
+}
+
+// labelStrings converts a slice of build labels to strings, in sorted order.
+func labelStrings(labels []core.BuildLabel) []string {
+	if len(labels) == 0 {
+		return nil
+	}
+	ret := make([]string, len(labels))
+	for i, label := range labels {
+		ret[i] = label.String()
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,117 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestPrintJSONBuildRule(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	dep := addTarget(state.Graph, "//src/query:json_dep")
+	target := addTarget(state.Graph, "//src/query:json_rule")
+	target.AddSource(core.FileLabel{File: "file1.go", Package: "src/query"})
+	target.AddSource(core.FileLabel{File: "file2.go", Package: "src/query"})
+	target.AddOutput("out.go")
+	target.AddDependency(dep.Label)
+	target.Command = "cp $SRCS $OUTS"
+	target.Labels = []string{"go"}
+	target.Visibility = core.WholeGraph
+	target.BuildTimeout = 30 * time.Second
+
+	targets := makeJSONPrintTargets(state, []core.BuildLabel{target.Label})
+	assert.Equal(t, map[string]JSONPrintTarget{
+		"//src/query:json_rule": {
+			Label:      "//src/query:json_rule",
+			Type:       "build_rule",
+			Sources:    []string{"file1.go", "file2.go"},
+			Outputs:    []string{"out.go"},
+			Deps:       []string{"//src/query:json_dep"},
+			Visibility: []string{"PUBLIC"},
+			Labels:     []string{"go"},
+			Command:    "cp $SRCS $OUTS",
+			Timeout:    30,
+		},
+	}, targets)
+}
+
+func TestPrintJSONFilegroup(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	target := addTarget(state.Graph, "//src/query:json_filegroup")
+	target.AddSource(core.FileLabel{File: "file.txt", Package: "src/query"})
+	target.AddNamedSource("srcs", core.FileLabel{File: "named.txt", Package: "src/query"})
+	target.IsFilegroup = true
+	target.Visibility = []core.BuildLabel{core.ParseBuildLabel("//src/core:core", "")}
+
+	printed := makeJSONPrintTarget(state, target)
+	assert.Equal(t, "filegroup", printed.Type)
+	assert.Equal(t, []string{"file.txt"}, printed.Sources)
+	assert.Equal(t, map[string][]string{"srcs": {"named.txt"}}, printed.NamedSources)
+	assert.Equal(t, []string{"//src/core:core"}, printed.Visibility)
+	assert.Nil(t, printed.Test)
+
+	target.IsHashFilegroup = true
+	assert.Equal(t, "hash_filegroup", makeJSONPrintTarget(state, target).Type)
+}
+
+func TestPrintJSONTest(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	setup := addTarget(state.Graph, "//src/query:json_setup")
+	target := addTarget(state.Graph, "//src/query:json_test")
+	target.IsTest = true
+	target.IsBinary = true
+	target.TestCommand = "$TEST"
+	target.TestTimeout = 2 * time.Minute
+	target.Flakiness = 3
+	target.FlakyRetryRegex = "connection refused"
+	target.TestSetup = &setup.Label
+	target.SymlinkData = true
+	target.Priority = 10
+
+	printed := makeJSONPrintTarget(state, target)
+	assert.True(t, printed.Binary)
+	assert.Equal(t, 10, printed.Priority)
+	assert.Equal(t, &JSONTestConfig{
+		Command:           "$TEST",
+		Timeout:           120,
+		Flakiness:         3,
+		FlakyRetryRegex:   "connection refused",
+		NumRuns:           3,
+		SuccessesRequired: 1,
+		SymlinkData:       true,
+		Setup:             "//src/query:json_setup",
+	}, printed.Test)
+
+	// The effective number of runs takes the current flags into account.
+	state.FlakyMajority = true
+	printed = makeJSONPrintTarget(state, target)
+	assert.Equal(t, 3, printed.Test.NumRuns)
+	assert.Equal(t, 2, printed.Test.SuccessesRequired)
+}
+
+func TestPrintJSONSchema(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	target := addTarget(state.Graph, "//src/query:json_schema")
+	target.AddOutput("out.txt")
+	target.IsTest = true
+	target.Command = "touch $OUT"
+
+	b, err := json.Marshal(makeJSONPrintTargets(state, []core.BuildLabel{target.Label}))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+        "//src/query:json_schema": {
+            "label": "//src/query:json_schema",
+            "type": "build_rule",
+            "outs": ["out.txt"],
+            "cmd": "touch $OUT",
+            "test": {
+                "num_runs": 1,
+                "successes_required": 1
+            }
+        }
+    }`, string(b))
+}
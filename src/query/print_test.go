@@ -141,6 +141,14 @@ func TestPrintFields(t *testing.T) {
 	assert.Equal(t, "go\ntest\n", s)
 }
 
+func TestPrintTestSetup(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/query:test_print_test_setup", ""))
+	setup := core.ParseBuildLabel("//src/query:setup", "")
+	target.TestSetup = &setup
+	assert.Equal(t, "//src/query:setup\n", testPrintFields(target, []string{"test_setup"}))
+	assert.Equal(t, "", testPrintFields(target, []string{"test_teardown"}))
+}
+
 func testPrint(target *core.BuildTarget) string {
 	var buf bytes.Buffer
 	newPrinter(&buf, target, 2).PrintTarget()
@@ -15,6 +15,8 @@
 //   'affectedtargets': 'plz query affectedtargets path/to/changed_file.py'
 //            produces a list of test targets which have a transitive dependency on
 //            the given file.
+//   'affectedtests': 'plz query affectedtests --files=-' reads a list of changed files from
+//            stdin and produces a list of test targets which are transitively affected by them.
 //   'input': 'plz query input //src:label' produces a list of all the files
 //            (including transitive deps) that are referenced by this rule.
 //   'output': 'plz query output //src:label' produces a list of all the files
@@ -1,12 +1,18 @@
 package query
 
 import "fmt"
+import "sort"
 
 import "core"
 
 // QuerySomePath finds and returns a path between two targets.
 // Useful for a "why on earth do I depend on this thing" type query.
-func QuerySomePath(graph *core.BuildGraph, label1 core.BuildLabel, label2 core.BuildLabel) {
+// If all is true it prints every dependency on any path between them instead of just one path.
+func QuerySomePath(graph *core.BuildGraph, label1 core.BuildLabel, label2 core.BuildLabel, all bool) {
+	if all {
+		queryAllPaths(graph, label1, label2)
+		return
+	}
 	// Awkwardly either target can be :all. This is an extremely useful idiom though so despite
 	// trickiness is worth supporting.
 	// Of course this calculation is also quadratic but it's not very obvious how to avoid that.
@@ -61,3 +67,70 @@ func printSomePath(graph *core.BuildGraph, target1, target2 *core.BuildTarget) b
 	}
 	return false
 }
+
+// queryAllPaths prints all the dependencies on any path between two targets, in either direction.
+func queryAllPaths(graph *core.BuildGraph, label1, label2 core.BuildLabel) {
+	targets1 := expandAllTargets(graph, label1)
+	targets2 := expandAllTargets(graph, label2)
+	edges := allPaths(targets1, targets2)
+	if len(edges) == 0 {
+		edges = allPaths(targets2, targets1)
+	}
+	if len(edges) == 0 {
+		fmt.Printf("Couldn't find any dependency path between %s and %s\n", label1, label2)
+		return
+	}
+	fmt.Printf("Found paths:\n")
+	for _, edge := range edges {
+		fmt.Printf("  %s -> %s\n", edge[0], edge[1])
+	}
+}
+
+// expandAllTargets returns the target for a label, or all targets in its package if it's :all.
+func expandAllTargets(graph *core.BuildGraph, label core.BuildLabel) []*core.BuildTarget {
+	if !label.IsAllTargets() {
+		return []*core.BuildTarget{graph.TargetOrDie(label)}
+	}
+	targets := []*core.BuildTarget{}
+	for _, target := range graph.PackageOrDie(label.PackageName).Targets {
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// allPaths returns every dependency that's on some path from one of the targets in from to
+// one of the targets in to, as pairs of (dependent, dependency), sorted.
+func allPaths(from, to []*core.BuildTarget) [][2]core.BuildLabel {
+	dests := map[*core.BuildTarget]bool{}
+	for _, target := range to {
+		dests[target] = true
+	}
+	edges := [][2]core.BuildLabel{}
+	onPath := map[*core.BuildTarget]bool{}
+	var visit func(target *core.BuildTarget) bool
+	visit = func(target *core.BuildTarget) bool {
+		if result, present := onPath[target]; present {
+			return result
+		}
+		onPath[target] = false // The graph has no cycles by now, but still guard against them.
+		result := dests[target]
+		for _, dep := range target.Dependencies() {
+			if visit(dep) {
+				edges = append(edges, [2]core.BuildLabel{target.Label, dep.Label})
+				result = true
+			}
+		}
+		onPath[target] = result
+		return result
+	}
+	for _, target := range from {
+		visit(target)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i][0] != edges[j][0] {
+			return edges[i][0].Less(edges[j][0])
+		}
+		return edges[i][1].Less(edges[j][1])
+	})
+	return edges
+}
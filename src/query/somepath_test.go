@@ -0,0 +1,35 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestAllPaths(t *testing.T) {
+	graph := core.NewGraph()
+	a := addTarget(graph, "//package1:a")
+	b := addTarget(graph, "//package1:b")
+	c := addTarget(graph, "//package2:c")
+	d := addTarget(graph, "//package2:d")
+	e := addTarget(graph, "//package3:e")
+	addDep(graph, a, b)
+	addDep(graph, a, c)
+	addDep(graph, b, d)
+	addDep(graph, c, d)
+	addDep(graph, a, e) // Not on any path to d
+
+	expected := [][2]core.BuildLabel{
+		{a.Label, b.Label},
+		{a.Label, c.Label},
+		{b.Label, d.Label},
+		{c.Label, d.Label},
+	}
+	assert.Equal(t, expected, allPaths([]*core.BuildTarget{a}, []*core.BuildTarget{d}))
+	assert.Equal(t, 0, len(allPaths([]*core.BuildTarget{d}, []*core.BuildTarget{a})))
+	assert.Equal(t, 0, len(allPaths([]*core.BuildTarget{e}, []*core.BuildTarget{d})))
+	assert.Equal(t, [][2]core.BuildLabel{{b.Label, d.Label}, {c.Label, d.Label}},
+		allPaths([]*core.BuildTarget{c, b}, []*core.BuildTarget{d, e}))
+}
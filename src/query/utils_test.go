@@ -0,0 +1,18 @@
+// Helpers shared between the tests in this package.
+
+package query
+
+import "core"
+
+// addTarget adds a new target with the given label to the graph.
+func addTarget(graph *core.BuildGraph, label string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	graph.AddTarget(target)
+	return target
+}
+
+// addDep adds a dependency between two targets that are already in the graph.
+func addDep(graph *core.BuildGraph, target, dep *core.BuildTarget) {
+	target.AddDependency(dep.Label)
+	graph.AddDependency(target.Label, dep.Label)
+}
@@ -0,0 +1,133 @@
+// Support for managing a set of subprocesses that should all be stopped together.
+
+package run
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// stopGracePeriod is how long we give processes to exit after signalling them before killing them outright.
+// It's a variable so tests can shorten it.
+var stopGracePeriod = 5 * time.Second
+
+// A processGroup tracks a set of running subprocesses.
+// Once it's stopped, all of them are signalled and no more will be started.
+// Signals received by this process are forwarded to all of them so they don't get orphaned.
+type processGroup struct {
+	mutex   sync.Mutex
+	running map[*exec.Cmd]bool
+	stopped map[*exec.Cmd]bool
+	started []*exec.Cmd
+	stop    bool
+	signal  syscall.Signal
+	signals chan os.Signal
+	done    chan struct{}
+}
+
+// newProcessGroup returns a new processGroup. It must be closed once all its processes have finished.
+func newProcessGroup() *processGroup {
+	group := &processGroup{
+		running: map[*exec.Cmd]bool{},
+		stopped: map[*exec.Cmd]bool{},
+		signals: make(chan os.Signal, 1),
+		done:    make(chan struct{}),
+	}
+	signal.Notify(group.signals, syscall.SIGINT, syscall.SIGTERM)
+	go group.forwardSignals()
+	return group
+}
+
+// forwardSignals stops all the processes in the group with any signal that we receive.
+func (group *processGroup) forwardSignals() {
+	for {
+		select {
+		case sig := <-group.signals:
+			log.Warning("Received %s, stopping all targets", sig)
+			group.mutex.Lock()
+			group.signal = sig.(syscall.Signal)
+			group.mutex.Unlock()
+			group.stopWith(sig.(syscall.Signal))
+		case <-group.done:
+			return
+		}
+	}
+}
+
+// Start starts the given command as part of this group.
+// It returns false if the group has already been stopped, in which case the command isn't started.
+func (group *processGroup) Start(cmd *exec.Cmd) (bool, error) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	if group.stop {
+		return false, nil
+	} else if err := cmd.Start(); err != nil {
+		return true, err
+	}
+	group.running[cmd] = true
+	group.started = append(group.started, cmd)
+	return true, nil
+}
+
+// Remove removes a command from the group once it's finished.
+// It returns true if the group had stopped it.
+func (group *processGroup) Remove(cmd *exec.Cmd) bool {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	stopped := group.stopped[cmd]
+	delete(group.running, cmd)
+	delete(group.stopped, cmd)
+	return stopped
+}
+
+// Stop stops all the processes in the group. It's safe to call more than once.
+func (group *processGroup) Stop() {
+	group.stopWith(syscall.SIGTERM)
+}
+
+// stopWith stops all the processes in the group by sending them the given signal.
+// After the grace period the process groups of everything we started are killed, including
+// ones whose leader has already exited, so nothing they started is left behind.
+func (group *processGroup) stopWith(sig syscall.Signal) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	group.stop = true
+	for cmd := range group.running {
+		group.stopped[cmd] = true
+		signalGroup(cmd, sig)
+	}
+	time.AfterFunc(stopGracePeriod, func() {
+		group.mutex.Lock()
+		defer group.mutex.Unlock()
+		for _, cmd := range group.started {
+			if group.running[cmd] {
+				log.Warning("%s didn't exit after %s, killing it", cmd.Path, stopGracePeriod)
+			}
+			signalGroup(cmd, syscall.SIGKILL)
+		}
+	})
+}
+
+// Signal returns the signal that we received while the group was running, or 0 if there wasn't one.
+func (group *processGroup) Signal() syscall.Signal {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	return group.signal
+}
+
+// Close stops forwarding signals to the group.
+func (group *processGroup) Close() {
+	signal.Stop(group.signals)
+	close(group.done)
+}
+
+// signalGroup sends a signal to the process group of the given command, so anything it's started gets it too.
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) {
+	if err := syscall.Kill(-cmd.Process.Pid, sig); err != nil && err != syscall.ESRCH {
+		log.Warning("Failed to signal %s: %s", cmd.Path, err)
+	}
+}
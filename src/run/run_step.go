@@ -3,6 +3,7 @@
 package run
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"os/exec"
@@ -26,8 +27,13 @@ func Run(graph *core.BuildGraph, label core.BuildLabel, args []string) {
 }
 
 // Parallel runs a series of targets in parallel.
-// Returns true if all were successful.
+// Their output is interleaved on the console, prefixed with the label of the target it came from.
+// As soon as any of them exits (or fails to start), successfully or not, the rest are stopped.
+// Signals that we receive are forwarded to all of them.
+// Returns the exit code of the first one to fail, or 0 if none did.
 func Parallel(graph *core.BuildGraph, labels []core.BuildLabel, args []string, numTasks int, quiet bool) int {
+	group := newProcessGroup()
+	defer group.Close()
 	pool := NewGoroutinePool(numTasks)
 	var g errgroup.Group
 	for _, label := range labels {
@@ -36,16 +42,20 @@ func Parallel(graph *core.BuildGraph, labels []core.BuildLabel, args []string, n
 			var wg sync.WaitGroup
 			wg.Add(1)
 			pool.Submit(func() {
-				if e := run(graph, label, args, true, quiet); e != nil {
+				if e := runInGroup(graph, label, args, quiet, group); e != nil {
 					err = e
 				}
+				group.Stop()
 				wg.Done()
 			})
 			wg.Wait()
 			return
 		})
 	}
-	if err := g.Wait(); err != nil {
+	err := g.Wait()
+	if sig := group.Signal(); sig != 0 {
+		return 128 + int(sig) // Conventional exit code for something that was killed by a signal.
+	} else if err != nil {
 		log.Error("Command failed: %s", err)
 		return err.(*exitError).code
 	}
@@ -70,6 +80,64 @@ func Sequential(graph *core.BuildGraph, labels []core.BuildLabel, args []string,
 // If it's false this function never returns (because we either win or die; it's like
 // Game of Thrones except rather less glamorous).
 func run(graph *core.BuildGraph, label core.BuildLabel, args []string, fork, quiet bool) *exitError {
+	args = command(graph, label, args)
+	log.Info("Running target %s...", strings.Join(args, " "))
+	output.SetWindowTitle("plz run: " + strings.Join(args, " "))
+	if !fork {
+		// Plain 'plz run'. One way or another we never return from the following line.
+		must(syscall.Exec(args[0], args, os.Environ()), args)
+	}
+	// Run as a normal subcommand.
+	// Note that we don't connect stdin. It doesn't make sense for multiple processes.
+	cmd := exec.Command(args[0], args[1:]...) // args here don't include argv[0]
+	if !quiet {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		must(cmd.Start(), args)
+		err := cmd.Wait()
+		return toExitError(err, cmd, nil)
+	}
+	out, err := cmd.CombinedOutput()
+	return toExitError(err, cmd, out)
+}
+
+// runInGroup runs a single target as part of the given group, streaming its output unless quiet is true.
+// It returns nil without running anything if the group has already been stopped.
+func runInGroup(graph *core.BuildGraph, label core.BuildLabel, args []string, quiet bool, group *processGroup) *exitError {
+	args = command(graph, label, args)
+	log.Info("Running target %s...", strings.Join(args, " "))
+	cmd := exec.Command(args[0], args[1:]...)
+	// Put each one in its own process group so we can signal anything it starts as well.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var out bytes.Buffer
+	var stdout, stderr *core.LineStreamer
+	if quiet {
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+	} else {
+		stdout = core.NewLineStreamer(os.Stdout, label)
+		stderr = core.NewLineStreamer(os.Stderr, label)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+	}
+	if started, err := group.Start(cmd); !started {
+		return nil
+	} else if err != nil {
+		return &exitError{msg: fmt.Sprintf("Failed to start %s: %s", strings.Join(args, " "), err), code: 1}
+	}
+	err := cmd.Wait()
+	if !quiet {
+		stdout.Flush()
+		stderr.Flush()
+	}
+	if group.Remove(cmd) {
+		return nil // We killed it, so whatever it exited with isn't interesting.
+	}
+	return toExitError(err, cmd, out.Bytes())
+}
+
+// command returns the command line to run the given target with the given arguments.
+func command(graph *core.BuildGraph, label core.BuildLabel, args []string) []string {
 	target := graph.TargetOrDie(label)
 	if !target.IsBinary {
 		log.Fatalf("Target %s cannot be run; it's not marked as binary", label)
@@ -87,25 +155,7 @@ func run(graph *core.BuildGraph, label core.BuildLabel, args []string, fork, qui
 		}
 		splitCmd[0] = cmd
 	}
-	args = append(splitCmd, args...)
-	log.Info("Running target %s...", strings.Join(args, " "))
-	output.SetWindowTitle("plz run: " + strings.Join(args, " "))
-	if !fork {
-		// Plain 'plz run'. One way or another we never return from the following line.
-		must(syscall.Exec(splitCmd[0], args, os.Environ()), args)
-	}
-	// Run as a normal subcommand.
-	// Note that we don't connect stdin. It doesn't make sense for multiple processes.
-	cmd := exec.Command(splitCmd[0], args[1:]...) // args here don't include argv[0]
-	if !quiet {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		must(cmd.Start(), args)
-		err := cmd.Wait()
-		return toExitError(err, cmd, nil)
-	}
-	out, err := cmd.CombinedOutput()
-	return toExitError(err, cmd, out)
+	return append(splitCmd, args...)
 }
 
 // must dies if the given error is non-nil.
@@ -1,8 +1,16 @@
 package run
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -27,10 +35,58 @@ func TestParallel(t *testing.T) {
 	graph, labels1, labels2 := makeGraph()
 	code := Parallel(graph, labels1, nil, 5, false)
 	assert.Equal(t, 0, code)
-	code = Parallel(graph, labels2, nil, 5, true)
+	code = Parallel(graph, labels2[1:], nil, 5, true)
 	assert.Equal(t, 1, code)
 }
 
+func TestParallelStopsOthersOnFailure(t *testing.T) {
+	graph, _, labels := makeGraph()
+	labels = append(labels[1:], addSleepTarget(graph))
+	start := time.Now()
+	code := Parallel(graph, labels, nil, 5, true)
+	assert.Equal(t, 1, code)
+	assert.True(t, time.Since(start) < 10*time.Second, "sleep should have been stopped when false failed")
+}
+
+func TestParallelStopsOthersOnExit(t *testing.T) {
+	graph, labels, _ := makeGraph()
+	labels = append(labels, addSleepTarget(graph))
+	start := time.Now()
+	code := Parallel(graph, labels, nil, 5, true)
+	assert.Equal(t, 0, code, "sleep being stopped doesn't count as a failure")
+	assert.True(t, time.Since(start) < 10*time.Second, "sleep should have been stopped when true exited")
+}
+
+func TestStopKillsOrphanedProcesses(t *testing.T) {
+	stopGracePeriod = 10 * time.Millisecond
+	defer func() { stopGracePeriod = 5 * time.Second }()
+	group := newProcessGroup()
+	defer group.Close()
+	// This exits straight away, but leaves something behind in its process group.
+	cmd := exec.Command("sh", "-c", "sleep 60 > /dev/null & echo $!")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	started, err := group.Start(cmd)
+	assert.True(t, started)
+	assert.NoError(t, err)
+	assert.NoError(t, cmd.Wait())
+	group.Remove(cmd)
+	pid, err := strconv.Atoi(strings.TrimSpace(out.String()))
+	assert.NoError(t, err)
+	group.Stop()
+	for i := 0; i < 100 && processExists(pid); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, processExists(pid), "Orphaned process should have been killed")
+}
+
+// processExists returns true if the given process is still running (i.e. not a zombie).
+func processExists(pid int) bool {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	return err == nil && !strings.Contains(string(b), ") Z ")
+}
+
 func makeGraph() (*core.BuildGraph, []core.BuildLabel, []core.BuildLabel) {
 	state := core.NewBuildState(1, nil, 0, core.DefaultConfiguration())
 	target1 := core.NewBuildTarget(core.ParseBuildLabel("//:true", ""))
@@ -43,3 +99,11 @@ func makeGraph() (*core.BuildGraph, []core.BuildLabel, []core.BuildLabel) {
 	state.Graph.AddTarget(target2)
 	return state.Graph, []core.BuildLabel{target1.Label}, []core.BuildLabel{target1.Label, target2.Label}
 }
+
+func addSleepTarget(graph *core.BuildGraph) core.BuildLabel {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//:sleep", ""))
+	target.IsBinary = true
+	target.AddOutput("sleep")
+	graph.AddTarget(target)
+	return target.Label
+}
@@ -13,7 +13,7 @@ import (
 	"core"
 )
 
-func runContainerisedTest(state *core.BuildState, target *core.BuildTarget) ([]byte, error) {
+func runContainerisedTest(state *core.BuildState, target *core.BuildTarget, run int) ([]byte, error) {
 	testDir := path.Join(core.RepoRoot, target.TestDir())
 	replacedCmd := build.ReplaceTestSequences(target, target.GetTestCommand())
 	replacedCmd += " " + strings.Join(state.TestArgs, " ")
@@ -39,18 +39,20 @@ func runContainerisedTest(state *core.BuildState, target *core.BuildTarget) ([]b
 	} else {
 		command = append(command, state.Config.Docker.RunArgs...)
 	}
-	for _, env := range core.BuildEnvironment(state, target, true) {
+	for _, env := range testEnvironment(state, target, run) {
 		command = append(command, "-e", strings.Replace(env, testDir, "/tmp/test", -1))
 	}
 	replacedCmd = "mkdir -p /tmp/test && cp -r /tmp/test_in/* /tmp/test && cd /tmp/test && " + replacedCmd
 	command = append(command, "-v", testDir+":/tmp/test_in", "-w", "/tmp/test_in", containerName, "bash", "-o", "pipefail", "-c", replacedCmd)
 	log.Debug("Running containerised test %s: %s", target.Label, strings.Join(command, " "))
-	_, out, err := core.ExecWithTimeout(target, target.TestDir(), nil, target.TestTimeout, state.Config.Test.Timeout, state.ShowAllOutput, command)
+	stream, done := testOutputStream(state, target)
+	_, out, err := core.ExecWithTimeoutStreaming(target, target.TestDir(), nil, testTimeout(state, target, run), state.Config.Test.Timeout, stream, command)
+	done()
 	retrieveResultsAndRemoveContainer(target, cidfile, err == nil)
 	return out, err
 }
 
-func runPossiblyContainerisedTest(state *core.BuildState, target *core.BuildTarget) (out []byte, err error) {
+func runPossiblyContainerisedTest(state *core.BuildState, target *core.BuildTarget, run int) (out []byte, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("%s", r)
@@ -61,17 +63,17 @@ func runPossiblyContainerisedTest(state *core.BuildState, target *core.BuildTarg
 		if state.Config.Test.DefaultContainer == core.ContainerImplementationNone {
 			log.Warning("Target %s specifies that it should be tested in a container, but test "+
 				"containers are disabled in your .plzconfig.", target.Label)
-			return runTest(state, target)
+			return runTest(state, target, run)
 		}
-		out, err = runContainerisedTest(state, target)
+		out, err = runContainerisedTest(state, target, run)
 		if err != nil && state.Config.Docker.AllowLocalFallback {
 			log.Warning("Failed to run %s containerised: %s %s. Falling back to local version.",
 				target.Label, out, err)
-			return runTest(state, target)
+			return runTest(state, target, run)
 		}
 		return out, err
 	}
-	return runTest(state, target)
+	return runTest(state, target, run)
 }
 
 // retrieveResultsAndRemoveContainer copies the test.results file out of the Docker container and into
@@ -3,9 +3,11 @@
 package test
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -147,6 +149,65 @@ func WriteCoverageToFileOrDie(coverage core.TestCoverage, filename string) {
 	}
 }
 
+// WriteCoverageReportOrDie writes the combined coverage of all files to a file in either lcov
+// or Go coverprofile format, so it can be consumed by other tools. Dies on failure.
+func WriteCoverageReportOrDie(coverage core.TestCoverage, filename, format string) {
+	if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+		log.Fatalf("Failed to create directory for coverage report: %s", err)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Fatalf("Failed to write coverage report to %s: %s", filename, err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if format == "go" {
+		writeGoCoverage(w, coverage)
+	} else {
+		writeLcovCoverage(w, coverage)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Failed to write coverage report to %s: %s", filename, err)
+	}
+}
+
+// writeLcovCoverage writes coverage in the lcov tracefile format.
+func writeLcovCoverage(w io.Writer, coverage core.TestCoverage) {
+	for _, file := range coverage.OrderedFiles() {
+		lines := coverage.Files[file]
+		fmt.Fprintf(w, "SF:%s\n", file)
+		for i, line := range lines {
+			if line == core.Covered {
+				fmt.Fprintf(w, "DA:%d,1\n", i+1)
+			} else if line != core.NotExecutable {
+				fmt.Fprintf(w, "DA:%d,0\n", i+1)
+			}
+		}
+		covered, total := CountCoverage(lines)
+		fmt.Fprintf(w, "LF:%d\nLH:%d\nend_of_record\n", total, covered)
+	}
+}
+
+// writeGoCoverage writes coverage in the format produced by go test -coverprofile.
+// We only have line-level information, so each executable line becomes a single block.
+func writeGoCoverage(w io.Writer, coverage core.TestCoverage) {
+	fmt.Fprintf(w, "mode: set\n")
+	for _, file := range coverage.OrderedFiles() {
+		for i, line := range coverage.Files[file] {
+			if line == core.Covered {
+				fmt.Fprintf(w, "%s:%d.1,%d.1 1 1\n", file, i+1, i+2)
+			} else if line != core.NotExecutable {
+				fmt.Fprintf(w, "%s:%d.1,%d.1 1 0\n", file, i+1, i+2)
+			}
+		}
+	}
+}
+
+// TotalCoverage returns the percentage of coverable lines that are covered across all files.
+func TotalCoverage(coverage core.TestCoverage) float32 {
+	return getStats(coverage).TotalCoverage
+}
+
 // CountCoverage counts the number of lines covered and the total number coverable in a single file.
 func CountCoverage(lines []core.LineCoverage) (int, int) {
 	covered := 0
@@ -1,6 +1,7 @@
 package test
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -218,3 +219,19 @@ func TestIstanbulCoverage2(t *testing.T) {
 	assertLine(t, lines, 22, core.Covered)
 	assertLine(t, lines, 23, core.Covered)
 }
+
+func TestWriteLcovCoverage(t *testing.T) {
+	coverage := core.NewTestCoverage()
+	coverage.Files["src/test/a.go"] = []core.LineCoverage{core.NotExecutable, core.Covered, core.Uncovered}
+	var buf bytes.Buffer
+	writeLcovCoverage(&buf, coverage)
+	assert.Equal(t, "SF:src/test/a.go\nDA:2,1\nDA:3,0\nLF:2\nLH:1\nend_of_record\n", buf.String())
+}
+
+func TestWriteGoCoverage(t *testing.T) {
+	coverage := core.NewTestCoverage()
+	coverage.Files["src/test/a.go"] = []core.LineCoverage{core.NotExecutable, core.Covered, core.Uncovered}
+	var buf bytes.Buffer
+	writeGoCoverage(&buf, coverage)
+	assert.Equal(t, "mode: set\nsrc/test/a.go:2.1,3.1 1 1\nsrc/test/a.go:3.1,4.1 1 0\n", buf.String())
+}
@@ -0,0 +1,118 @@
+// Persistent history of test runs, used to find the flakiest tests over time.
+
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"core"
+)
+
+// FlakyHistoryFile is the file we append a record of each test run to.
+const FlakyHistoryFile = "plz-out/log/flaky_history.json"
+
+// A FlakyRecord records a single invocation of a test target.
+// The history file contains one of these per line.
+type FlakyRecord struct {
+	Label     string    `json:"target"`
+	Timestamp time.Time `json:"timestamp"`
+	Runs      int       `json:"runs"`
+	Successes int       `json:"successes"`
+	// One of "pass", "fail" or "flaky" (if it passed, but only after failing some runs).
+	Result string `json:"result"`
+}
+
+// AppendFlakyHistory appends a record for each test that was run in this build to the given file.
+// Tests whose results were cached aren't recorded since they weren't actually run.
+// It's safe to call this from multiple processes at once.
+func AppendFlakyHistory(graph *core.BuildGraph, filename string, now time.Time) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, target := range graph.AllTargets() {
+		if target.IsTest && !target.Results.Cached && len(target.Results.RunDurations) > 0 {
+			if err := encoder.Encode(flakyRecord(target, now)); err != nil {
+				return err
+			}
+		}
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// O_APPEND alone doesn't guarantee that large writes from different processes won't interleave.
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	_, err = f.Write(buf.Bytes())
+	return err
+}
+
+func flakyRecord(target *core.BuildTarget, now time.Time) FlakyRecord {
+	record := FlakyRecord{
+		Label:     target.Label.String(),
+		Timestamp: now,
+		Runs:      len(target.Results.RunDurations),
+		Successes: target.Results.SuccessfulRuns,
+		Result:    "pass",
+	}
+	// This goes on how the test was finally classified, not on the counts above; a test that
+	// passed some runs but not as many as it needed to has still failed.
+	if testFailed(target) {
+		record.Result = "fail"
+	} else if target.Results.Flakes > 0 {
+		record.Result = "flaky"
+	}
+	return record
+}
+
+// AnyFlakes returns true if any of the tests we were asked to run only passed after being retried.
+func AnyFlakes(state *core.BuildState) bool {
+	for _, label := range state.ExpandOriginalTargets() {
+		if target := state.Graph.Target(label); target != nil && target.IsTest && target.Results.Flakes > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadFlakyHistory reads all the records from the given history file.
+// A nonexistent file is not an error, it just has no history in it yet.
+func ReadFlakyHistory(filename string) ([]FlakyRecord, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		return nil, err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	records := []FlakyRecord{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := FlakyRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// Most likely a write that was interrupted. Carry on; the rest of the file will still be fine.
+			log.Warning("Ignoring malformed line in %s: %s", filename, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
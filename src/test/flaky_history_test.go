@@ -0,0 +1,105 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+const flakyHistoryTestFile = "plz-out/tmp/src/test/flaky_history.json"
+
+func TestFlakyHistoryRoundTrip(t *testing.T) {
+	os.RemoveAll(flakyHistoryTestFile)
+	graph := core.NewGraph()
+	graph.AddTarget(historyTarget("//src/test:passing", 1, 1, false))
+	graph.AddTarget(historyTarget("//src/test:flaky", 3, 2, false))
+	graph.AddTarget(historyTarget("//src/test:failing", 2, 0, false))
+	graph.AddTarget(historyTarget("//src/test:cached", 0, 0, true))
+	now := time.Unix(1500000000, 0).UTC()
+	assert.NoError(t, AppendFlakyHistory(graph, flakyHistoryTestFile, now))
+	assert.NoError(t, AppendFlakyHistory(graph, flakyHistoryTestFile, now.Add(time.Hour)))
+	records, err := ReadFlakyHistory(flakyHistoryTestFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, len(records))
+	results := map[string]string{}
+	for _, record := range records[:3] {
+		assert.Equal(t, now, record.Timestamp)
+		results[record.Label] = record.Result
+	}
+	assert.Equal(t, map[string]string{
+		"//src/test:passing": "pass",
+		"//src/test:flaky":   "flaky",
+		"//src/test:failing": "fail",
+	}, results)
+}
+
+func TestReadFlakyHistorySkipsMalformedLines(t *testing.T) {
+	os.MkdirAll("plz-out/tmp/src/test", core.DirPermissions)
+	contents := `{"target":"//src/test:a","runs":2,"successes":1,"result":"flaky"}
+{"target":"//src/te
+{"target":"//src/test:b","runs":1,"successes":1,"result":"pass"}
+`
+	assert.NoError(t, ioutil.WriteFile(flakyHistoryTestFile, []byte(contents), 0644))
+	records, err := ReadFlakyHistory(flakyHistoryTestFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "//src/test:b", records[1].Label)
+}
+
+func TestReadFlakyHistoryMissingFile(t *testing.T) {
+	records, err := ReadFlakyHistory("plz-out/tmp/src/test/doesnt_exist.json")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(records))
+}
+
+func TestFlakyRecordClassification(t *testing.T) {
+	now := time.Unix(1500000000, 0).UTC()
+	// Passed on a retry.
+	flaky := historyTarget("//src/test:flaky", 2, 1, false)
+	assert.Equal(t, "flaky", flakyRecord(flaky, now).Result)
+	// Passed once, but all three runs needed to pass.
+	strict := historyTarget("//src/test:strict", 3, 1, false)
+	strict.Results.Status = core.TargetTestFailed
+	assert.Equal(t, "fail", flakyRecord(strict, now).Result)
+	// Passed every run but something else failed it afterwards.
+	failed := historyTarget("//src/test:failed", 1, 1, false)
+	failed.Results.Failed = 1
+	assert.Equal(t, "fail", flakyRecord(failed, now).Result)
+}
+
+// historyTarget returns a test target that was run the given number of times. It's classified as
+// having passed if any of those succeeded, and any that didn't are counted as flakes.
+func historyTarget(label string, runs, successes int, cached bool) *core.BuildTarget {
+	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	target.IsTest = true
+	target.Results.Cached = cached
+	target.Results.SuccessfulRuns = successes
+	if successes > 0 {
+		target.Results.Status = core.TargetTested
+		target.Results.Flakes = runs - successes
+	} else {
+		target.Results.Status = core.TargetTestFailed
+	}
+	for i := 0; i < runs; i++ {
+		target.Results.RunDurations = append(target.Results.RunDurations, 1.0)
+	}
+	return target
+}
+
+func TestAnyFlakes(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	passing := historyTarget("//src/test:passing", 1, 1, false)
+	flaky := historyTarget("//src/test:flaky", 2, 1, false)
+	flaky.Results.Flakes = 1
+	state.Graph.AddTarget(passing)
+	state.Graph.AddTarget(flaky)
+	state.OriginalTargets = []core.BuildLabel{passing.Label}
+	assert.False(t, AnyFlakes(state))
+	state.OriginalTargets = []core.BuildLabel{passing.Label, flaky.Label}
+	assert.True(t, AnyFlakes(state))
+}
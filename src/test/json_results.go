@@ -0,0 +1,97 @@
+// Machine-readable JSON summary of test results.
+
+package test
+
+import (
+	"encoding/json"
+	"io"
+
+	"core"
+)
+
+// JSONResultsVersion is the version of the JSON results schema.
+// It should be incremented on any incompatible change to the structures below.
+const JSONResultsVersion = 1
+
+// JSONTestResults is the top-level structure of the JSON results summary.
+type JSONTestResults struct {
+	Version int              `json:"version"`
+	Targets []JSONTestTarget `json:"targets"`
+}
+
+// JSONTestTarget describes the results of a single test target.
+type JSONTestTarget struct {
+	Label string `json:"label"`
+	// One of "pass", "fail" or "skipped" (if the test was not run at all).
+	Result string `json:"result"`
+	// True if some runs of the test failed and some succeeded.
+	Flaky bool `json:"flaky"`
+	// True if the test took longer than its expected_duration.
+	Slow      bool      `json:"slow,omitempty"`
+	Cached    bool      `json:"cached"`
+	Runs      int       `json:"runs"`
+	Successes int       `json:"successes"`
+	Failures  int       `json:"failures"`
+	Durations []float64 `json:"durations"`
+	Tests     int       `json:"tests"`
+	Passed    int       `json:"passed"`
+	Failed    int       `json:"failed"`
+	Skipped   int       `json:"skipped"`
+}
+
+// WriteJSONResultsOrDie writes a summary of the results of all tests that were requested to the given writer.
+// Dies on any errors.
+func WriteJSONResultsOrDie(state *core.BuildState, w io.Writer) {
+	b, err := json.MarshalIndent(jsonResults(state), "", "    ")
+	if err != nil {
+		log.Fatalf("Failed to serialise JSON: %s", err)
+	} else if _, err := w.Write(append(b, '\n')); err != nil {
+		log.Fatalf("Failed to write JSON results: %s", err)
+	}
+}
+
+func jsonResults(state *core.BuildState) JSONTestResults {
+	results := JSONTestResults{
+		Version: JSONResultsVersion,
+		Targets: []JSONTestTarget{},
+	}
+	for _, label := range state.ExpandOriginalTargets() {
+		if target := state.Graph.Target(label); target != nil && target.IsTest {
+			results.Targets = append(results.Targets, jsonTarget(target))
+		}
+	}
+	return results
+}
+
+func jsonTarget(target *core.BuildTarget) JSONTestTarget {
+	t := JSONTestTarget{
+		Label:     target.Label.String(),
+		Result:    "pass",
+		Flaky:     target.Results.Flakes > 0,
+		Slow:      target.Results.Slow,
+		Cached:    target.Results.Cached,
+		Runs:      len(target.Results.RunDurations),
+		Successes: target.Results.SuccessfulRuns,
+		Durations: target.Results.RunDurations,
+		Tests:     target.Results.NumTests,
+		Passed:    target.Results.Passed,
+		Failed:    target.Results.Failed,
+		Skipped:   target.Results.Skipped,
+	}
+	t.Failures = t.Runs - t.Successes
+	if t.Durations == nil {
+		t.Durations = []float64{}
+	}
+	if testFailed(target) {
+		t.Result = "fail"
+	} else if target.Results.NumTests == 0 {
+		t.Result = "skipped"
+	}
+	return t
+}
+
+// testFailed returns true if the given test failed, either because it was reported as failing
+// (which it can be without any individual test cases failing) or because it couldn't be built.
+func testFailed(target *core.BuildTarget) bool {
+	return target.Results.Status == core.TargetTestFailed || target.Results.Failed > 0 || target.State() == core.Failed
+}
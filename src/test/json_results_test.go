@@ -0,0 +1,60 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestJSONTargetPass(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:pass_test", ""))
+	target.Results = core.TestResults{NumTests: 3, Passed: 3, RunDurations: []float64{0.5}, SuccessfulRuns: 1}
+	result := jsonTarget(target)
+	assert.Equal(t, "//src/test:pass_test", result.Label)
+	assert.Equal(t, "pass", result.Result)
+	assert.False(t, result.Flaky)
+	assert.Equal(t, 1, result.Runs)
+	assert.Equal(t, 1, result.Successes)
+	assert.Equal(t, 0, result.Failures)
+	assert.Equal(t, []float64{0.5}, result.Durations)
+}
+
+func TestJSONTargetFlaky(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:flaky_test", ""))
+	target.Results = core.TestResults{NumTests: 1, Passed: 1, Flakes: 2, RunDurations: []float64{0.5, 0.6, 0.7}, SuccessfulRuns: 1}
+	result := jsonTarget(target)
+	assert.Equal(t, "pass", result.Result)
+	assert.True(t, result.Flaky)
+	assert.Equal(t, 3, result.Runs)
+	assert.Equal(t, 1, result.Successes)
+	assert.Equal(t, 2, result.Failures)
+}
+
+func TestJSONTargetFail(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:fail_test", ""))
+	target.Results = core.TestResults{NumTests: 1, Failed: 1, RunDurations: []float64{0.5}}
+	result := jsonTarget(target)
+	assert.Equal(t, "fail", result.Result)
+	assert.Equal(t, 1, result.Failures)
+}
+
+func TestJSONTargetFailedWithNoFailures(t *testing.T) {
+	// e.g. an expected_to_fail test that passed, or one that took too long with --enforce_durations.
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:failed_no_failures_test", ""))
+	target.IsTest = true
+	state.Graph.AddTarget(target)
+	target.Results = core.TestResults{NumTests: 1, Passed: 1, RunDurations: []float64{0.5}, SuccessfulRuns: 1}
+	state.LogTestResult(0, target.Label, core.TargetTestFailed, &target.Results, &core.TestCoverage{}, nil, "")
+	assert.Equal(t, "fail", jsonTarget(target).Result)
+}
+
+func TestJSONTargetSkipped(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:skipped_test", ""))
+	result := jsonTarget(target)
+	assert.Equal(t, "skipped", result.Result)
+	assert.Equal(t, 0, result.Runs)
+	assert.NotNil(t, result.Durations)
+}
@@ -0,0 +1,69 @@
+// Records which tests failed so they can be rerun with plz test --last_failed.
+
+package test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"core"
+)
+
+// LastFailedFile is the file we record the failed tests from the last run in.
+const LastFailedFile = "plz-out/log/last_failed.json"
+
+// LastFailed describes the tests that failed in the last run, and the settings they were run with.
+type LastFailed struct {
+	Targets       []string `json:"targets"`
+	NumRuns       int      `json:"num_runs,omitempty"`
+	FlakyMajority bool     `json:"flaky_majority,omitempty"`
+}
+
+// Labels returns the failed targets as build labels.
+func (lastFailed *LastFailed) Labels() []core.BuildLabel {
+	labels := make([]core.BuildLabel, len(lastFailed.Targets))
+	for i, target := range lastFailed.Targets {
+		labels[i] = core.ParseBuildLabel(target, "")
+	}
+	return labels
+}
+
+// WriteLastFailed writes the tests that failed in this build to the given file.
+// The file is always written, so a run where everything passed leaves an empty set behind.
+func WriteLastFailed(state *core.BuildState, filename string) error {
+	lastFailed := LastFailed{
+		Targets:       []string{},
+		NumRuns:       state.NumTestRuns,
+		FlakyMajority: state.FlakyMajority,
+	}
+	for _, label := range state.ExpandOriginalTargets() {
+		if target := state.Graph.Target(label); target != nil && target.IsTest {
+			// Tests that never got built because a dependency failed (with --keep_going) count too.
+			if testFailed(target) || (target.State() >= core.Active && target.State() < core.Stopped) {
+				lastFailed.Targets = append(lastFailed.Targets, label.String())
+			}
+		}
+	}
+	b, err := json.Marshal(&lastFailed)
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0644)
+}
+
+// ReadLastFailed reads the tests that failed in the last run from the given file.
+// It returns nil if there was no previous run.
+func ReadLastFailed(filename string) (*LastFailed, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	lastFailed := &LastFailed{}
+	return lastFailed, json.Unmarshal(b, lastFailed)
+}
@@ -0,0 +1,59 @@
+package test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+const lastFailedTestFile = "plz-out/tmp/src/test/last_failed.json"
+
+func TestLastFailedRoundTrip(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	state.NumTestRuns = 3
+	passed := lastFailedTarget(state, "//src/test:passed")
+	failed := lastFailedTarget(state, "//src/test:failed")
+	failed.Results.Failed = 1
+	broken := lastFailedTarget(state, "//src/test:broken")
+	broken.SetState(core.Failed)
+	blocked := lastFailedTarget(state, "//src/test:blocked")
+	blocked.SetState(core.Pending)
+	timedOut := lastFailedTarget(state, "//src/test:timed_out")
+	state.LogTestResult(0, timedOut.Label, core.TargetTestFailed, &timedOut.Results, &core.TestCoverage{}, nil, "")
+	state.OriginalTargets = []core.BuildLabel{blocked.Label, broken.Label, failed.Label, passed.Label, timedOut.Label}
+	assert.NoError(t, WriteLastFailed(state, lastFailedTestFile))
+	lastFailed, err := ReadLastFailed(lastFailedTestFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []core.BuildLabel{blocked.Label, broken.Label, failed.Label, timedOut.Label}, lastFailed.Labels())
+	assert.Equal(t, 3, lastFailed.NumRuns)
+	assert.False(t, lastFailed.FlakyMajority)
+}
+
+func TestLastFailedAllPassed(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	passed := lastFailedTarget(state, "//src/test:passed")
+	state.OriginalTargets = []core.BuildLabel{passed.Label}
+	assert.NoError(t, WriteLastFailed(state, lastFailedTestFile))
+	lastFailed, err := ReadLastFailed(lastFailedTestFile)
+	assert.NoError(t, err)
+	assert.NotNil(t, lastFailed)
+	assert.Equal(t, 0, len(lastFailed.Targets))
+}
+
+func TestLastFailedMissing(t *testing.T) {
+	os.RemoveAll(lastFailedTestFile)
+	lastFailed, err := ReadLastFailed(lastFailedTestFile)
+	assert.NoError(t, err)
+	assert.Nil(t, lastFailed)
+}
+
+func lastFailedTarget(state *core.BuildState, label string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	target.IsTest = true
+	target.SetState(core.Built)
+	state.Graph.AddTarget(target)
+	return target
+}
@@ -158,6 +158,41 @@ func TestParseGoFileWithNoTests(t *testing.T) {
 	}
 }
 
+func TestJUnitXMLProperties(t *testing.T) {
+	results, err := parseTestResults(new(core.BuildTarget), "src/test/test_data/junit-properties.xml", false)
+	if err != nil {
+		t.Errorf("Unable to parse file: %s", err)
+		return
+	}
+	assert(t, results.NumTests, 2, "tests")
+	assert(t, results.Passed, 2, "passes")
+	assert(t, len(results.Properties), 2, "properties")
+	if results.Properties[0] != (core.TestProperty{Name: "git.sha", Value: "a0b1c2d3"}) {
+		t.Errorf("Unexpected property %v", results.Properties[0])
+	}
+	if results.Properties[1] != (core.TestProperty{Name: "seed", Value: "42"}) {
+		t.Errorf("Unexpected property %v", results.Properties[1])
+	}
+}
+
+func TestMergeResultsFiles(t *testing.T) {
+	filename := "plz-out/tmp/merged_results.xml"
+	MergeResultsFilesOrDie([]string{
+		"src/test/test_data/shard0_results.xml",
+		"src/test/test_data/shard1_results.xml",
+	}, filename)
+	results, err := parseTestResults(new(core.BuildTarget), filename, false)
+	if err != nil {
+		t.Errorf("Unable to parse file: %s", err)
+		return
+	}
+	// TestUnsharded and TestFlaky were run on both shards; TestFlaky only failed on the second
+	// but that failure should win over its pass on the first.
+	assert(t, results.NumTests, 6, "tests")
+	assert(t, results.Passed, 4, "passes")
+	assert(t, results.Failed, 2, "failures")
+}
+
 // because I'm already pining for self.assertEqual...
 func assert(t *testing.T, actual int, expected int, description string) {
 	if actual != expected {
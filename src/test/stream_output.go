@@ -0,0 +1,30 @@
+// Support for streaming the output of tests to the console while they run.
+
+package test
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"core"
+)
+
+// testOutputStream returns the writer that a test's output should be copied to while it runs,
+// or nil if it's not being shown. The returned function must be called once the test has finished.
+func testOutputStream(state *core.BuildState, target *core.BuildTarget) (io.Writer, func()) {
+	if state.StreamTestOutput {
+		s := core.NewLineStreamer(os.Stderr, target.Label)
+		return s, s.Flush
+	} else if state.ShowAllOutput {
+		return os.Stderr, func() {}
+	}
+	return nil, func() {}
+}
+
+// streamDelimiter writes a line delimiting the output of separate runs of a test, if its output is being streamed.
+func streamDelimiter(state *core.BuildState, target *core.BuildTarget, format string, args ...interface{}) {
+	if state.StreamTestOutput {
+		fmt.Fprintf(core.NewLineStreamer(os.Stderr, target.Label), "=== "+format+" ===\n", args...)
+	}
+}
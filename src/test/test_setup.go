@@ -0,0 +1,70 @@
+// Support for running setup & teardown targets around all the runs of a test.
+
+package test
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"build"
+	"core"
+)
+
+// scratchDirSuffix is appended to the test directory of a target to get its scratch directory.
+// It has to be separate since the test directory is recreated for each run.
+const scratchDirSuffix = "_scratch"
+
+// hasSetupOrTeardown returns true if the given test has a setup or teardown target.
+func hasSetupOrTeardown(target *core.BuildTarget) bool {
+	return target.TestSetup != nil || target.TestTeardown != nil
+}
+
+// scratchDir returns the scratch directory shared between a test and its setup & teardown targets.
+func scratchDir(target *core.BuildTarget) string {
+	return path.Join(core.RepoRoot, target.TestDir()+scratchDirSuffix)
+}
+
+// prepareScratchDir creates an empty scratch directory for a test.
+func prepareScratchDir(target *core.BuildTarget) error {
+	dir := scratchDir(target)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, core.DirPermissions)
+}
+
+// runTestSetup runs the setup target of a test, if it has one.
+func runTestSetup(state *core.BuildState, target *core.BuildTarget) ([]byte, error) {
+	if target.TestSetup == nil {
+		return nil, nil
+	}
+	return runSetupTarget(state, target, *target.TestSetup)
+}
+
+// runTestTeardown runs the teardown target of a test, if it has one.
+// Failures are only warned about; by now the test has already passed or failed.
+func runTestTeardown(state *core.BuildState, target *core.BuildTarget) {
+	if target.TestTeardown == nil {
+		return
+	}
+	if out, err := runSetupTarget(state, target, *target.TestTeardown); err != nil {
+		log.Warning("Teardown %s of %s failed: %s\n%s", target.TestTeardown, target.Label, err, out)
+	}
+}
+
+// runSetupTarget runs a setup or teardown target for a test, from the repo root and with the
+// test's environment. It's subject to the same timeout as a single run of the test.
+func runSetupTarget(state *core.BuildState, target *core.BuildTarget, label core.BuildLabel) ([]byte, error) {
+	setup := state.Graph.TargetOrDie(label)
+	if !setup.IsBinary {
+		return nil, fmt.Errorf("%s can't be run; it's not marked as binary", label)
+	}
+	// ReplaceSequences quotes things, which is fine since we run it through a shell.
+	cmd := build.ReplaceSequences(setup, fmt.Sprintf("$(out_exe %s)", setup.Label))
+	env := testEnvironment(state, target, 1)
+	log.Debug("Running %s for %s\nENVIRONMENT:\n%s\n%s", label, target.Label, strings.Join(env, "\n"), cmd)
+	_, out, err := core.ExecWithTimeoutShell(setup, core.RepoRoot, env, testTimeout(state, target, 1), state.Config.Test.Timeout, state.ShowAllOutput, cmd, false)
+	return out, err
+}
@@ -0,0 +1,67 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestSetupAndTeardownRunOnceAroundAllRuns(t *testing.T) {
+	state, target := setupTeardownTarget("setup_teardown", "echo setup >> $PLZ_TEST_SCRATCH_DIR/log")
+	target.TestCommand = "echo run >> $PLZ_TEST_SCRATCH_DIR/log; false"
+	target.Flakiness = 3
+	test(0, state, target.Label, target)
+	assert.Equal(t, 3, len(target.Results.RunDurations))
+	b, err := ioutil.ReadFile(path.Join(scratchDir(target), "log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "setup\nrun\nrun\nrun\nteardown\n", string(b))
+}
+
+func TestFailedSetupAbortsTest(t *testing.T) {
+	state, target := setupTeardownTarget("failed_setup", "echo setup >> $PLZ_TEST_SCRATCH_DIR/log; exit 1")
+	target.TestCommand = "echo run >> $PLZ_TEST_SCRATCH_DIR/log"
+	target.Flakiness = 3
+	test(0, state, target.Label, target)
+	assert.Equal(t, 0, len(target.Results.RunDurations), "Test shouldn't have been run at all")
+	assert.Equal(t, 0, target.Results.Flakes)
+	assert.Equal(t, 1, target.Results.Failed)
+	assert.Equal(t, "Test setup", target.Results.Failures[0].Name)
+	assert.Equal(t, "fail", jsonTarget(target).Result)
+	b, err := ioutil.ReadFile(path.Join(scratchDir(target), "log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "setup\nteardown\n", string(b), "Teardown should still have run")
+}
+
+// setupTeardownTarget creates a test target with setup & teardown targets, the setup one
+// running the given command. The teardown one records itself in the scratch directory.
+func setupTeardownTarget(name, setupCmd string) (*core.BuildState, *core.BuildTarget) {
+	core.RepoRoot, _ = os.Getwd() // The scratch directory has to be absolute for the test to find it.
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	state.Config.Build.Path = []string{"/usr/local/bin", "/usr/bin", "/bin"}
+	setup := addScriptTarget(state, name+"_setup", setupCmd)
+	teardown := addScriptTarget(state, name+"_teardown", "echo teardown >> $PLZ_TEST_SCRATCH_DIR/log")
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:"+name, ""))
+	target.IsTest = true
+	target.NoTestOutput = true
+	target.TestSetup = &setup.Label
+	target.TestTeardown = &teardown.Label
+	target.SetState(core.Built)
+	state.Graph.AddTarget(target)
+	return state, target
+}
+
+// addScriptTarget adds a binary target whose output is a shell script running the given command.
+func addScriptTarget(state *core.BuildState, name, cmd string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:"+name, ""))
+	target.IsBinary = true
+	target.AddOutput(name + ".sh")
+	state.Graph.AddTarget(target)
+	os.MkdirAll(target.OutDir(), core.DirPermissions)
+	ioutil.WriteFile(path.Join(target.OutDir(), name+".sh"), []byte("#!/bin/sh\n"+cmd+"\n"), 0755)
+	return target
+}
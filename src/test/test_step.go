@@ -1,13 +1,16 @@
 package test
 
 import (
-	"context"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -43,14 +46,17 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 	hashStr := base64.RawURLEncoding.EncodeToString(hash)
 	resultsFileName := fmt.Sprintf(".test_results_%s_%s", label.Name, hashStr)
 	coverageFileName := fmt.Sprintf(".test_coverage_%s_%s", label.Name, hashStr)
+	runsFileName := fmt.Sprintf(".test_runs_%s_%s", label.Name, hashStr)
 	outputFile := path.Join(target.TestDir(), "test.results")
 	coverageFile := path.Join(target.TestDir(), "test.coverage")
 	cachedOutputFile := path.Join(target.OutDir(), resultsFileName)
 	cachedCoverageFile := path.Join(target.OutDir(), coverageFileName)
+	cachedRunsFile := path.Join(target.OutDir(), runsFileName)
 	needCoverage := state.NeedCoverage && !target.NoTestOutput
+	numRuns, successesRequired := NumRuns(state, target)
 
 	cachedTest := func() {
-		log.Debug("Not re-running test %s; got cached results.", label)
+		log.Debug("Not re-running test %s; got cached results from unfiltered runs with at least the %d successes needed.", label, successesRequired)
 		coverage := parseCoverageFile(target, cachedCoverageFile)
 		results, err := parseTestResults(target, cachedOutputFile, true)
 		target.Results.Duration = time.Since(startTime).Seconds()
@@ -64,16 +70,25 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 		}
 	}
 
-	moveAndCacheOutputFiles := func(results *core.TestResults, coverage *core.TestCoverage) bool {
-		// Never cache test results when given arguments; the results may be incomplete.
-		if len(state.TestArgs) > 0 {
+	moveAndCacheOutputFiles := func(results *core.TestResults, coverage *core.TestCoverage, numSucceeded int) bool {
+		// Never cache test results when given arguments or a filter; the results may be incomplete.
+		if len(state.TestArgs) > 0 || state.TestFilter != "" {
 			log.Debug("Not caching results for %s, we passed it arguments", label)
 			return true
 		}
+		// Similarly the results of a single shard are incomplete.
+		if state.IsSharded(target) {
+			log.Debug("Not caching results for %s, it's only one shard", label)
+			return true
+		}
 		if err := moveAndCacheOutputFile(state, target, hash, outputFile, cachedOutputFile, resultsFileName, dummyOutput); err != nil {
 			state.LogTestResult(tid, label, core.TargetTestFailed, results, coverage, err, "Failed to move test output file")
 			return false
 		}
+		if err := writeAndCacheRunsFile(state, target, hash, cachedRunsFile, runsFileName, numSucceeded); err != nil {
+			state.LogTestResult(tid, label, core.TargetTestFailed, results, coverage, err, "Failed to write test runs file")
+			return false
+		}
 		if needCoverage || core.PathExists(coverageFile) {
 			if err := moveAndCacheOutputFile(state, target, hash, coverageFile, cachedCoverageFile, coverageFileName, dummyCoverage); err != nil {
 				state.LogTestResult(tid, label, core.TargetTestFailed, results, coverage, err, "Failed to move test coverage file")
@@ -92,7 +107,14 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 	}
 
 	needToRun := func() bool {
-		if target.State() == core.Unchanged && core.PathExists(cachedOutputFile) {
+		if state.TestFilter != "" {
+			// We can't tell which cases cached results cover, and the user wants to see the filtered ones run.
+			return true
+		} else if state.RepeatUntilFailure > 0 {
+			// Cached results can't tell us anything about whether it'll fail this time.
+			return true
+		}
+		if target.State() == core.Unchanged && core.PathExists(cachedOutputFile) && sufficientRuns(cachedRunsFile, successesRequired) {
 			// Output file exists already and appears to be valid. We might still need to rerun though
 			// if the coverage files aren't available.
 			if needCoverage && !core.PathExists(cachedCoverageFile) {
@@ -101,12 +123,17 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 			return false
 		}
 		// Check the cache for these artifacts.
-		if state.Cache == nil {
+		if state.Cache == nil || target.NoCache {
 			return true
 		}
 		if !state.Cache.RetrieveExtra(target, hash, resultsFileName) {
 			return true
 		}
+		// Results from before we recorded this won't have it, in which case they count as a single run.
+		state.Cache.RetrieveExtra(target, hash, runsFileName)
+		if !sufficientRuns(cachedRunsFile, successesRequired) {
+			return true
+		}
 		if needCoverage && !state.Cache.RetrieveExtra(target, hash, coverageFileName) {
 			return true
 		}
@@ -118,8 +145,7 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 		return false
 	}
 
-	// Don't cache when doing multiple runs, presumably the user explicitly wants to check it.
-	if state.NumTestRuns <= 1 && !needToRun() {
+	if !state.IsSharded(target) && !needToRun() {
 		cachedTest()
 		return
 	}
@@ -128,17 +154,52 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 		state.LogBuildError(tid, label, core.TargetTestFailed, err, "Failed to remove cached test files")
 		return
 	}
+	var retryRegex *regexp.Regexp
+	if target.FlakyRetryRegex != "" {
+		// This has already been validated by the parser so it shouldn't fail here.
+		retryRegex = regexp.MustCompile(target.FlakyRetryRegex)
+	}
+	// Setup & teardown happen once around all the runs, not for each one.
+	if hasSetupOrTeardown(target) {
+		if err := prepareScratchDir(target); err != nil {
+			state.LogBuildError(tid, label, core.TargetTestFailed, err, "Failed to prepare scratch directory")
+			return
+		}
+		state.LogBuildResult(tid, label, core.TargetTesting, "Setting up...")
+		if out, err := runTestSetup(state, target); err != nil {
+			runTestTeardown(state, target)
+			// This is an error in its own right, not something to be retried as a flake.
+			target.Results.NumTests = 1
+			target.Results.Failed = 1
+			target.Results.Failures = []core.TestFailure{{
+				Name:   "Test setup",
+				Type:   err.Error(),
+				Stdout: string(out),
+			}}
+			state.LogTestResult(tid, label, core.TargetTestFailed, &target.Results, &core.TestCoverage{}, err, "Test setup %s failed: %s\n%s", target.TestSetup, err, out)
+			return
+		}
+		startTime = time.Now() // don't count the setup either
+	}
 	numSucceeded := 0
 	numFlakes := 0
-	numRuns, successesRequired := calcNumRuns(state.NumTestRuns, target.Flakiness)
+	numTimeouts := 0
+	flaky := false
 	var resultErr error
 	resultMsg := ""
 	var coverage core.TestCoverage
 	for i := 0; i < numRuns && numSucceeded < successesRequired; i++ {
+		description := "Testing..."
+		if numRuns > 1 {
+			description = fmt.Sprintf("Testing (%d of %d, timeout %s)...", i+1, numRuns, testTimeout(state, target, i+1))
+		}
+		state.LogTestRun(tid, label, i+1, numRuns, false, false, description)
 		if numRuns > 1 {
-			state.LogBuildResult(tid, label, core.TargetTesting, fmt.Sprintf("Testing (%d of %d)...", i+1, numRuns))
+			streamDelimiter(state, target, "Run %d of %d", i+1, numRuns)
 		}
-		out, err := prepareAndRunTest(tid, state, target)
+		numFailures := len(target.Results.Failures)
+		out, execDuration, err := prepareAndRunTest(tid, state, target, i+1)
+		flakesBefore := numFlakes
 		duration := time.Since(startTime).Seconds()
 		startTime = time.Now() // reset this for next time
 
@@ -153,9 +214,12 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 		if err != nil && target.Results.Output == "" {
 			target.Results.Output = err.Error()
 		}
-		target.Results.TimedOut = err == context.DeadlineExceeded
-		coverage = parseCoverageFile(target, coverageFile)
+		target.Results.TimedOut = core.IsTimeout(err)
+		runCoverage := parseCoverageFile(target, coverageFile)
+		coverage.Aggregate(&runCoverage)
 		target.Results.Duration += duration
+		target.Results.RunDurations = append(target.Results.RunDurations, duration)
+		target.Results.ExecDurations = append(target.Results.ExecDurations, execDuration)
 		if !core.PathExists(outputFile) {
 			if err == nil && target.NoTestOutput {
 				target.Results.NumTests += 1
@@ -183,7 +247,14 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 				resultMsg = fmt.Sprintf("Test failed with no results. Output: %s", string(out))
 			}
 		} else {
+			numProperties := len(target.Results.Properties)
 			results, err2 := parseTestResults(target, outputFile, false)
+			if numRuns > 1 {
+				// Tag any properties from this run so they aren't conflated with those from other runs.
+				for j := numProperties; j < len(target.Results.Properties); j++ {
+					target.Results.Properties[j].Run = i + 1
+				}
+			}
 			if err2 != nil {
 				resultErr = err2
 				resultMsg = fmt.Sprintf("Couldn't parse test output file: %s. Stdout: %s", err2, string(out))
@@ -215,28 +286,122 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 				}
 			}
 		}
+		target.Results.RunPassed = append(target.Results.RunPassed, numFlakes == flakesBefore)
+		state.LogTestRun(tid, label, i+1, numRuns, true, numFlakes == flakesBefore, description)
+		if numRuns > 1 {
+			streamDelimiter(state, target, "Run %d of %d %s", i+1, numRuns, passedOrFailed(numFlakes == flakesBefore))
+		}
+		if target.Shuffle && numFlakes > flakesBefore {
+			seed := testSeed(state, i+1)
+			resultMsg += fmt.Sprintf("\nTest was run with PLZ_TEST_SEED=%d; rerun with --test_seed=%d to reproduce.", seed, seed)
+		}
+		if target.Results.TimedOut {
+			numTimeouts++
+		}
+		if target.Results.TimedOut && (state.FlakyTimeoutMultiplier <= 1.0 || numTimeouts >= maxTimedOutRuns) {
+			// The timeout is a hard limit on the test; another run with the same limit isn't going to
+			// fare any better, and we can't trust whatever partial results it produced.
+			// If the timeout grows on each run it's worth another go, but not indefinitely since
+			// a test that's hanging would otherwise be run every time with ever longer timeouts.
+			log.Debug("Abandoning remaining runs of %s after it timed out", label)
+			resultErr = err
+			resultMsg = fmt.Sprintf("Test timed out after %s. %s", testTimeout(state, target, i+1), resultMsg)
+			break
+		}
+		if state.RepeatUntilFailure > 0 && numFlakes > flakesBefore {
+			log.Debug("Stopping after %d of %d runs of %s, it failed", i+1, numRuns, label)
+			break
+		}
+		if retryRegex != nil && numFlakes > flakesBefore && i+1 < numRuns && !retryableFailure(retryRegex, target.Results.Output, target.Results.Failures, numFailures) {
+			log.Debug("Not retrying %s, its output didn't match flaky_retry_regex", label)
+			resultMsg = fmt.Sprintf("Test failed in a way that doesn't match flaky_retry_regex, so wasn't retried. %s", resultMsg)
+			break
+		}
+		if target.ExpectedToFail && numFlakes > 0 {
+			log.Debug("Stopping after %d of %d runs of %s, it failed as expected", i+1, numRuns, label)
+			break
+		}
+		if state.FailFastFlakes && !state.FlakyMajority && numSucceeded > 0 && numFlakes > 0 && numSucceeded < successesRequired {
+			// We've seen it both pass and fail now, so there's no point running it any further.
+			log.Debug("Stopping after %d of %d runs of %s, it's flaky", i+1, numRuns, label)
+			resultMsg = fmt.Sprintf("Test is flaky; passed %d %s and failed %d %s. %s", numSucceeded, pluralise("time", numSucceeded), numFlakes, pluralise("time", numFlakes), resultMsg)
+			flaky = true
+			break
+		}
+	}
+	if hasSetupOrTeardown(target) {
+		state.LogBuildResult(tid, label, core.TargetTesting, "Tearing down...")
+		runTestTeardown(state, target)
 	}
-	if numSucceeded >= successesRequired {
+	target.Results.SuccessfulRuns = numSucceeded
+	if target.ExpectedToFail {
+		logExpectedFailure(state, tid, target, &coverage, numSucceeded >= successesRequired)
+	} else if numSucceeded >= successesRequired && state.TestFilter != "" && target.Results.NumTests == 0 && !target.NoTestOutput {
+		state.LogTestResult(tid, label, core.TargetTestFailed, &target.Results, &coverage, fmt.Errorf("No tests matched filter"),
+			"No test cases matched --test_filter=%s", state.TestFilter)
+	} else if numSucceeded >= successesRequired {
 		target.Results.Failures = nil // Remove any failures, they don't count
 		target.Results.Failed = 0     // (they'll be picked up as flakes below)
 		if numSucceeded > 0 && numFlakes > 0 {
 			target.Results.Flakes = numFlakes
 		}
+		if err := checkExpectedDuration(target); err != nil {
+			if state.EnforceDurations {
+				state.LogTestResult(tid, label, core.TargetTestFailed, &target.Results, &coverage, err, "%s", err)
+				return
+			}
+			log.Warning("%s: %s", label, err)
+		}
 		// Success, clean things up
-		if moveAndCacheOutputFiles(&target.Results, &coverage) {
+		if moveAndCacheOutputFiles(&target.Results, &coverage, numSucceeded) {
 			logTestSuccess(state, tid, label, &target.Results, &coverage)
 		}
 		// Clean up the test directory.
 		if state.CleanWorkdirs {
 			if err := os.RemoveAll(target.TestDir()); err != nil {
 				log.Warning("Failed to remove test directory for %s: %s", target.Label, err)
+			} else if err := os.RemoveAll(scratchDir(target)); err != nil {
+				log.Warning("Failed to remove scratch directory for %s: %s", target.Label, err)
 			}
 		}
 	} else {
+		if state.RepeatUntilFailure > 0 {
+			runs := len(target.Results.RunDurations)
+			resultMsg = fmt.Sprintf("Failed on run %d of %d, after passing %d %s. %s", runs, numRuns, runs-1, pluralise("time", runs-1), resultMsg)
+		}
+		if flaky {
+			// It didn't pass as many times as it needed to, so it's still a failure, but we record
+			// the flakes so it's reported as a flaky one.
+			target.Results.Flakes = numFlakes
+			if resultErr == nil {
+				resultErr = fmt.Errorf("Test is flaky")
+			}
+		}
+		if err := checkExpectedDuration(target); err != nil {
+			log.Warning("%s: %s", label, err)
+		}
 		state.LogTestResult(tid, label, core.TargetTestFailed, &target.Results, &coverage, resultErr, resultMsg)
 	}
 }
 
+// retryableFailure returns true if the output or any of the new failures from a test run match the given regex.
+// The failures before index from are from earlier runs, although they may have been replaced by
+// this one in which case we consider all of them.
+func retryableFailure(regex *regexp.Regexp, output string, failures []core.TestFailure, from int) bool {
+	if regex.MatchString(output) {
+		return true
+	}
+	if from > len(failures) {
+		from = 0
+	}
+	for _, failure := range failures[from:] {
+		if regex.MatchString(failure.Type) || regex.MatchString(failure.Traceback) || regex.MatchString(failure.Stdout) || regex.MatchString(failure.Stderr) {
+			return true
+		}
+	}
+	return false
+}
+
 func logTestSuccess(state *core.BuildState, tid int, label core.BuildLabel, results *core.TestResults, coverage *core.TestCoverage) {
 	var description string
 	tests := pluralise("test", results.NumTests)
@@ -250,6 +415,30 @@ func logTestSuccess(state *core.BuildState, tid int, label core.BuildLabel, resu
 	state.LogTestResult(tid, label, core.TargetTested, results, coverage, nil, description)
 }
 
+// logExpectedFailure logs the result of a test that is marked as expected to fail.
+// Its results aren't cached since they contain failures.
+func logExpectedFailure(state *core.BuildState, tid int, target *core.BuildTarget, coverage *core.TestCoverage, passed bool) {
+	if passed {
+		target.Results.Failed = 0
+		target.Results.Failures = nil
+		state.LogTestResult(tid, target.Label, core.TargetTestFailed, &target.Results, coverage,
+			fmt.Errorf("Test unexpectedly passed"), "Test passed but is marked as expected_to_fail; remove the marker if it's been fixed.")
+		return
+	}
+	target.Results.ExpectedFailures += target.Results.Failed
+	target.Results.Failed = 0
+	target.Results.Failures = nil
+	target.Results.Flakes = 0
+	logTestSuccess(state, tid, target.Label, &target.Results, coverage)
+}
+
+func passedOrFailed(passed bool) string {
+	if passed {
+		return "passed"
+	}
+	return "failed"
+}
+
 func pluralise(word string, quantity int) string {
 	if quantity == 1 {
 		return word
@@ -264,18 +453,77 @@ func prepareTestDir(graph *core.BuildGraph, target *core.BuildTarget) error {
 	if err := os.MkdirAll(target.TestDir(), core.DirPermissions); err != nil {
 		return err
 	}
+	symlink := symlinkableData(graph, target)
 	for out := range core.IterRuntimeFiles(graph, target, true) {
-		if err := core.PrepareSourcePair(out); err != nil {
+		if symlink[out.Src] {
+			if err := symlinkData(absPath(out.Src), out.Tmp); err != nil {
+				return err
+			}
+		} else if err := core.PrepareSourcePair(out); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// symlinkableData returns the set of data files for a test that we can symlink into its test
+// directory rather than linking or copying them. This is empty unless symlink_data is set.
+// Containerised tests always get real files since the symlinks won't resolve within the container,
+// and so do sandboxed ones since the symlinks would lead them back out into the repo.
+func symlinkableData(graph *core.BuildGraph, target *core.BuildTarget) map[string]bool {
+	ret := map[string]bool{}
+	if !target.SymlinkData {
+		return ret
+	} else if target.Containerise {
+		log.Debug("Not symlinking data for %s since it's containerised", target.Label)
+		return ret
+	} else if target.TestSandbox {
+		log.Debug("Not symlinking data for %s since it's sandboxed", target.Label)
+		return ret
+	}
+	for _, data := range target.Data {
+		for _, p := range data.FullPaths(graph) {
+			ret[p] = true
+		}
+	}
+	return ret
+}
+
+// absPath returns the given path relative to the repo root, if it isn't absolute already.
+func absPath(p string) string {
+	if path.IsAbs(p) {
+		return p
+	}
+	return path.Join(core.RepoRoot, p)
+}
+
+// symlinkData symlinks a data file or directory into a test directory.
+// Setting symlink_data declares that the test only reads its data, so every file is symlinked
+// regardless of its permissions. Directories are recreated rather than being symlinked so
+// anything new the test writes into them stays within its test directory.
+func symlinkData(from, to string) error {
+	if !core.PathExists(from) {
+		return fmt.Errorf("Data file %s doesn't exist", from)
+	}
+	return filepath.Walk(from, func(name string, info os.FileInfo, err error) error {
+		dest := path.Join(to, name[len(from):])
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			return os.MkdirAll(dest, core.DirPermissions)
+		} else if err := os.MkdirAll(path.Dir(dest), core.DirPermissions); err != nil {
+			return err
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			return core.RecursiveCopyFile(name, dest, 0, true, true)
+		}
+		return os.Symlink(name, dest)
+	})
+}
+
 // testCommandAndEnv returns the test command & environment for a target.
-func testCommandAndEnv(state *core.BuildState, target *core.BuildTarget) (string, []string) {
+func testCommandAndEnv(state *core.BuildState, target *core.BuildTarget, run int) (string, []string) {
 	replacedCmd := build.ReplaceTestSequences(target, target.GetTestCommand())
-	env := core.BuildEnvironment(state, target, true)
+	env := testEnvironment(state, target, run)
 	if len(state.TestArgs) > 0 {
 		args := strings.Join(state.TestArgs, " ")
 		replacedCmd += " " + args
@@ -284,20 +532,155 @@ func testCommandAndEnv(state *core.BuildState, target *core.BuildTarget) (string
 	return replacedCmd, env
 }
 
-func runTest(state *core.BuildState, target *core.BuildTarget) ([]byte, error) {
-	replacedCmd, env := testCommandAndEnv(state, target)
+// testEnvironment returns the environment for a single run of a test (1-indexed).
+func testEnvironment(state *core.BuildState, target *core.BuildTarget, run int) []string {
+	env := core.BuildEnvironment(state, target, true)
+	if target.Shuffle {
+		env = append(env, fmt.Sprintf("PLZ_TEST_SEED=%d", testSeed(state, run)))
+	}
+	if state.TestFilter != "" {
+		env = append(env, "PLZ_TEST_FILTER="+state.TestFilter)
+	}
+	if target.PerCaseTimeout > 0 {
+		env = append(env, fmt.Sprintf("PLZ_TEST_CASE_TIMEOUT=%d", int(target.PerCaseTimeout.Seconds())))
+	}
+	if hasSetupOrTeardown(target) {
+		env = append(env, "PLZ_TEST_SCRATCH_DIR="+scratchDir(target))
+	}
+	if state.IsSharded(target) {
+		env = append(env,
+			fmt.Sprintf("PLZ_TEST_TOTAL_SHARDS=%d", state.NumTestShards),
+			fmt.Sprintf("PLZ_TEST_SHARD_INDEX=%d", state.TestShardIndex),
+		)
+	}
+	env = passEnv(env, target.PassEnv)
+	if state.HermeticTestEnv {
+		env = hermeticEnv(env, target.PassEnv)
+	}
+	return env
+}
+
+// hermeticTestVars are the variables Please sets that tests still get with --hermetic_env,
+// because they're needed to run the test at all or to collect its results.
+var hermeticTestVars = map[string]bool{
+	"PATH":          true,
+	"TEST":          true,
+	"TESTS":         true,
+	"TEST_ARGS":     true,
+	"TEST_DIR":      true,
+	"TMP_DIR":       true,
+	"TMPDIR":        true,
+	"COVERAGE":      true,
+	"COVERAGE_FILE": true,
+	"GCNO_DIR":      true,
+}
+
+// passEnv adds any of the given variables from our own environment that aren't already set.
+func passEnv(env []string, names []string) []string {
+	for _, name := range names {
+		if _, set := envValue(env, name); !set {
+			if value, present := os.LookupEnv(name); present {
+				env = append(env, name+"="+value)
+			}
+		}
+	}
+	return env
+}
+
+// hermeticEnv filters the given environment down to Please's own test variables and the given names.
+// Anything else is dropped entirely so a test that depends on it fails rather than silently
+// picking up whatever the variable happens to be set to.
+func hermeticEnv(env []string, names []string) []string {
+	allowed := map[string]bool{}
+	for _, name := range names {
+		allowed[name] = true
+	}
+	ret := make([]string, 0, len(env))
+	for _, e := range env {
+		name := strings.SplitN(e, "=", 2)[0]
+		if hermeticTestVars[name] || strings.HasPrefix(name, "PLZ_") || allowed[name] {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// envValue returns the value of a variable in the given environment, and whether it was set.
+func envValue(env []string, name string) (string, bool) {
+	for _, e := range env {
+		if strings.HasPrefix(e, name+"=") {
+			return e[len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
+// testSeed returns the seed to give to a shuffled test for a particular run.
+// Each run gets a different seed so they're distinct from one another, but a run can be
+// reproduced by passing its seed as --test_seed.
+func testSeed(state *core.BuildState, run int) int64 {
+	return state.TestSeed + int64(run-1)
+}
+
+// testTimeout returns the timeout for a single run of a test (1-indexed).
+func testTimeout(state *core.BuildState, target *core.BuildTarget, run int) time.Duration {
+	timeout := target.TestTimeout
+	if timeout == 0 {
+		timeout = time.Duration(state.Config.Test.Timeout)
+	}
+	return calcTimeout(timeout, run, state.FlakyTimeoutMultiplier)
+}
+
+func runTest(state *core.BuildState, target *core.BuildTarget, run int) ([]byte, error) {
+	replacedCmd, env := testCommandAndEnv(state, target, run)
 	log.Debug("Running test %s\nENVIRONMENT:\n%s\n%s", target.Label, strings.Join(env, "\n"), replacedCmd)
-	_, out, err := core.ExecWithTimeoutShell(target, target.TestDir(), env, target.TestTimeout, state.Config.Test.Timeout, state.ShowAllOutput, replacedCmd, target.TestSandbox)
+	stream, done := testOutputStream(state, target)
+	defer done()
+	_, out, err := core.ExecWithTimeoutShellStreaming(target, target.TestDir(), env, testTimeout(state, target, run), state.Config.Test.Timeout, stream, replacedCmd, target.TestSandbox)
 	return out, err
 }
 
 // prepareAndRunTest sets up a test directory and runs the test.
-func prepareAndRunTest(tid int, state *core.BuildState, target *core.BuildTarget) (out []byte, err error) {
+// It also returns how long the test took to run in seconds, which doesn't include setting up its directory.
+// That does include starting please_sandbox or the Docker container if the test uses one (and, for
+// containers, copying results back out of it); they wrap the test process itself so we can't time it
+// separately from out here, and it's the wall time that a user waiting on the test actually sees.
+func prepareAndRunTest(tid int, state *core.BuildState, target *core.BuildTarget, run int) (out []byte, duration float64, err error) {
 	if err = prepareTestDir(state.Graph, target); err != nil {
 		state.LogBuildError(tid, target.Label, core.TargetTestFailed, err, "Failed to prepare test directory for %s: %s", target.Label, err)
-		return []byte{}, err
+		return []byte{}, 0, err
 	}
-	return runPossiblyContainerisedTest(state, target)
+	startTime := time.Now()
+	out, err = runPossiblyContainerisedTest(state, target, run)
+	return out, time.Since(startTime).Seconds(), err
+}
+
+// checkExpectedDuration marks a test as slow if it took longer than its expected_duration,
+// and returns an error describing how long it took if so.
+// Tests that were run more than once are judged on the median of their runs, so one slow rerun
+// of a flaky test doesn't count against it.
+func checkExpectedDuration(target *core.BuildTarget) error {
+	if target.ExpectedDuration == 0 || len(target.Results.ExecDurations) == 0 {
+		return nil
+	}
+	duration := median(target.Results.ExecDurations)
+	if duration <= target.ExpectedDuration.Seconds() {
+		return nil
+	}
+	target.Results.Slow = true
+	return fmt.Errorf("Test took %0.2fs, longer than its expected duration of %s", duration, target.ExpectedDuration)
+}
+
+// median returns the median of the given durations, which must not be empty.
+func median(durations []float64) float64 {
+	sorted := make([]float64, len(durations))
+	copy(sorted, durations)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 1 {
+		return sorted[mid]
+	}
+	return (sorted[mid-1] + sorted[mid]) / 2
 }
 
 // Parses the coverage output for a single target.
@@ -317,6 +700,9 @@ func RemoveCachedTestFiles(target *core.BuildTarget) error {
 	if err := removeAnyFilesWithPrefix(target.OutDir(), ".test_coverage_"+target.Label.Name); err != nil {
 		return err
 	}
+	if err := removeAnyFilesWithPrefix(target.OutDir(), ".test_runs_"+target.Label.Name); err != nil {
+		return err
+	}
 	for _, output := range target.TestOutputs {
 		if err := os.RemoveAll(path.Join(target.OutDir(), output)); err != nil {
 			return err
@@ -357,12 +743,55 @@ func moveAndCacheOutputFile(state *core.BuildState, target *core.BuildTarget, ha
 	} else if err := os.Rename(from, to); err != nil {
 		return err
 	}
-	if state.Cache != nil {
+	if state.Cache != nil && !target.NoCache {
 		state.Cache.StoreExtra(target, hash, filename)
 	}
 	return nil
 }
 
+// writeAndCacheRunsFile records the number of successful runs that a set of cached test results represents.
+func writeAndCacheRunsFile(state *core.BuildState, target *core.BuildTarget, hash []byte, filename, cacheName string, numSucceeded int) error {
+	if err := ioutil.WriteFile(filename, []byte(strconv.Itoa(numSucceeded)), 0644); err != nil {
+		return err
+	}
+	if state.Cache != nil && !target.NoCache {
+		state.Cache.StoreExtra(target, hash, cacheName)
+	}
+	return nil
+}
+
+// sufficientRuns returns true if the cached results recorded in the given runs file have enough
+// successful runs to satisfy the current requirement. If the file doesn't exist the results
+// are assumed to be from a single run.
+func sufficientRuns(filename string, successesRequired int) bool {
+	numSucceeded := 1
+	if b, err := ioutil.ReadFile(filename); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+			numSucceeded = n
+		}
+	}
+	return numSucceeded >= successesRequired
+}
+
+// NumRuns returns how many times the given test will be run in total and how many of those
+// runs must pass, taking into account its flakiness and the flags in the current build state.
+func NumRuns(state *core.BuildState, target *core.BuildTarget) (int, int) {
+	if state.RepeatUntilFailure > 0 {
+		// Here we're trying to make it fail, so every run has to pass and we stop at the first that doesn't.
+		return state.RepeatUntilFailure, state.RepeatUntilFailure
+	}
+	numRuns, successesRequired := calcNumRuns(state.NumTestRuns, target.Flakiness)
+	if state.FlakyMajority {
+		numRuns, successesRequired = calcMajorityRuns(state.NumTestRuns, target.Flakiness)
+	}
+	if target.ExpectedToFail {
+		// An expected failure only counts as unexpectedly passing if every run passes;
+		// a single failure is enough to confirm it's still broken.
+		successesRequired = numRuns
+	}
+	return numRuns, successesRequired
+}
+
 // calcNumRuns works out how many total runs we should have for a test, and how many successes
 // are required for it to count as success.
 func calcNumRuns(numRuns, flakiness int) (int, int) {
@@ -375,3 +804,35 @@ func calcNumRuns(numRuns, flakiness int) (int, int) {
 	}
 	return 1, 1
 }
+
+// calcMajorityRuns is like calcNumRuns but for --flaky_policy=majority, where a test must
+// succeed in more than half of its runs to pass.
+func calcMajorityRuns(numRuns, flakiness int) (int, int) {
+	if numRuns <= 0 {
+		numRuns = flakiness
+	}
+	if numRuns <= 0 {
+		return 1, 1
+	}
+	return numRuns, numRuns/2 + 1
+}
+
+// maxFlakyTimeoutMultiplier is the largest multiplier we'll apply to the timeout of successive test runs.
+const maxFlakyTimeoutMultiplier = 10.0
+
+// maxTimedOutRuns is the number of runs of a test that can time out before we abandon the rest.
+// It only matters when the timeout grows between runs; otherwise we give up after the first.
+const maxTimedOutRuns = 2
+
+// calcTimeout works out the timeout for a particular run of a test (1-indexed), given the
+// base timeout for the test and the multiplier to apply to successive runs.
+// A multiplier of 1 uses the same timeout for every run; larger values increase it linearly, so
+// that for a multiplier of 2 the second run gets double the original timeout, the third triple, etc.
+func calcTimeout(timeout time.Duration, run int, multiplier float64) time.Duration {
+	if multiplier <= 1.0 || run <= 1 {
+		return timeout
+	} else if multiplier > maxFlakyTimeoutMultiplier {
+		multiplier = maxFlakyTimeoutMultiplier
+	}
+	return time.Duration(float64(timeout) * (1.0 + float64(run-1)*(multiplier-1.0)))
+}
@@ -1,9 +1,16 @@
 package test
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"core"
 )
 
 func TestCalcNumRuns(t *testing.T) {
@@ -24,3 +31,321 @@ func TestCalcNumRuns(t *testing.T) {
 	assert.Equal(t, nr(6, 2), nr(calcNumRuns(6, 3)))
 	assert.Equal(t, nr(7, 3), nr(calcNumRuns(7, 3)))
 }
+
+func TestCalcMajorityRuns(t *testing.T) {
+	// Helper for assert
+	nr := func(a, b int) []interface{} { return []interface{}{a, b} }
+
+	// Base case when no flags are passed
+	assert.Equal(t, nr(1, 1), nr(calcMajorityRuns(0, 0)))
+	// Flaky test; run n times, more than half must succeed
+	assert.Equal(t, nr(3, 2), nr(calcMajorityRuns(0, 3)))
+	assert.Equal(t, nr(4, 3), nr(calcMajorityRuns(0, 4)))
+	// Non-flaky test with multiple runs; the policy applies to it too
+	assert.Equal(t, nr(5, 3), nr(calcMajorityRuns(5, 0)))
+	assert.Equal(t, nr(6, 4), nr(calcMajorityRuns(6, 0)))
+	// When we pass both flags the number of runs wins and flakiness is ignored.
+	assert.Equal(t, nr(1, 1), nr(calcMajorityRuns(1, 3)))
+	assert.Equal(t, nr(2, 2), nr(calcMajorityRuns(2, 3)))
+	assert.Equal(t, nr(7, 4), nr(calcMajorityRuns(7, 3)))
+	assert.Equal(t, nr(8, 5), nr(calcMajorityRuns(8, 3)))
+}
+
+func TestCalcTimeout(t *testing.T) {
+	// Default multiplier leaves the timeout unchanged for every run.
+	assert.Equal(t, 10*time.Second, calcTimeout(10*time.Second, 1, 1.0))
+	assert.Equal(t, 10*time.Second, calcTimeout(10*time.Second, 3, 1.0))
+	// The first run always gets the base timeout.
+	assert.Equal(t, 10*time.Second, calcTimeout(10*time.Second, 1, 2.0))
+	// Subsequent runs are increased linearly.
+	assert.Equal(t, 20*time.Second, calcTimeout(10*time.Second, 2, 2.0))
+	assert.Equal(t, 30*time.Second, calcTimeout(10*time.Second, 3, 2.0))
+	assert.Equal(t, 20*time.Second, calcTimeout(10*time.Second, 3, 1.5))
+	// Multipliers below 1 are ignored, and very large ones are clamped.
+	assert.Equal(t, 10*time.Second, calcTimeout(10*time.Second, 3, 0.5))
+	assert.Equal(t, 190*time.Second, calcTimeout(10*time.Second, 3, 100.0))
+}
+
+func TestSufficientRuns(t *testing.T) {
+	// A missing file is treated as a single successful run.
+	assert.True(t, sufficientRuns("plz-out/tmp/.test_runs_missing", 1))
+	assert.False(t, sufficientRuns("plz-out/tmp/.test_runs_missing", 3))
+	// Otherwise it's as many runs as recorded.
+	assert.NoError(t, os.MkdirAll("plz-out/tmp", os.ModeDir|0775))
+	assert.NoError(t, ioutil.WriteFile("plz-out/tmp/.test_runs_five", []byte("5"), 0644))
+	assert.True(t, sufficientRuns("plz-out/tmp/.test_runs_five", 1))
+	assert.True(t, sufficientRuns("plz-out/tmp/.test_runs_five", 5))
+	assert.False(t, sufficientRuns("plz-out/tmp/.test_runs_five", 6))
+}
+
+func TestTestFilterEnvironment(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:filter_test", ""))
+	target.IsTest = true
+	assert.NotContains(t, testEnvironment(state, target, 1), "PLZ_TEST_FILTER=")
+	state.TestFilter = "Parser.*"
+	assert.Contains(t, testEnvironment(state, target, 1), "PLZ_TEST_FILTER=Parser.*")
+}
+
+func TestTestSeedEnvironment(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	state.TestSeed = 42
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:seed_test", ""))
+	_, present := envValue(testEnvironment(state, target, 1), "PLZ_TEST_SEED")
+	assert.False(t, present, "Only shuffled tests should get a seed")
+
+	target.Shuffle = true
+	seed, _ := envValue(testEnvironment(state, target, 1), "PLZ_TEST_SEED")
+	assert.Equal(t, "42", seed)
+	// Each successive run gets the next seed, so any of them can be reproduced with --test_seed.
+	seed, _ = envValue(testEnvironment(state, target, 3), "PLZ_TEST_SEED")
+	assert.Equal(t, "44", seed)
+
+	// Zero is a seed like any other.
+	state.TestSeed = 0
+	seed, _ = envValue(testEnvironment(state, target, 1), "PLZ_TEST_SEED")
+	assert.Equal(t, "0", seed)
+}
+
+func TestTestSeed(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	state.TestSeed = 1000
+	assert.EqualValues(t, 1000, testSeed(state, 1))
+	assert.EqualValues(t, 1001, testSeed(state, 2))
+	assert.EqualValues(t, 1009, testSeed(state, 10))
+	state.TestSeed = -5
+	assert.EqualValues(t, -5, testSeed(state, 1))
+	assert.EqualValues(t, -4, testSeed(state, 2))
+}
+
+func TestPassEnv(t *testing.T) {
+	os.Setenv("PLZ_PASS_ENV_TEST_VAR", "wibble")
+	defer os.Unsetenv("PLZ_PASS_ENV_TEST_VAR")
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:pass_env_test", ""))
+	target.IsTest = true
+	env := testEnvironment(state, target, 1)
+	assert.NotContains(t, env, "PLZ_PASS_ENV_TEST_VAR=wibble")
+	_, present := envValue(env, "HOME")
+	assert.True(t, present, "Non-hermetic tests still get the variables Please sets")
+	target.PassEnv = []string{"PLZ_PASS_ENV_TEST_VAR", "PLZ_UNSET_TEST_VAR"}
+	env = testEnvironment(state, target, 1)
+	assert.Contains(t, env, "PLZ_PASS_ENV_TEST_VAR=wibble")
+	_, present = envValue(env, "PLZ_UNSET_TEST_VAR")
+	assert.False(t, present, "Variables that aren't set shouldn't be passed at all")
+}
+
+func TestHermeticEnv(t *testing.T) {
+	os.Setenv("PLZ_PASS_ENV_TEST_VAR", "wibble")
+	defer os.Unsetenv("PLZ_PASS_ENV_TEST_VAR")
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	state.HermeticTestEnv = true
+	state.TestFilter = "Parser.*"
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:hermetic_env_test", ""))
+	target.IsTest = true
+	target.PassEnv = []string{"PLZ_PASS_ENV_TEST_VAR"}
+	env := testEnvironment(state, target, 1)
+	assert.Contains(t, env, "PLZ_PASS_ENV_TEST_VAR=wibble")
+	assert.Contains(t, env, "PLZ_TEST_FILTER=Parser.*")
+	for _, name := range []string{"PATH", "TEST_DIR", "TMPDIR"} {
+		_, present := envValue(env, name)
+		assert.True(t, present, "%s should still be set", name)
+	}
+	for _, name := range []string{"HOME", "LANG", "PKG", "BUILD_CONFIG"} {
+		_, present := envValue(env, name)
+		assert.False(t, present, "%s should have been unset", name)
+	}
+	// Variables that Please sets can be asked for explicitly too.
+	target.PassEnv = []string{"HOME"}
+	home, present := envValue(testEnvironment(state, target, 1), "HOME")
+	assert.True(t, present)
+	assert.Contains(t, home, target.TestDir())
+	// Sandboxing doesn't change the environment at all.
+	target.TestSandbox = true
+	sandboxed := testEnvironment(state, target, 1)
+	target.TestSandbox = false
+	assert.Equal(t, sandboxed, testEnvironment(state, target, 1))
+}
+
+func TestSymlinkData(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "symlink_data_test")
+	defer os.RemoveAll(dir)
+	from := path.Join(dir, "data")
+	to := path.Join(dir, "test/data")
+	os.MkdirAll(path.Join(from, "sub"), core.DirPermissions)
+	ioutil.WriteFile(path.Join(from, "fixture"), []byte("fixture"), 0444)
+	ioutil.WriteFile(path.Join(from, "sub/writable"), []byte("writable"), 0644)
+	assert.NoError(t, symlinkData(from, to))
+
+	info, err := os.Lstat(to)
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir(), "Directories should be recreated, not symlinked")
+	dest, err := os.Readlink(path.Join(to, "fixture"))
+	assert.NoError(t, err)
+	assert.Equal(t, path.Join(from, "fixture"), dest)
+	// The target has declared its data as read-only, so it doesn't matter what the permissions are.
+	dest, err = os.Readlink(path.Join(to, "sub/writable"))
+	assert.NoError(t, err)
+	assert.Equal(t, path.Join(from, "sub/writable"), dest)
+
+	assert.Error(t, symlinkData(path.Join(dir, "missing"), to))
+}
+
+func TestSymlinkableData(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:symlink_test", ""))
+	target.Data = append(target.Data, core.FileLabel{File: "fixture", Package: "src/test"})
+	graph := core.NewGraph()
+	assert.Equal(t, 0, len(symlinkableData(graph, target)))
+	target.SymlinkData = true
+	assert.Equal(t, map[string]bool{"src/test/fixture": true}, symlinkableData(graph, target))
+	target.Containerise = true
+	assert.Equal(t, 0, len(symlinkableData(graph, target)))
+	target.Containerise = false
+	target.TestSandbox = true
+	assert.Equal(t, 0, len(symlinkableData(graph, target)))
+}
+
+func TestRetryableFailure(t *testing.T) {
+	regex := regexp.MustCompile("connection refused")
+	assert.True(t, retryableFailure(regex, "dial tcp 127.0.0.1:8080: connection refused", nil, 0))
+	assert.False(t, retryableFailure(regex, "expected 1, got 2", nil, 0))
+	failures := []core.TestFailure{
+		{Name: "TestFirstRun", Traceback: "connection refused"},
+		{Name: "TestSecondRun", Traceback: "expected 1, got 2"},
+	}
+	// Only failures from this run count.
+	assert.False(t, retryableFailure(regex, "", failures, 1))
+	assert.True(t, retryableFailure(regex, "", failures, 0))
+	failures[1].Stderr = "connection refused"
+	assert.True(t, retryableFailure(regex, "", failures, 1))
+	// If the failures got replaced by this run they're all considered.
+	assert.True(t, retryableFailure(regex, "", failures[:1], 3))
+}
+
+func TestRepeatUntilFailure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "repeat_until_failure_test")
+	defer os.RemoveAll(dir)
+	counter := path.Join(dir, "counter")
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	state.Config.Build.Path = []string{"/usr/local/bin", "/usr/bin", "/bin"}
+	state.RepeatUntilFailure = 5
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:repeat_until_failure", ""))
+	target.IsTest = true
+	target.NoTestOutput = true
+	// Passes twice, then fails.
+	target.TestCommand = "echo >> " + counter + "; test `wc -l < " + counter + "` -lt 3"
+	target.SetState(core.Built)
+	state.Graph.AddTarget(target)
+	test(0, state, target.Label, target)
+	assert.Equal(t, 3, len(target.Results.RunDurations), "Should stop at the first failure")
+	assert.Equal(t, []bool{true, true, false}, target.Results.RunPassed)
+	assert.Equal(t, 2, target.Results.SuccessfulRuns)
+}
+
+func TestFailFastFlakes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fail_fast_flakes_test")
+	defer os.RemoveAll(dir)
+	counter := path.Join(dir, "counter")
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	state.Config.Build.Path = []string{"/usr/local/bin", "/usr/bin", "/bin"}
+	state.NumTestRuns = 5
+	state.FailFastFlakes = true
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:fail_fast_flakes", ""))
+	target.IsTest = true
+	target.NoTestOutput = true
+	// Passes on the first run, fails on the second, then passes from then on.
+	target.TestCommand = "echo >> " + counter + "; test `wc -l < " + counter + "` -ne 2"
+	target.SetState(core.Built)
+	state.Graph.AddTarget(target)
+	test(0, state, target.Label, target)
+	assert.Equal(t, 2, len(target.Results.RunDurations), "Should stop once it's both passed and failed")
+	assert.Equal(t, []bool{true, false}, target.Results.RunPassed)
+	assert.Equal(t, 1, target.Results.Flakes)
+	// It had to pass all five times, so it's still a failure, just a flaky one.
+	assert.Equal(t, core.TargetTestFailed, target.Results.Status)
+	assert.Equal(t, "fail", jsonTarget(target).Result)
+	assert.True(t, jsonTarget(target).Flaky)
+}
+
+func TestFailFastFlakesRunsEverythingIfItPasses(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	state.Config.Build.Path = []string{"/usr/local/bin", "/usr/bin", "/bin"}
+	state.NumTestRuns = 3
+	state.FailFastFlakes = true
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:fail_fast_flakes_pass", ""))
+	target.IsTest = true
+	target.NoTestOutput = true
+	target.TestCommand = "true"
+	target.SetState(core.Built)
+	state.Graph.AddTarget(target)
+	assert.NoError(t, os.MkdirAll(target.OutDir(), core.DirPermissions)) // Results get moved there when it passes.
+	test(0, state, target.Label, target)
+	assert.Equal(t, 3, len(target.Results.RunDurations))
+	assert.Equal(t, 0, target.Results.Flakes)
+	assert.Equal(t, core.TargetTested, target.Results.Status)
+	assert.Equal(t, "pass", jsonTarget(target).Result)
+}
+
+func TestTimedOutRunsAreAbandoned(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	state.Config.Build.Path = []string{"/usr/local/bin", "/usr/bin", "/bin"}
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:timed_out_runs", ""))
+	target.IsTest = true
+	target.NoTestOutput = true
+	target.Flakiness = 5
+	target.TestTimeout = 100 * time.Millisecond
+	target.TestCommand = "exec sleep 10"
+	target.SetState(core.Built)
+	state.Graph.AddTarget(target)
+	test(0, state, target.Label, target)
+	assert.True(t, target.Results.TimedOut)
+	assert.Equal(t, 1, len(target.Results.RunDurations), "Shouldn't rerun with the same timeout")
+
+	// A growing timeout gets another go, but it doesn't keep going until it runs out of runs.
+	state.FlakyTimeoutMultiplier = 2.0
+	target.Results = core.TestResults{}
+	test(0, state, target.Label, target)
+	assert.True(t, target.Results.TimedOut)
+	assert.Equal(t, maxTimedOutRuns, len(target.Results.RunDurations))
+	assert.Equal(t, core.TargetTestFailed, target.Results.Status)
+}
+
+func TestMedian(t *testing.T) {
+	assert.Equal(t, 2.0, median([]float64{3.0, 1.0, 2.0}))
+	assert.Equal(t, 2.5, median([]float64{4.0, 1.0, 2.0, 3.0}))
+	assert.Equal(t, 5.0, median([]float64{5.0}))
+}
+
+func TestCheckExpectedDuration(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:expected_duration", ""))
+	target.Results.ExecDurations = []float64{1.0, 30.0, 2.0}
+	assert.NoError(t, checkExpectedDuration(target), "No expected duration, shouldn't be flagged")
+	target.ExpectedDuration = 5 * time.Second
+	assert.NoError(t, checkExpectedDuration(target), "One slow run shouldn't flag it")
+	assert.False(t, target.Results.Slow)
+	target.Results.ExecDurations = []float64{6.0, 30.0, 2.0}
+	assert.Error(t, checkExpectedDuration(target))
+	assert.True(t, target.Results.Slow)
+}
+
+func TestEnforceDurations(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	state.Config.Build.Path = []string{"/usr/local/bin", "/usr/bin", "/bin"}
+	state.EnforceDurations = true
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:enforce_durations", ""))
+	target.IsTest = true
+	target.NoTestOutput = true
+	target.TestCommand = "sleep 1.2"
+	target.ExpectedDuration = time.Second
+	target.SetState(core.Built)
+	state.Graph.AddTarget(target)
+	test(0, state, target.Label, target)
+	assert.True(t, target.Results.Slow)
+	assert.Equal(t, 1, len(target.Results.ExecDurations))
+	assert.True(t, target.Results.ExecDurations[0] >= 1.2)
+	result := <-state.Results
+	for result.Status != core.TargetTestFailed && result.Status != core.TargetTested {
+		result = <-state.Results
+	}
+	assert.Equal(t, core.TargetTestFailed, result.Status)
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 
 	"core"
@@ -18,6 +19,7 @@ func parseJUnitXMLTestResults(bytes []byte) (core.TestResults, error) {
 	if err := xml.Unmarshal(bytes, &junitCase); err != nil {
 		return results, err
 	}
+	appendProperties(junitCase.Properties, &results)
 	for _, test := range junitCase.Tests {
 		appendResult(test, &results)
 	}
@@ -25,6 +27,7 @@ func parseJUnitXMLTestResults(bytes []byte) (core.TestResults, error) {
 		appendResult(test, &results)
 	}
 	for _, suite := range junitCase.TestSuites {
+		appendProperties(suite.Properties, &results)
 		for _, test := range suite.TestCases {
 			appendResult(test, &results)
 		}
@@ -57,6 +60,16 @@ func appendResult2(test JUnitXMLTest, results *core.TestResults, failure JUnitXM
 	})
 }
 
+func appendProperties(properties []JUnitXMLProperty, results *core.TestResults) {
+	for _, property := range properties {
+		results.Properties = append(results.Properties, core.TestProperty{
+			Name:  property.Name,
+			Value: property.Value,
+			Run:   property.Run,
+		})
+	}
+}
+
 func messageOrTraceback(failure JUnitXMLFailure) string {
 	if failure.Traceback != "" {
 		return failure.Traceback
@@ -75,6 +88,7 @@ func combineNames(className string, name string) string {
 }
 
 type JUnitXMLTestResults struct {
+	Properties []JUnitXMLProperty  `xml:"properties>property"`
 	TestSuites []JUnitXMLTestSuite `xml:"testsuite"`
 	TestCases  []JUnitXMLTest      `xml:"testcase"`
 	Tests      []JUnitXMLTest      `xml:"test"`
@@ -82,10 +96,19 @@ type JUnitXMLTestResults struct {
 }
 
 type JUnitXMLTestSuite struct {
-	Name      string         `xml:"name,attr"`
-	Failures  int            `xml:"failures,attr,omitempty"`
-	Tests     int            `xml:"tests,attr"`
-	TestCases []JUnitXMLTest `xml:"testcase"`
+	Name       string             `xml:"name,attr"`
+	Failures   int                `xml:"failures,attr,omitempty"`
+	Tests      int                `xml:"tests,attr"`
+	Time       float64            `xml:"time,attr,omitempty"`
+	RunTimes   string             `xml:"runtimes,attr,omitempty"`
+	Properties []JUnitXMLProperty `xml:"properties>property"`
+	TestCases  []JUnitXMLTest     `xml:"testcase"`
+}
+
+type JUnitXMLProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+	Run   int    `xml:"run,attr,omitempty"`
 }
 
 type JUnitXMLTest struct {
@@ -109,9 +132,6 @@ type JUnitXMLFailure struct {
 
 // Write test results out to a file in xUnit format. Dies on any errors.
 func WriteResultsToFileOrDie(graph *core.BuildGraph, filename string) {
-	if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
-		log.Fatalf("Failed to create directory for test output")
-	}
 	results := JUnitXMLTestResults{}
 	results.XMLName.Local = "testsuites"
 	for _, target := range graph.AllTargets() {
@@ -120,6 +140,17 @@ func WriteResultsToFileOrDie(graph *core.BuildGraph, filename string) {
 				Name:     target.Label.String(),
 				Failures: target.Results.Failed,
 				Tests:    target.Results.NumTests,
+				Time:     target.Results.Duration,
+			}
+			if len(target.Results.RunDurations) > 1 {
+				suite.RunTimes = formatRunTimes(target.Results.RunDurations)
+			}
+			for _, property := range target.Results.Properties {
+				suite.Properties = append(suite.Properties, JUnitXMLProperty{
+					Name:  property.Name,
+					Value: property.Value,
+					Run:   property.Run,
+				})
 			}
 			for _, pass := range target.Results.Passes {
 				suite.TestCases = append(suite.TestCases, JUnitXMLTest{Name: pass})
@@ -139,9 +170,85 @@ func WriteResultsToFileOrDie(graph *core.BuildGraph, filename string) {
 			results.TestSuites = append(results.TestSuites, suite)
 		}
 	}
+	writeResultsOrDie(results, filename)
+}
+
+// MergeResultsFilesOrDie merges several results files written by WriteResultsToFileOrDie
+// (typically from separate shards of the same set of tests) into one. Test cases that appear in
+// more than one file (eg. from targets that don't support sharding, which are run in full on every
+// shard) are only counted once; if any of them failed the merged result is that failure, otherwise
+// it's the first one seen. Dies on any errors.
+func MergeResultsFilesOrDie(filenames []string, filename string) {
+	merged := JUnitXMLTestResults{}
+	merged.XMLName.Local = "testsuites"
+	suites := map[string]int{}
+	properties := map[string]bool{}
+	tests := map[string]int{} // Indices into the TestCases of the suite they belong to.
+	for _, input := range filenames {
+		b, err := ioutil.ReadFile(input)
+		if err != nil {
+			log.Fatalf("Failed to read test results file: %s", err)
+		}
+		results := JUnitXMLTestResults{}
+		if err := xml.Unmarshal(b, &results); err != nil {
+			log.Fatalf("Failed to parse test results file %s: %s", input, err)
+		}
+		for _, suite := range results.TestSuites {
+			i, present := suites[suite.Name]
+			if !present {
+				i = len(merged.TestSuites)
+				suites[suite.Name] = i
+				merged.TestSuites = append(merged.TestSuites, JUnitXMLTestSuite{Name: suite.Name})
+			}
+			s := &merged.TestSuites[i]
+			s.Time += suite.Time
+			for _, property := range suite.Properties {
+				if key := suite.Name + "\x00" + property.Name + "\x00" + property.Value; !properties[key] {
+					properties[key] = true
+					s.Properties = append(s.Properties, property)
+				}
+			}
+			for _, test := range suite.TestCases {
+				key := suite.Name + "\x00" + test.ClassName + "\x00" + test.Name
+				if j, present := tests[key]; !present {
+					tests[key] = len(s.TestCases)
+					s.Tests++
+					if testCaseFailed(test) {
+						s.Failures++
+					}
+					s.TestCases = append(s.TestCases, test)
+				} else if testCaseFailed(test) && !testCaseFailed(s.TestCases[j]) {
+					s.Failures++
+					s.TestCases[j] = test
+				}
+			}
+		}
+	}
+	writeResultsOrDie(merged, filename)
+}
+
+// testCaseFailed returns true if the given test case failed or errored.
+func testCaseFailed(test JUnitXMLTest) bool {
+	return test.Error != nil || test.Failure != nil
+}
+
+// writeResultsOrDie writes the given results to a file. Dies on any errors.
+func writeResultsOrDie(results JUnitXMLTestResults, filename string) {
+	if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+		log.Fatalf("Failed to create directory for test output")
+	}
 	if b, err := xml.MarshalIndent(results, "", "    "); err != nil {
 		log.Fatalf("Failed to serialise XML: %s", err)
 	} else if err = ioutil.WriteFile(filename, b, 0644); err != nil {
 		log.Fatalf("Failed to write XML to %s: %s", filename, err)
 	}
 }
+
+// formatRunTimes formats the durations of each run of a test as a space-separated list.
+func formatRunTimes(durations []float64) string {
+	times := make([]string, len(durations))
+	for i, duration := range durations {
+		times[i] = strconv.FormatFloat(duration, 'f', 3, 64)
+	}
+	return strings.Join(times, " ")
+}
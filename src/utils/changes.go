@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"core"
+)
+
+// ChangedFiles returns the files that have changed in the working tree since the given git
+// revision, including any untracked files. Files that have been deleted are returned separately
+// since they no longer belong to any build target.
+// All paths are relative to the repo root.
+func ChangedFiles(since string) (changed, deleted []string, err error) {
+	if changed, err = git("diff", "--name-only", "--relative", "--no-renames", "--diff-filter=d", since); err != nil {
+		return nil, nil, err
+	}
+	untracked, err := git("ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, nil, err
+	}
+	if deleted, err = git("diff", "--name-only", "--relative", "--no-renames", "--diff-filter=D", since); err != nil {
+		return nil, nil, err
+	}
+	return append(changed, untracked...), deleted, nil
+}
+
+// git runs a git command in the repo root and returns the lines of its output.
+func git(args ...string) ([]string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = core.RepoRoot
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed: %s", strings.Join(args, " "), err)
+	}
+	ret := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			ret = append(ret, line)
+		}
+	}
+	return ret, nil
+}
@@ -9,11 +9,15 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/kardianos/osext"
-	"github.com/streamrail/concurrent-map"
 	"gopkg.in/op/go-logging.v1"
 
 	"core"
@@ -23,8 +27,8 @@ var log = logging.MustGetLogger("watch")
 
 const debounceInterval = 50 * time.Millisecond
 
-// Watch starts watching the sources of the given labels for changes and triggers
-// rebuilds whenever they change.
+// Watch builds (or tests) the given labels, then watches their sources for changes and triggers
+// rebuilds whenever they change. Only the labels affected by any given change are rebuilt.
 // It never returns successfully, it will either watch forever or die.
 func Watch(state *core.BuildState, labels []core.BuildLabel) {
 	watcher, err := fsnotify.NewWatcher()
@@ -32,7 +36,7 @@ func Watch(state *core.BuildState, labels []core.BuildLabel) {
 		log.Fatalf("Error setting up watcher: %s", err)
 	}
 	// This sets up the actual watches. It must be done in a separate goroutine.
-	files := cmap.New()
+	files := newWatchedFiles()
 	go startWatching(watcher, state, labels, files)
 
 	// If any of the targets are tests, we'll run plz test, otherwise just plz build.
@@ -45,31 +49,81 @@ func Watch(state *core.BuildState, labels []core.BuildLabel) {
 	}
 	log.Notice("Command: %s", command)
 
+	// Build or test everything once to start with, exactly as later changes will be.
+	changes := newChangeSet()
+	for _, label := range labels {
+		changes.labels[label] = true
+	}
+	rebuild(watcher, files, state, command, changes)
 	for {
 		select {
 		case event := <-watcher.Events:
 			log.Info("Event: %s", event)
-			if !files.Has(event.Name) {
+			changes = newChangeSet()
+			if !changes.Add(files, event) {
 				log.Notice("Skipping notification for %s", event.Name)
 				continue
 			}
-			// Quick debounce; poll and discard all events for the next brief period.
-		outer:
-			for {
-				select {
-				case <-watcher.Events:
-				case <-time.After(debounceInterval):
-					break outer
-				}
-			}
-			runBuild(state, command, labels)
+			debounce(watcher, files, changes)
+			rebuild(watcher, files, state, command, changes)
 		case err := <-watcher.Errors:
 			log.Error("Error watching files:", err)
 		}
 	}
 }
 
-func runBuild(state *core.BuildState, command string, labels []core.BuildLabel) {
+// rebuild runs the given command on the labels in a set of changes until it completes without
+// anything else changing, or restarts this process if the changes need the graph to be reparsed.
+func rebuild(watcher *fsnotify.Watcher, files *watchedFiles, state *core.BuildState, command string, changes *changeSet) {
+	for !changes.NeedsReparse() && !startBuild(state, command, changes.Labels()).Wait(watcher, files, changes) {
+		// Something else changed while we were building; start again with everything that's changed.
+		debounce(watcher, files, changes)
+	}
+	if changes.NeedsReparse() {
+		// Building against the graph we've got would be wasted effort since it's out of date.
+		// The restarted process reparses everything and rebuilds the targets from scratch.
+		restart()
+	}
+}
+
+// debounce polls for further events for a brief period and adds them to the given set of changes.
+func debounce(watcher *fsnotify.Watcher, files *watchedFiles, changes *changeSet) {
+	for {
+		select {
+		case event := <-watcher.Events:
+			changes.Add(files, event)
+		case <-time.After(debounceInterval):
+			return
+		}
+	}
+}
+
+// restart re-executes this process. We do this when BUILD files change since the graph will
+// need to be reparsed, and we don't have a way of incrementally updating our own copy of it.
+func restart() {
+	binary, err := osext.Executable()
+	if err != nil {
+		log.Fatalf("Can't determine current executable to restart watching: %s", err)
+	}
+	log.Notice("Build files have changed, restarting watch...")
+	if err := syscall.Exec(binary, os.Args, os.Environ()); err != nil {
+		log.Fatalf("Failed to restart watch: %s", err)
+	}
+}
+
+// A build is a single invocation of plz build or plz test.
+type build struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// startBuild starts a new build of the given labels in the background.
+func startBuild(state *core.BuildState, command string, labels []core.BuildLabel) *build {
+	return runBuild(buildCommand(state, command, labels))
+}
+
+// buildCommand returns the command that runs plz build or plz test on the given labels.
+func buildCommand(state *core.BuildState, command string, labels []core.BuildLabel) *exec.Cmd {
 	binary, err := osext.Executable()
 	if err != nil {
 		log.Warning("Can't determine current executable, will assume 'plz'")
@@ -77,74 +131,259 @@ func runBuild(state *core.BuildState, command string, labels []core.BuildLabel)
 	}
 	cmd := exec.Command(binary, command)
 	cmd.Args = append(cmd.Args, "-c", state.Config.Build.Config)
+	if command == "test" {
+		cmd.Args = append(cmd.Args, testFlags(state)...)
+	}
 	for _, label := range labels {
 		cmd.Args = append(cmd.Args, label.String())
 	}
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	log.Notice("Running %s %s...", binary, command)
-	if err := cmd.Run(); err != nil {
-		// Only log the error if it's not a straightforward non-zero exit; the user will presumably
-		// already have been pestered about that.
-		if _, ok := err.(*exec.ExitError); !ok {
-			log.Error("Failed to run %s: %s", binary, err)
-		}
-	}
+	return cmd
 }
 
-func startWatching(watcher *fsnotify.Watcher, state *core.BuildState, labels []core.BuildLabel, files cmap.ConcurrentMap) {
-	// Deduplicate seen targets & sources.
-	targets := map[*core.BuildTarget]struct{}{}
-	dirs := map[string]struct{}{}
+// testFlags returns the flags to pass to plz test so it runs tests the same way we were asked to.
+func testFlags(state *core.BuildState) []string {
+	flags := []string{}
+	if state.NumTestRuns > 0 {
+		flags = append(flags, "--num_runs", strconv.Itoa(state.NumTestRuns))
+	}
+	if state.RepeatUntilFailure > 0 {
+		flags = append(flags, "--repeat_until_failure", strconv.Itoa(state.RepeatUntilFailure))
+	}
+	if state.FlakyTimeoutMultiplier != 0 && state.FlakyTimeoutMultiplier != 1.0 {
+		flags = append(flags, "--flaky_timeout_multiplier", strconv.FormatFloat(state.FlakyTimeoutMultiplier, 'g', -1, 64))
+	}
+	if state.FailFastFlakes {
+		flags = append(flags, "--fail_fast_flakes")
+	}
+	if state.FlakyMajority {
+		flags = append(flags, "--flaky_policy", "majority")
+	}
+	if state.EnforceDurations {
+		flags = append(flags, "--enforce_durations")
+	}
+	if state.TestFilter != "" {
+		flags = append(flags, "--test_filter", state.TestFilter)
+	}
+	if state.HermeticTestEnv {
+		flags = append(flags, "--hermetic_env")
+	}
+	if state.ShowTestOutput {
+		flags = append(flags, "--show_output")
+	}
+	return flags
+}
 
-	var startWatch func(*core.BuildTarget)
-	startWatch = func(target *core.BuildTarget) {
-		if _, present := targets[target]; present {
-			return
-		}
-		targets[target] = struct{}{}
-		for _, source := range target.AllSources() {
-			addSource(watcher, state, source, dirs, files)
-		}
-		for _, datum := range target.Data {
-			addSource(watcher, state, datum, dirs, files)
-		}
-		for _, dep := range target.Dependencies() {
-			startWatch(dep)
-		}
-		pkg := state.Graph.PackageOrDie(target.Label.PackageName)
-		if !files.Has(pkg.Filename) {
-			log.Notice("Adding watch on %s", pkg.Filename)
-			files.Set(pkg.Filename, struct{}{})
+// runBuild runs the given command in the background.
+func runBuild(cmd *exec.Cmd) *build {
+	log.Notice("Running %s %s...", cmd.Path, strings.Join(cmd.Args[1:], " "))
+	b := &build{cmd: cmd, done: make(chan struct{})}
+	// Start it here rather than in the goroutine so Stop can always find the process.
+	if err := cmd.Start(); err != nil {
+		log.Error("Failed to run %s: %s", cmd.Path, err)
+		close(b.done)
+		return b
+	}
+	go func() {
+		defer close(b.done)
+		if err := cmd.Wait(); err != nil {
+			// Only log the error if it's not a straightforward non-zero exit; the user will presumably
+			// already have been pestered about that.
+			if _, ok := err.(*exec.ExitError); !ok {
+				log.Error("Failed to run %s: %s", cmd.Path, err)
+			}
 		}
-		for _, subinclude := range pkg.Subincludes {
-			startWatch(state.Graph.TargetOrDie(subinclude))
+	}()
+	return b
+}
+
+// Wait waits for the build to finish. Any changes that arrive in the meantime are added to
+// the given set; if any of them are relevant the build is stopped early and Wait returns false.
+func (b *build) Wait(watcher *fsnotify.Watcher, files *watchedFiles, changes *changeSet) bool {
+	for {
+		select {
+		case <-b.done:
+			return true
+		case event := <-watcher.Events:
+			if changes.Add(files, event) {
+				log.Notice("%s changed while building, restarting...", event.Name)
+				b.Stop()
+				return false
+			}
+		case err := <-watcher.Errors:
+			log.Error("Error watching files:", err)
 		}
 	}
+}
+
+// Stop interrupts the build and waits for it to exit.
+func (b *build) Stop() {
+	if b.cmd.Process != nil {
+		// Interrupt rather than killing so plz gets a chance to clean up its own subprocesses.
+		b.cmd.Process.Signal(os.Interrupt)
+	}
+	<-b.done
+}
+
+// A changeSet accumulates the labels that need rebuilding after a series of filesystem events.
+type changeSet struct {
+	labels  map[core.BuildLabel]bool
+	reparse bool
+}
+
+func newChangeSet() *changeSet {
+	return &changeSet{labels: map[core.BuildLabel]bool{}}
+}
+
+// Add adds the labels affected by the given event. It returns true if the event was relevant.
+func (changes *changeSet) Add(files *watchedFiles, event fsnotify.Event) bool {
+	labels, isBuildFile := files.Get(event.Name)
+	if len(labels) == 0 && event.Op&fsnotify.Create != 0 && !isTempFile(event.Name) {
+		// New files don't belong to anything yet, but they may well be picked up by a glob
+		// in the package they're in. Treat them like a change to its BUILD file.
+		labels = files.GetDir(path.Dir(event.Name))
+		isBuildFile = len(labels) > 0
+	}
+	for _, label := range labels {
+		changes.labels[label] = true
+	}
+	changes.reparse = changes.reparse || isBuildFile
+	return len(labels) > 0
+}
+
+// isTempFile returns true if the given file looks like a temporary or backup file that an editor has created.
+func isTempFile(filename string) bool {
+	base := path.Base(filename)
+	return strings.HasPrefix(base, ".") || strings.HasPrefix(base, "#") || strings.HasSuffix(base, "~") || base == "4913"
+}
+
+// Labels returns the labels that have changed, in a consistent order.
+func (changes *changeSet) Labels() []core.BuildLabel {
+	labels := make(core.BuildLabels, 0, len(changes.labels))
+	for label := range changes.labels {
+		labels = append(labels, label)
+	}
+	sort.Sort(labels)
+	return labels
+}
+
+// NeedsReparse returns true if any of the changes may have altered the build graph.
+func (changes *changeSet) NeedsReparse() bool {
+	return changes.reparse
+}
+
+// watchedFiles records the files we're watching and which of the original labels depend on each.
+// It's safe for concurrent use since watches are set up in the background.
+type watchedFiles struct {
+	files      map[string]map[core.BuildLabel]bool
+	dirs       map[string]map[core.BuildLabel]bool
+	buildFiles map[string]bool
+	mutex      sync.Mutex
+}
+
+func newWatchedFiles() *watchedFiles {
+	return &watchedFiles{
+		files:      map[string]map[core.BuildLabel]bool{},
+		dirs:       map[string]map[core.BuildLabel]bool{},
+		buildFiles: map[string]bool{},
+	}
+}
+
+// Add records that the given label depends on a file. It returns true if that file wasn't known before.
+func (files *watchedFiles) Add(file string, label core.BuildLabel, isBuildFile bool) bool {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	dir := path.Dir(file)
+	if isBuildFile {
+		files.buildFiles[file] = true
+	} else if info, err := os.Stat(file); err == nil && info.IsDir() {
+		dir = file
+	}
+	add(files.dirs, dir, label)
+	return add(files.files, file, label)
+}
+
+// Get returns the labels that depend on a file and whether it's a BUILD file.
+func (files *watchedFiles) Get(file string) ([]core.BuildLabel, bool) {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	return keys(files.files[file]), files.buildFiles[file]
+}
+
+// GetDir returns the labels that depend on any file in a directory.
+func (files *watchedFiles) GetDir(dir string) []core.BuildLabel {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	return keys(files.dirs[dir])
+}
+
+func add(m map[string]map[core.BuildLabel]bool, key string, label core.BuildLabel) bool {
+	labels, present := m[key]
+	if !present {
+		labels = map[core.BuildLabel]bool{}
+		m[key] = labels
+	}
+	labels[label] = true
+	return !present
+}
+
+func keys(m map[core.BuildLabel]bool) []core.BuildLabel {
+	ret := make([]core.BuildLabel, 0, len(m))
+	for label := range m {
+		ret = append(ret, label)
+	}
+	return ret
+}
+
+func startWatching(watcher *fsnotify.Watcher, state *core.BuildState, labels []core.BuildLabel, files *watchedFiles) {
+	// Deduplicate watched directories across all labels.
+	dirs := map[string]struct{}{}
 
 	for _, label := range labels {
+		// Deduplicate seen targets for this label.
+		targets := map[*core.BuildTarget]struct{}{}
+
+		var startWatch func(*core.BuildTarget)
+		startWatch = func(target *core.BuildTarget) {
+			if _, present := targets[target]; present {
+				return
+			}
+			targets[target] = struct{}{}
+			for _, source := range target.AllSources() {
+				addSource(watcher, state, source, label, dirs, files)
+			}
+			for _, datum := range target.Data {
+				addSource(watcher, state, datum, label, dirs, files)
+			}
+			for _, dep := range target.Dependencies() {
+				startWatch(dep)
+			}
+			pkg := state.Graph.PackageOrDie(target.Label.PackageName)
+			if files.Add(pkg.Filename, label, true) {
+				log.Notice("Adding watch on %s", pkg.Filename)
+				addDir(watcher, path.Dir(pkg.Filename), dirs)
+			}
+			for _, subinclude := range pkg.Subincludes {
+				startWatch(state.Graph.TargetOrDie(subinclude))
+			}
+		}
 		startWatch(state.Graph.TargetOrDie(label))
 	}
 	// Drop a message here so they know when it's actually ready to go.
 	fmt.Println("And now my watch begins...")
 }
 
-func addSource(watcher *fsnotify.Watcher, state *core.BuildState, source core.BuildInput, dirs map[string]struct{}, files cmap.ConcurrentMap) {
+func addSource(watcher *fsnotify.Watcher, state *core.BuildState, source core.BuildInput, label core.BuildLabel, dirs map[string]struct{}, files *watchedFiles) {
 	if source.Label() == nil {
 		for _, src := range source.Paths(state.Graph) {
 			if err := filepath.Walk(src, func(src string, info os.FileInfo, err error) error {
-				files.Set(src, struct{}{})
+				files.Add(src, label, false)
 				dir := src
 				if info, err := os.Stat(src); err == nil && !info.IsDir() {
 					dir = path.Dir(src)
 				}
-				if _, present := dirs[dir]; !present {
-					log.Notice("Adding watch on %s", dir)
-					dirs[dir] = struct{}{}
-					if err := watcher.Add(dir); err != nil {
-						log.Error("Failed to add watch on %s: %s", src, err)
-					}
-				}
+				addDir(watcher, dir, dirs)
 				return err
 			}); err != nil {
 				log.Error("Failed to add watch on %s: %s", src, err)
@@ -152,3 +391,13 @@ func addSource(watcher *fsnotify.Watcher, state *core.BuildState, source core.Bu
 		}
 	}
 }
+
+func addDir(watcher *fsnotify.Watcher, dir string, dirs map[string]struct{}) {
+	if _, present := dirs[dir]; !present {
+		log.Notice("Adding watch on %s", dir)
+		dirs[dir] = struct{}{}
+		if err := watcher.Add(dir); err != nil {
+			log.Error("Failed to add watch on %s: %s", dir, err)
+		}
+	}
+}
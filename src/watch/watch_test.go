@@ -0,0 +1,169 @@
+// +build watch
+
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+var (
+	label1 = core.ParseBuildLabel("//src/watch:target1", "")
+	label2 = core.ParseBuildLabel("//src/watch:target2", "")
+)
+
+func TestChangedSource(t *testing.T) {
+	files := newWatchedFiles()
+	files.Add("src/watch/watch.go", label1, false)
+	files.Add("src/watch/BUILD", label1, true)
+	changes := newChangeSet()
+	assert.True(t, changes.Add(files, fsnotify.Event{Name: "src/watch/watch.go", Op: fsnotify.Write}))
+	assert.Equal(t, []core.BuildLabel{label1}, changes.Labels())
+	assert.False(t, changes.NeedsReparse(), "Changing a source doesn't affect the graph")
+}
+
+func TestChangedBuildFile(t *testing.T) {
+	files := newWatchedFiles()
+	files.Add("src/watch/watch.go", label1, false)
+	files.Add("src/watch/BUILD", label1, true)
+	changes := newChangeSet()
+	assert.True(t, changes.Add(files, fsnotify.Event{Name: "src/watch/BUILD", Op: fsnotify.Write}))
+	assert.Equal(t, []core.BuildLabel{label1}, changes.Labels())
+	assert.True(t, changes.NeedsReparse())
+}
+
+func TestNewFile(t *testing.T) {
+	files := newWatchedFiles()
+	files.Add("src/watch/watch.go", label1, false)
+	changes := newChangeSet()
+	// A new file in a watched directory might be picked up by a glob, so it's treated like a BUILD file change.
+	assert.True(t, changes.Add(files, fsnotify.Event{Name: "src/watch/new.go", Op: fsnotify.Create}))
+	assert.Equal(t, []core.BuildLabel{label1}, changes.Labels())
+	assert.True(t, changes.NeedsReparse())
+}
+
+func TestIrrelevantChanges(t *testing.T) {
+	files := newWatchedFiles()
+	files.Add("src/watch/watch.go", label1, false)
+	changes := newChangeSet()
+	assert.False(t, changes.Add(files, fsnotify.Event{Name: "src/watch/other.go", Op: fsnotify.Write}))
+	assert.False(t, changes.Add(files, fsnotify.Event{Name: "src/core/new.go", Op: fsnotify.Create}))
+	// Editors' temporary files don't count as new files.
+	assert.False(t, changes.Add(files, fsnotify.Event{Name: "src/watch/.watch.go.swp", Op: fsnotify.Create}))
+	assert.False(t, changes.Add(files, fsnotify.Event{Name: "src/watch/watch.go~", Op: fsnotify.Create}))
+	assert.False(t, changes.Add(files, fsnotify.Event{Name: "src/watch/4913", Op: fsnotify.Create}))
+	assert.Equal(t, 0, len(changes.Labels()))
+	assert.False(t, changes.NeedsReparse())
+}
+
+func TestChangesAccumulate(t *testing.T) {
+	files := newWatchedFiles()
+	files.Add("src/watch/watch.go", label2, false)
+	files.Add("src/watch/watch.go", label1, false)
+	files.Add("src/watch/stub.go", label2, false)
+	changes := newChangeSet()
+	assert.True(t, changes.Add(files, fsnotify.Event{Name: "src/watch/stub.go", Op: fsnotify.Write}))
+	assert.Equal(t, []core.BuildLabel{label2}, changes.Labels())
+	assert.True(t, changes.Add(files, fsnotify.Event{Name: "src/watch/watch.go", Op: fsnotify.Write}))
+	assert.Equal(t, []core.BuildLabel{label1, label2}, changes.Labels())
+}
+
+func TestWatchedFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "watched_files_test")
+	defer os.RemoveAll(dir)
+	files := newWatchedFiles()
+	assert.True(t, files.Add("src/watch/watch.go", label1, false))
+	assert.False(t, files.Add("src/watch/watch.go", label2, false), "File is already known")
+	assert.True(t, files.Add("src/watch/BUILD", label1, true))
+	assert.True(t, files.Add(dir, label2, false))
+
+	labels, isBuildFile := files.Get("src/watch/watch.go")
+	assert.Equal(t, []core.BuildLabel{label1, label2}, sorted(labels))
+	assert.False(t, isBuildFile)
+	labels, isBuildFile = files.Get("src/watch/BUILD")
+	assert.Equal(t, []core.BuildLabel{label1}, labels)
+	assert.True(t, isBuildFile)
+	labels, _ = files.Get("src/watch/stub.go")
+	assert.Equal(t, 0, len(labels))
+
+	assert.Equal(t, []core.BuildLabel{label1, label2}, sorted(files.GetDir("src/watch")))
+	// Directories that are sources themselves count as the directory to look in for new files.
+	assert.Equal(t, []core.BuildLabel{label2}, files.GetDir(dir))
+}
+
+func TestBuildCommand(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	state.Config.Build.Config = "dbg"
+	state.NumTestRuns = 3
+	cmd := buildCommand(state, "build", []core.BuildLabel{label1, label2})
+	assert.Equal(t, []string{"build", "-c", "dbg", "//src/watch:target1", "//src/watch:target2"}, cmd.Args[1:])
+	cmd = buildCommand(state, "test", []core.BuildLabel{label1})
+	assert.Equal(t, []string{"test", "-c", "dbg", "--num_runs", "3", "//src/watch:target1"}, cmd.Args[1:])
+}
+
+func TestBuildCommandForwardsTestFlags(t *testing.T) {
+	state := core.NewBuildState(1, nil, 4, core.DefaultConfiguration())
+	state.Config.Build.Config = "opt"
+	state.RepeatUntilFailure = 10
+	state.FlakyTimeoutMultiplier = 1.5
+	state.FailFastFlakes = true
+	state.FlakyMajority = true
+	state.EnforceDurations = true
+	state.TestFilter = "TestFoo.*"
+	state.HermeticTestEnv = true
+	state.ShowTestOutput = true
+	cmd := buildCommand(state, "test", []core.BuildLabel{label1})
+	assert.Equal(t, []string{
+		"test", "-c", "opt",
+		"--repeat_until_failure", "10",
+		"--flaky_timeout_multiplier", "1.5",
+		"--fail_fast_flakes",
+		"--flaky_policy", "majority",
+		"--enforce_durations",
+		"--test_filter", "TestFoo.*",
+		"--hermetic_env",
+		"--show_output",
+		"//src/watch:target1",
+	}, cmd.Args[1:])
+	// None of them mean anything to plz build.
+	cmd = buildCommand(state, "build", []core.BuildLabel{label1})
+	assert.Equal(t, []string{"build", "-c", "opt", "//src/watch:target1"}, cmd.Args[1:])
+}
+
+func TestBuildFinishes(t *testing.T) {
+	watcher, err := fsnotify.NewWatcher()
+	assert.NoError(t, err)
+	defer watcher.Close()
+	b := runBuild(exec.Command("true"))
+	assert.True(t, b.Wait(watcher, newWatchedFiles(), newChangeSet()))
+}
+
+func TestBuildIsStoppedByChanges(t *testing.T) {
+	watcher, err := fsnotify.NewWatcher()
+	assert.NoError(t, err)
+	defer watcher.Close()
+	files := newWatchedFiles()
+	files.Add("src/watch/watch.go", label1, false)
+	changes := newChangeSet()
+	b := runBuild(exec.Command("sleep", "10"))
+	go func() {
+		watcher.Events <- fsnotify.Event{Name: "src/watch/other.go", Op: fsnotify.Write}
+		watcher.Events <- fsnotify.Event{Name: "src/watch/watch.go", Op: fsnotify.Write}
+	}()
+	assert.False(t, b.Wait(watcher, files, changes))
+	assert.Equal(t, []core.BuildLabel{label1}, changes.Labels())
+	assert.False(t, b.cmd.ProcessState.Success(), "Build should have been interrupted")
+}
+
+func sorted(labels []core.BuildLabel) []core.BuildLabel {
+	sort.Sort(core.BuildLabels(labels))
+	return labels
+}
@@ -232,6 +232,9 @@ func main() {
     args := []string{os.Args[0], "-test.v"}
 {{end}}
     testVar := os.Getenv("TESTS")
+    if filter := os.Getenv("PLZ_TEST_FILTER"); filter != "" {
+        testVar = filter
+    }
     if testVar != "" {
         args = append(args, "-test.run", testVar)
     }
@@ -1,6 +1,7 @@
 """Customised test runner to output in JUnit-style XML."""
 
 import os
+import re
 import unittest
 import sys
 try:
@@ -34,6 +35,12 @@ def filter_suite(suite, test_names):
     return new_suite
 
 
+def filter_suite_regex(suite, test_filter):
+    """Reduces a test suite to just the tests whose names match the given regex."""
+    regex = re.compile(test_filter)
+    return unittest.suite.TestSuite(cls for cls, class_name in list_classes(suite) if regex.search(class_name))
+
+
 def initialise_coverage():
     """Imports & initialises the coverage module."""
     sys.meta_path.append(TracerImport())
@@ -97,6 +104,12 @@ def run_tests(test_names):
         suite = filter_suite(suite, test_names)
         if suite.countTestCases() == 0:
             raise Exception('No matching tests found')
+    test_filter = os.getenv('PLZ_TEST_FILTER')
+    if test_filter:
+        suite = filter_suite_regex(suite, test_filter)
+        if suite.countTestCases() == 0 and not os.path.exists('test.results'):
+            # Please reports this case itself; make sure it finds an (empty) set of results.
+            os.mkdir('test.results')
     runner = xmlrunner.XMLTestRunner(output='test.results', outsuffix='')
     results = runner.run(suite)
     return len(results.errors) + len(results.failures)